@@ -0,0 +1,192 @@
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State is the state of a Breaker.
+type State int32
+
+const (
+	// Closed lets all requests through while counting consecutive failures.
+	Closed State = iota
+
+	// Open rejects all requests until the cool-down has passed.
+	Open
+
+	// HalfOpen lets a single probe request through at a time. Successful probes
+	// close the breaker again, a failed one opens it.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+
+	return fmt.Sprintf("State(%d)", int32(s))
+}
+
+// OpenError is returned by Allow while the breaker rejects requests.
+type OpenError struct {
+	// RetryIn is the time left until the breaker lets a probe through.
+	RetryIn time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit breaker is open, retry in %s", e.RetryIn)
+}
+
+// RetryAfter returns RetryIn, so task workers wait for the cool-down instead of
+// their backoff delay.
+func (e *OpenError) RetryAfter() time.Duration {
+	return e.RetryIn
+}
+
+// Breaker stops sending requests to an endpoint after a number of consecutive
+// failures and lets a single probe through once a cool-down has passed.
+type Breaker struct {
+	failureThreshold int
+	successThreshold int
+	coolDown         time.Duration
+	onChange         func(from, to State)
+	now              func() time.Time
+
+	// state is written under mx but read atomically, so State never blocks.
+	state int32
+
+	mx        sync.Mutex
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+}
+
+// setState changes the state and returns a function reporting the transition,
+// to be called once mx is released.
+func (b *Breaker) setState(to State) func() {
+	from := State(atomic.LoadInt32(&b.state))
+	atomic.StoreInt32(&b.state, int32(to))
+
+	b.failures = 0
+	b.successes = 0
+	b.probing = false
+	if to == Open {
+		b.openedAt = b.now()
+	}
+
+	if b.onChange == nil || from == to {
+		return func() {}
+	}
+
+	return func() { b.onChange(from, to) }
+}
+
+// Allow reports whether a request may be sent now. It returns an *OpenError if
+// not. Every allowed request must be followed by a call to Done.
+func (b *Breaker) Allow() error {
+	notify := func() {}
+	defer func() { notify() }()
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	switch State(atomic.LoadInt32(&b.state)) {
+	case Open:
+		elapsed := b.now().Sub(b.openedAt)
+		if elapsed < b.coolDown {
+			return &OpenError{RetryIn: b.coolDown - elapsed}
+		}
+
+		notify = b.setState(HalfOpen)
+		b.probing = true
+	case HalfOpen:
+		if b.probing {
+			return &OpenError{RetryIn: b.coolDown}
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// Done records the outcome of a request allowed by Allow. Failures are meant to
+// be ones that indicate trouble with the endpoint, not rejected payloads.
+func (b *Breaker) Done(success bool) {
+	notify := func() {}
+	defer func() { notify() }()
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	switch State(atomic.LoadInt32(&b.state)) {
+	case Closed:
+		if success {
+			b.failures = 0
+			return
+		}
+
+		b.failures++
+		if b.failures >= b.failureThreshold {
+			notify = b.setState(Open)
+		}
+	case HalfOpen:
+		b.probing = false
+		if !success {
+			notify = b.setState(Open)
+			return
+		}
+
+		b.successes++
+		if b.successes >= b.successThreshold {
+			notify = b.setState(Closed)
+		}
+	case Open:
+		// Requests allowed before the breaker opened may finish while it's
+		// open. Their outcome is stale and ignored.
+	}
+}
+
+// State returns the current state without blocking.
+func (b *Breaker) State() State {
+	return State(atomic.LoadInt32(&b.state))
+}
+
+// NewBreaker creates a new Breaker instance that opens after failureThreshold
+// consecutive failures, waits coolDown before probing and closes again after
+// successThreshold successful probes. onChange, if not nil, is called on every
+// state transition. Use this function to instantiate a concrete Breaker type.
+func NewBreaker(failureThreshold, successThreshold int, coolDown time.Duration,
+	onChange func(from, to State)) (*Breaker, error) {
+
+	if failureThreshold < 1 {
+		return nil, errors.New("failureThreshold must be at least 1")
+	}
+
+	if successThreshold < 1 {
+		return nil, errors.New("successThreshold must be at least 1")
+	}
+
+	if coolDown <= 0 {
+		return nil, errors.New("coolDown must be positive")
+	}
+
+	b := &Breaker{
+		failureThreshold: failureThreshold,
+		successThreshold: successThreshold,
+		coolDown:         coolDown,
+		onChange:         onChange,
+		now:              time.Now,
+	}
+
+	return b, nil
+}
@@ -0,0 +1,158 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+type mockClock struct {
+	t time.Time
+}
+
+func (m *mockClock) now() time.Time {
+	return m.t
+}
+
+func newTestBreaker(t *testing.T, failures, successes int, transitions *[]State) (*Breaker, *mockClock) {
+	b, err := NewBreaker(failures, successes, time.Minute, func(from, to State) {
+		*transitions = append(*transitions, to)
+	})
+	if err != nil {
+		t.Fatalf("creating breaker failed with error: %s", err.Error())
+	}
+
+	clock := &mockClock{time.Now()}
+	b.now = clock.now
+	return b, clock
+}
+
+func TestNewBreaker(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		failures  int
+		successes int
+		coolDown  time.Duration
+	}{
+		{0, 1, time.Second},
+		{1, 0, time.Second},
+		{1, 1, 0},
+	}
+
+	for _, tc := range tests {
+		_, err := NewBreaker(tc.failures, tc.successes, tc.coolDown, nil)
+		if err == nil {
+			t.Errorf("given values %v are invalid", tc)
+			t.Fail()
+		}
+	}
+}
+
+func TestBreaker_WithConsecutiveFailuresShouldOpen(t *testing.T) {
+	t.Parallel()
+
+	var transitions []State
+	b, clock := newTestBreaker(t, 3, 1, &transitions)
+
+	// A success in between resets the failure count.
+	for _, success := range []bool{false, false, true, false, false} {
+		b.Allow()
+		b.Done(success)
+	}
+	if b.State() != Closed {
+		t.Errorf("expected %s, got %s", Closed, b.State())
+		t.Fail()
+	}
+
+	b.Allow()
+	b.Done(false)
+	if b.State() != Open {
+		t.Errorf("expected %s, got %s", Open, b.State())
+		t.FailNow()
+	}
+
+	clock.t = clock.t.Add(20 * time.Second)
+	err, ok := b.Allow().(*OpenError)
+	if !ok || err.RetryAfter() != 40*time.Second {
+		t.Errorf("expected an open error with 40s left, got %v", err)
+		t.Fail()
+	}
+
+	if len(transitions) != 1 || transitions[0] != Open {
+		t.Errorf("unexpected transitions: %v", transitions)
+		t.Fail()
+	}
+}
+
+func TestBreaker_WithHalfOpenShouldProbeOnce(t *testing.T) {
+	t.Parallel()
+
+	var transitions []State
+	b, clock := newTestBreaker(t, 1, 2, &transitions)
+
+	b.Allow()
+	b.Done(false)
+	clock.t = clock.t.Add(time.Minute)
+
+	if err := b.Allow(); err != nil {
+		t.Errorf("probe should be allowed after the cool-down, got %v", err)
+		t.Fail()
+	}
+
+	if b.State() != HalfOpen {
+		t.Errorf("expected %s, got %s", HalfOpen, b.State())
+		t.Fail()
+	}
+
+	if b.Allow() == nil {
+		t.Error("only a single probe should be allowed at a time")
+		t.Fail()
+	}
+
+	b.Done(true)
+	if b.State() != HalfOpen {
+		t.Error("a single successful probe should not close the breaker")
+		t.Fail()
+	}
+
+	b.Allow()
+	b.Done(true)
+	if b.State() != Closed {
+		t.Errorf("expected %s, got %s", Closed, b.State())
+		t.Fail()
+	}
+
+	want := []State{Open, HalfOpen, Closed}
+	if len(transitions) != len(want) {
+		t.Fatalf("unexpected transitions: %v", transitions)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("unexpected transitions: %v", transitions)
+			t.Fail()
+		}
+	}
+}
+
+func TestBreaker_WithFailedProbeShouldReopen(t *testing.T) {
+	t.Parallel()
+
+	var transitions []State
+	b, clock := newTestBreaker(t, 1, 1, &transitions)
+
+	b.Allow()
+	b.Done(false)
+	clock.t = clock.t.Add(time.Minute)
+
+	b.Allow()
+	b.Done(false)
+	if b.State() != Open {
+		t.Errorf("expected %s, got %s", Open, b.State())
+		t.Fail()
+	}
+
+	// The cool-down starts over.
+	if b.Allow() == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,265 @@
+package failover
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Strategy decides which healthy endpoint of a Pool gets the next request.
+type Strategy int
+
+const (
+	// Priority sends every request to the first healthy endpoint, so later ones
+	// only take over while earlier ones are down.
+	Priority Strategy = iota
+
+	// RoundRobin spreads requests evenly over all healthy endpoints.
+	RoundRobin
+
+	// LatencyWeighted picks healthy endpoints at random, weighted by the inverse
+	// of their average latency.
+	LatencyWeighted
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case Priority:
+		return "priority"
+	case RoundRobin:
+		return "round-robin"
+	case LatencyWeighted:
+		return "latency-weighted"
+	}
+
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// latencySmoothing is the weight of a new sample in the moving average latency
+// of an endpoint.
+const latencySmoothing = 0.2
+
+type endpoint struct {
+	healthy  bool
+	failures int
+
+	// retryAt is when an unhealthy endpoint gets its next probe request.
+	retryAt time.Time
+
+	// latency is the moving average latency of successful requests, zero until
+	// the first one.
+	latency time.Duration
+}
+
+// Pool tracks the health of a list of endpoints passively, from the outcome of
+// the requests sent to them, and picks the endpoint of every request. Endpoints
+// are marked unhealthy after a number of consecutive failures. Once a cool-down
+// has passed a single probe request is sent to an unhealthy endpoint, and a
+// successful one brings it back, which fails back to a recovered primary.
+type Pool struct {
+	strategy         Strategy
+	failureThreshold int
+	coolDown         time.Duration
+	onChange         func(i int, healthy bool)
+	now              func() time.Time
+	rand             func() float64
+
+	mx        sync.Mutex
+	endpoints []endpoint
+	cursor    int
+}
+
+// Next returns the index of the endpoint the next request goes to. Every call
+// must be followed by a call to Done.
+func (p *Pool) Next() int {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	now := p.now()
+	healthy := make([]int, 0, len(p.endpoints))
+	fallback := 0
+	for i := range p.endpoints {
+		e := &p.endpoints[i]
+		if e.healthy {
+			healthy = append(healthy, i)
+			continue
+		}
+
+		if !now.Before(e.retryAt) {
+			// Probing an endpoint postpones its next probe, so only one goes out
+			// per cool-down.
+			e.retryAt = now.Add(p.coolDown)
+			return i
+		}
+
+		if e.retryAt.Before(p.endpoints[fallback].retryAt) {
+			fallback = i
+		}
+	}
+
+	if len(healthy) == 0 {
+		// Everything is down. Try the endpoint due for a probe first.
+		return fallback
+	}
+
+	switch p.strategy {
+	case RoundRobin:
+		p.cursor++
+		return healthy[p.cursor%len(healthy)]
+	case LatencyWeighted:
+		return p.weighted(healthy)
+	}
+
+	return healthy[0]
+}
+
+// weighted picks one of candidates at random, weighted by the inverse of their
+// latency. Endpoints without latency samples weigh as much as the fastest one,
+// so they get a chance to be measured.
+func (p *Pool) weighted(candidates []int) int {
+	fastest := time.Duration(0)
+	for _, i := range candidates {
+		l := p.endpoints[i].latency
+		if l > 0 && (fastest == 0 || l < fastest) {
+			fastest = l
+		}
+	}
+
+	if fastest == 0 {
+		return candidates[int(p.rand()*float64(len(candidates)))%len(candidates)]
+	}
+
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for k, i := range candidates {
+		l := p.endpoints[i].latency
+		if l == 0 {
+			l = fastest
+		}
+
+		weights[k] = 1 / float64(l)
+		total += weights[k]
+	}
+
+	r := p.rand() * total
+	for k, w := range weights {
+		r -= w
+		if r < 0 {
+			return candidates[k]
+		}
+	}
+
+	return candidates[len(candidates)-1]
+}
+
+// Done records the outcome of a request sent to endpoint i. Failures are meant
+// to be ones that indicate trouble with the endpoint, not rejected payloads.
+// latency is only used for successful requests.
+func (p *Pool) Done(i int, success bool, latency time.Duration) {
+	notify := func() {}
+	defer func() { notify() }()
+
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if i < 0 || i >= len(p.endpoints) {
+		return
+	}
+
+	e := &p.endpoints[i]
+	if success {
+		e.failures = 0
+		if e.latency == 0 {
+			e.latency = latency
+		} else {
+			e.latency += time.Duration(latencySmoothing * float64(latency-e.latency))
+		}
+
+		if !e.healthy {
+			e.healthy = true
+			notify = p.notify(i, true)
+		}
+		return
+	}
+
+	e.failures++
+	if e.healthy && e.failures >= p.failureThreshold {
+		e.healthy = false
+		e.retryAt = p.now().Add(p.coolDown)
+		notify = p.notify(i, false)
+	}
+}
+
+func (p *Pool) notify(i int, healthy bool) func() {
+	if p.onChange == nil {
+		return func() {}
+	}
+
+	return func() { p.onChange(i, healthy) }
+}
+
+// AnyHealthy reports whether at least one endpoint is healthy.
+func (p *Pool) AnyHealthy() bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	for _, e := range p.endpoints {
+		if e.healthy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Healthy reports whether endpoint i is healthy.
+func (p *Pool) Healthy(i int) bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return i >= 0 && i < len(p.endpoints) && p.endpoints[i].healthy
+}
+
+// NewPool creates a new Pool instance for size endpoints picked by strategy. An
+// endpoint is marked unhealthy after failureThreshold consecutive failures and
+// probed again after coolDown. onChange, if not nil, is called whenever an
+// endpoint is marked unhealthy or healthy again. Use this function to
+// instantiate a concrete Pool type.
+func NewPool(size int, strategy Strategy, failureThreshold int, coolDown time.Duration,
+	onChange func(i int, healthy bool)) (*Pool, error) {
+
+	if size < 1 {
+		return nil, errors.New("size must be at least 1")
+	}
+
+	if strategy < Priority || strategy > LatencyWeighted {
+		return nil, errors.New("strategy is not valid")
+	}
+
+	if failureThreshold < 1 {
+		return nil, errors.New("failureThreshold must be at least 1")
+	}
+
+	if coolDown <= 0 {
+		return nil, errors.New("coolDown must be positive")
+	}
+
+	p := &Pool{
+		strategy:         strategy,
+		failureThreshold: failureThreshold,
+		coolDown:         coolDown,
+		onChange:         onChange,
+		now:              time.Now,
+		rand:             rand.Float64,
+		endpoints:        make([]endpoint, size),
+		cursor:           -1,
+	}
+
+	for i := range p.endpoints {
+		p.endpoints[i].healthy = true
+	}
+
+	return p, nil
+}
@@ -0,0 +1,194 @@
+package failover
+
+import (
+	"testing"
+	"time"
+)
+
+type mockClock struct {
+	t time.Time
+}
+
+func (m *mockClock) now() time.Time {
+	return m.t
+}
+
+type change struct {
+	i       int
+	healthy bool
+}
+
+func newTestPool(t *testing.T, size int, strategy Strategy, changes *[]change) (*Pool, *mockClock) {
+	p, err := NewPool(size, strategy, 2, time.Minute, func(i int, healthy bool) {
+		*changes = append(*changes, change{i, healthy})
+	})
+	if err != nil {
+		t.Fatalf("creating pool failed with error: %s", err.Error())
+	}
+
+	clock := &mockClock{time.Now()}
+	p.now = clock.now
+	return p, clock
+}
+
+func TestNewPool(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		size      int
+		strategy  Strategy
+		threshold int
+		coolDown  time.Duration
+	}{
+		{0, Priority, 1, time.Second},
+		{1, Strategy(-1), 1, time.Second},
+		{1, LatencyWeighted + 1, 1, time.Second},
+		{1, Priority, 0, time.Second},
+		{1, Priority, 1, 0},
+	}
+
+	for _, tc := range tests {
+		_, err := NewPool(tc.size, tc.strategy, tc.threshold, tc.coolDown, nil)
+		if err == nil {
+			t.Errorf("given values %v are invalid", tc)
+			t.Fail()
+		}
+	}
+}
+
+func TestPool_WithPriorityShouldFailOverAndBack(t *testing.T) {
+	t.Parallel()
+
+	var changes []change
+	p, clock := newTestPool(t, 2, Priority, &changes)
+
+	if i := p.Next(); i != 0 {
+		t.Fatalf("expected the primary, got %d", i)
+	}
+
+	// A success in between resets the failure count.
+	for _, success := range []bool{false, true, false} {
+		p.Done(0, success, time.Millisecond)
+	}
+	if !p.Healthy(0) || p.Next() != 0 {
+		t.Fatal("primary shouldn't be marked unhealthy yet")
+	}
+
+	p.Done(0, false, 0)
+	if p.Healthy(0) {
+		t.Fatal("primary should be marked unhealthy")
+	}
+
+	if i := p.Next(); i != 1 {
+		t.Fatalf("expected the secondary while the primary is down, got %d", i)
+	}
+	p.Done(1, true, time.Millisecond)
+
+	// The first request after the cool-down probes the primary and later ones
+	// keep going to the secondary until the probe succeeds.
+	clock.t = clock.t.Add(time.Minute)
+	if i := p.Next(); i != 0 {
+		t.Fatalf("expected a probe to the primary, got %d", i)
+	}
+	if i := p.Next(); i != 1 {
+		t.Fatalf("expected the secondary during the probe, got %d", i)
+	}
+
+	p.Done(0, false, 0)
+	if i := p.Next(); i != 1 {
+		t.Fatalf("a failed probe should keep the primary down, got %d", i)
+	}
+
+	clock.t = clock.t.Add(time.Minute)
+	if i := p.Next(); i != 0 {
+		t.Fatalf("expected another probe to the primary, got %d", i)
+	}
+	p.Done(0, true, time.Millisecond)
+
+	if i := p.Next(); i != 0 {
+		t.Fatalf("expected a fail-back to the primary, got %d", i)
+	}
+
+	expected := []change{{0, false}, {0, true}}
+	if len(changes) != len(expected) || changes[0] != expected[0] || changes[1] != expected[1] {
+		t.Errorf("expected changes %v, got %v", expected, changes)
+		t.Fail()
+	}
+}
+
+func TestPool_WithAllEndpointsDown(t *testing.T) {
+	t.Parallel()
+
+	var changes []change
+	p, clock := newTestPool(t, 2, Priority, &changes)
+
+	p.Done(1, false, 0)
+	p.Done(1, false, 0)
+	if !p.AnyHealthy() {
+		t.Error("expected the first endpoint to still be healthy")
+		t.Fail()
+	}
+
+	clock.t = clock.t.Add(time.Second)
+	p.Done(0, false, 0)
+	p.Done(0, false, 0)
+	if p.AnyHealthy() {
+		t.Error("expected no healthy endpoint")
+		t.Fail()
+	}
+
+	// The endpoint that went down first is due for a probe first.
+	if i := p.Next(); i != 1 {
+		t.Errorf("expected the endpoint down the longest, got %d", i)
+		t.Fail()
+	}
+}
+
+func TestPool_WithRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	var changes []change
+	p, _ := newTestPool(t, 3, RoundRobin, &changes)
+
+	counts := make([]int, 3)
+	for n := 0; n < 6; n++ {
+		counts[p.Next()]++
+	}
+
+	if counts[0] != 2 || counts[1] != 2 || counts[2] != 2 {
+		t.Errorf("expected requests to be spread evenly, got %v", counts)
+		t.Fail()
+	}
+
+	p.Done(1, false, 0)
+	p.Done(1, false, 0)
+	for n := 0; n < 4; n++ {
+		if i := p.Next(); i == 1 {
+			t.Fatal("unhealthy endpoint shouldn't get requests")
+		}
+	}
+}
+
+func TestPool_WithLatencyWeighted(t *testing.T) {
+	t.Parallel()
+
+	var changes []change
+	p, _ := newTestPool(t, 2, LatencyWeighted, &changes)
+
+	p.Done(0, true, 10*time.Millisecond)
+	p.Done(1, true, 90*time.Millisecond)
+
+	// Weights are 1/10 and 1/90, so the first endpoint takes 90%.
+	for _, tc := range []struct {
+		r float64
+		i int
+	}{{0, 0}, {0.89, 0}, {0.91, 1}, {0.99, 1}} {
+		r := tc.r
+		p.rand = func() float64 { return r }
+
+		if i := p.Next(); i != tc.i {
+			t.Errorf("expected endpoint %d for %v, got %d", tc.i, tc.r, i)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// actionsEnvelopeSize is an upper bound of the encoded size of an ActionsContainer
+// without actions. Its timestamp has the longest possible encoding.
+var actionsEnvelopeSize = func() int {
+	b, _ := json.Marshal(ActionsContainer{
+		Timestamp: time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.FixedZone("", -12*3600-30*60)),
+		Actions:   []ActionContainer{},
+	})
+	return len(b)
+}()
+
+// identitiesEnvelopeSize is the IdentitiesContainer counterpart of
+// actionsEnvelopeSize.
+var identitiesEnvelopeSize = func() int {
+	b, _ := json.Marshal(IdentitiesContainer{
+		Timestamp:  time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.FixedZone("", -12*3600-30*60)),
+		Identities: []IdentityContainer{},
+	})
+	return len(b)
+}()
+
+// PayloadTooLargeError is returned for objects that don't fit into a request on
+// their own because of the maximum payload size.
+type PayloadTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *PayloadTooLargeError) Error() string {
+	return fmt.Sprintf("encoded payload of %d bytes exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// checkSize returns a *PayloadTooLargeError if t can never be sent because of the
+// maximum payload size. It reports the encoded size of the object otherwise. The
+// object must have been encoded before.
+func (u *Uploader) checkSize(t uploadTask) (int, error) {
+	if u.maxPayloadSize == 0 {
+		return 0, nil
+	}
+
+	size := len(t.b)
+	if t.objType == objTypeAction {
+		size += actionsEnvelopeSize
+	}
+	if t.objType == objTypeIdentity && u.identitiesBatchSize > 1 {
+		size += identitiesEnvelopeSize
+	}
+
+	if size > u.maxPayloadSize {
+		return 0, &PayloadTooLargeError{Size: size, Limit: u.maxPayloadSize}
+	}
+
+	return len(t.b), nil
+}
+
+// batch is the content of a single request. Batches of actions and identities
+// keep their objects, so they can be split if the server finds them too large.
+// seqs, deliveries and links are either empty or aligned with the objects.
+type batch struct {
+	// id identifies the batch in log messages. Halves of a split batch extend
+	// the id of the batch they're split from.
+	id string
+
+	payloadType string
+	b           []byte
+	count       int
+	actions     []ActionContainer
+	identities  []IdentityContainer
+	seqs        []uint64
+	deliveries  []*Delivery
+	links       []interface{}
+
+	// send is built on the first attempt and reused by retries. attempts counts
+	// the requests sent and latency is the duration of the last one.
+	send     func(attempt int) error
+	attempts int
+	latency  time.Duration
+}
+
+func newActionsBatch(actions []ActionContainer, seqs []uint64, deliveries []*Delivery,
+	links []interface{}) (*batch, error) {
+
+	b, err := json.Marshal(ActionsContainer{
+		Timestamp: time.Now(),
+		Actions:   actions,
+	})
+
+	return &batch{
+		payloadType: PayloadTypeActions,
+		b:           b,
+		count:       len(actions),
+		actions:     actions,
+		seqs:        seqs,
+		deliveries:  deliveries,
+		links:       links,
+	}, err
+}
+
+func newIdentitiesBatch(identities []IdentityContainer, seqs []uint64) (*batch, error) {
+	b, err := json.Marshal(IdentitiesContainer{
+		Timestamp:  time.Now(),
+		Identities: identities,
+	})
+
+	return &batch{
+		payloadType: PayloadTypeIdentities,
+		b:           b,
+		count:       len(identities),
+		identities:  identities,
+		seqs:        seqs,
+	}, err
+}
+
+// size returns the number of objects the batch can be split into.
+func (bt *batch) size() int {
+	return len(bt.actions) + len(bt.identities)
+}
+
+// slice returns a new batch holding the objects from lo to hi. Encoding can't
+// fail since the objects were encoded before as part of bt.
+func (bt *batch) slice(lo, hi int) *batch {
+	var seqs []uint64
+	if len(bt.seqs) == bt.size() {
+		seqs = bt.seqs[lo:hi]
+	}
+
+	if bt.payloadType == PayloadTypeIdentities {
+		res, _ := newIdentitiesBatch(bt.identities[lo:hi], seqs)
+		return res
+	}
+
+	var deliveries []*Delivery
+	if len(bt.deliveries) == bt.size() {
+		deliveries = bt.deliveries[lo:hi]
+	}
+
+	var links []interface{}
+	if len(bt.links) == bt.size() {
+		links = bt.links[lo:hi]
+	}
+
+	res, _ := newActionsBatch(bt.actions[lo:hi], seqs, deliveries, links)
+	return res
+}
+
+// split halves a batch of actions or identities.
+func (bt *batch) split() (*batch, *batch) {
+	mid := bt.size() / 2
+	l, r := bt.slice(0, mid), bt.slice(mid, bt.size())
+	l.id, r.id = bt.id+".0", bt.id+".1"
+
+	return l, r
+}
+
+// mergeBatches joins what's left of a split batch back into a single one.
+func mergeBatches(parts []*batch) *batch {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+
+	var actions []ActionContainer
+	var identities []IdentityContainer
+	var seqs []uint64
+	var deliveries []*Delivery
+	var links []interface{}
+	for _, p := range parts {
+		actions = append(actions, p.actions...)
+		identities = append(identities, p.identities...)
+		seqs = append(seqs, p.seqs...)
+		deliveries = append(deliveries, p.deliveries...)
+		links = append(links, p.links...)
+	}
+
+	if parts[0].payloadType == PayloadTypeIdentities {
+		res, _ := newIdentitiesBatch(identities, seqs)
+		return res
+	}
+
+	res, _ := newActionsBatch(actions, seqs, deliveries, links)
+	return res
+}
+
+// isTooLarge reports whether err is the server rejecting a request body as too
+// large.
+func isTooLarge(err error) bool {
+	if perr, ok := err.(*permanentError); ok {
+		err = perr.err
+	}
+
+	herr, ok := err.(*HTTPError)
+	return ok && herr.StatusCode == http.StatusRequestEntityTooLarge
+}
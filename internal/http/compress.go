@@ -0,0 +1,92 @@
+package http
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+)
+
+// Compression is the encoding applied to request bodies.
+type Compression int
+
+const (
+	// CompressionNone sends request bodies as is.
+	CompressionNone Compression = iota
+
+	// CompressionGzip sends request bodies with Content-Encoding: gzip.
+	CompressionGzip
+
+	// CompressionDeflate sends request bodies with Content-Encoding: deflate,
+	// which is zlib wrapped DEFLATE data as HTTP defines it.
+	CompressionDeflate
+)
+
+func (c Compression) valid() bool {
+	return c >= CompressionNone && c <= CompressionDeflate
+}
+
+func (c Compression) encoding() string {
+	switch c {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionDeflate:
+		return "deflate"
+	}
+
+	return ""
+}
+
+func validCompressionLevel(level int) bool {
+	return level == 0 || (level >= flate.BestSpeed && level <= flate.BestCompression)
+}
+
+// compress encodes b with c at given level. A zero level means the default one.
+func compress(b []byte, c Compression, level int) ([]byte, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+
+	buf := &bytes.Buffer{}
+
+	var w io.WriteCloser
+	var err error
+	switch c {
+	case CompressionGzip:
+		w, err = gzip.NewWriterLevel(buf, level)
+	case CompressionDeflate:
+		w, err = zlib.NewWriterLevel(buf, level)
+	default:
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encodeBody compresses b if it's at least the minimum size and returns the
+// body to send along with its Content-Encoding, which is empty for raw bodies.
+func (u *Uploader) encodeBody(b []byte) ([]byte, string) {
+	if u.compression == CompressionNone || len(b) < u.compressionMinSize {
+		return b, ""
+	}
+
+	cb, err := compress(b, u.compression, u.compressionLevel)
+	if err != nil {
+		// Sending the raw body still works, just at a higher cost.
+		return b, ""
+	}
+
+	return cb, u.compression.encoding()
+}
@@ -5,6 +5,7 @@ import (
 )
 
 type ActionContainer struct {
+	ID              string                 `json:"id"`
 	Key             string                 `json:"key"`
 	UserKey         string                 `json:"user_key"`
 	IsAnonymousUser bool                   `json:"is_anonymous_user"`
@@ -21,3 +22,8 @@ type IdentityContainer struct {
 	UserKey  string                 `json:"user_key"`
 	Metadata map[string]interface{} `json:"metadata"`
 }
+
+type IdentitiesContainer struct {
+	Timestamp  time.Time           `json:"timestamp"`
+	Identities []IdentityContainer `json:"identities"`
+}
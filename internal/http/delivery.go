@@ -0,0 +1,96 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errUndelivered resolves deliveries of objects still spilled to the journal on
+// shutdown. They are sent after the next start but can't be tracked anymore.
+var errUndelivered = errors.New("uploader shut down before the object was sent")
+
+// Delivery tracks an object until the request carrying it either succeeded or
+// failed on its last retry.
+type Delivery struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newDelivery() *Delivery {
+	return &Delivery{done: make(chan struct{})}
+}
+
+// NewResolvedDelivery returns a Delivery that's already resolved with err.
+func NewResolvedDelivery(err error) *Delivery {
+	d := newDelivery()
+	d.resolve(err)
+
+	return d
+}
+
+// JoinDeliveries returns a Delivery that's resolved once all of ds are, with the
+// first error among them in order. Nil deliveries are skipped.
+func JoinDeliveries(ds ...*Delivery) *Delivery {
+	d := newDelivery()
+	go func() {
+		var err error
+		for _, dd := range ds {
+			if dd == nil {
+				continue
+			}
+
+			<-dd.done
+			if err == nil {
+				err = dd.err
+			}
+		}
+
+		d.resolve(err)
+	}()
+
+	return d
+}
+
+func (d *Delivery) resolve(err error) {
+	d.once.Do(func() {
+		d.err = err
+		close(d.done)
+	})
+}
+
+// Done returns a channel that's closed once the delivery is resolved.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns the error of the last attempt to send the object, or nil if it was
+// delivered or isn't resolved yet.
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the delivery is resolved and returns its error. It returns
+// ctx.Err() if ctx is done first.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func resolveAll(ds []*Delivery, err error) {
+	for _, d := range ds {
+		if d != nil {
+			d.resolve(err)
+		}
+	}
+}
@@ -1,24 +1,93 @@
 package http
 
 import (
+	"fmt"
 	"net/url"
 	"path"
 )
 
-func buildURL(baseURL, endpointURL string) (string, error) {
+const (
+	actionsPath    = "/events/send-actions"
+	identitiesPath = "/users/identify"
+)
+
+// Endpoints overrides the paths requests are sent to, relative to the base URL.
+type Endpoints struct {
+	// APIVersion is a path segment such as "v2" put between the base URL and every
+	// endpoint path. Empty means no prefix.
+	APIVersion string
+
+	// ActionsPath is the path action batches are sent to. Defaults to
+	// /events/send-actions.
+	ActionsPath string
+
+	// IdentitiesPath is the path identities are sent to. Defaults to
+	// /users/identify.
+	IdentitiesPath string
+}
+
+func buildURL(baseURL, apiVersion, endpointURL string) (string, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return "", err
 	}
 
-	u.Path = path.Join(u.Path, endpointURL)
+	u.Path = path.Join(u.Path, apiVersion, endpointURL)
 	return u.String(), nil
 }
 
-func buildActionsURL(baseURL string) (string, error) {
-	return buildURL(baseURL, "/events/send-actions")
+func buildActionsURL(baseURL string, e Endpoints) (string, error) {
+	p := e.ActionsPath
+	if len(p) == 0 {
+		p = actionsPath
+	}
+
+	return buildURL(baseURL, e.APIVersion, p)
+}
+
+func buildIdentitiesURL(baseURL string, e Endpoints) (string, error) {
+	p := e.IdentitiesPath
+	if len(p) == 0 {
+		p = identitiesPath
+	}
+
+	return buildURL(baseURL, e.APIVersion, p)
+}
+
+// endpointURLs holds the URLs of a single endpoint.
+type endpointURLs struct {
+	actions    string
+	identities string
 }
 
-func buildIdentitiesURL(baseURL string) (string, error) {
-	return buildURL(baseURL, "/users/identify")
+func buildEndpointURLs(baseURL string, e Endpoints) (endpointURLs, error) {
+	actions, err := buildActionsURL(baseURL, e)
+	if err != nil {
+		return endpointURLs{}, err
+	}
+
+	identities, err := buildIdentitiesURL(baseURL, e)
+	if err != nil {
+		return endpointURLs{}, err
+	}
+
+	return endpointURLs{actions: actions, identities: identities}, nil
+}
+
+// forPayload returns the URL requests of payloadType are sent to.
+func (eu endpointURLs) forPayload(payloadType string) string {
+	if payloadType == PayloadTypeActions {
+		return eu.actions
+	}
+
+	return eu.identities
+}
+
+func checkPayloadType(payloadType string) error {
+	switch payloadType {
+	case PayloadTypeActions, PayloadTypeIdentity, PayloadTypeIdentities:
+		return nil
+	}
+
+	return fmt.Errorf("unknown payload type %q", payloadType)
 }
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPError is returned for requests the server answered with a non-200 status.
+type HTTPError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Body is the response body. It's nil if reading the body failed.
+	Body []byte
+
+	// Header holds the response headers.
+	Header http.Header
+
+	readErr error
+}
+
+func (e *HTTPError) Error() string {
+	if e.readErr != nil {
+		return fmt.Sprintf(
+			"request failed with status code %d. parsing response failed: %s", e.StatusCode, e.readErr.Error())
+	}
+
+	return fmt.Sprintf(
+		"request failed with status code %d. got response: %s", e.StatusCode, string(e.Body))
+}
+
+// RetryAfter returns the delay requested by a 429 or 503 response through its
+// Retry-After header, or zero if there's none. It lets task workers wait
+// exactly as long as the server asks.
+func (e *HTTPError) RetryAfter() time.Duration {
+	if e.StatusCode != http.StatusTooManyRequests && e.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+
+	d, _ := parseRetryAfter(e.Header.Get("Retry-After"), time.Now())
+	return d
+}
+
+// permanentError marks a failure that retrying can't fix. Task workers give up
+// on the request right away and report the wrapped error.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Permanent() bool {
+	return true
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// deferredError marks a request that wasn't sent yet, such as one held back by
+// the circuit breaker. Task workers retry it after the delay of the wrapped error
+// without counting an attempt.
+type deferredError struct {
+	err error
+}
+
+func (e *deferredError) Error() string {
+	return e.err.Error()
+}
+
+func (e *deferredError) Deferred() bool {
+	return true
+}
+
+func (e *deferredError) Unwrap() error {
+	return e.err
+}
+
+// IsRetryable is the default retry classifier. Network errors and responses
+// with status 408, 429 or 5xx are retried, any other status is permanent.
+func IsRetryable(err error) bool {
+	herr, ok := err.(*HTTPError)
+	if !ok {
+		return true
+	}
+
+	switch {
+	case herr.StatusCode == http.StatusRequestTimeout:
+		return true
+	case herr.StatusCode == http.StatusTooManyRequests:
+		return true
+	case herr.StatusCode >= 500:
+		return true
+	}
+
+	return false
+}
+
+// parseRetryAfter parses a Retry-After header value given either in seconds or
+// as an HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if len(v) == 0 {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	d := t.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
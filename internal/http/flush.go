@@ -0,0 +1,144 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxCrashedFlights bounds the failed requests kept for the next Flush, so an
+// uploader that is never flushed doesn't grow without limit.
+const maxCrashedFlights = 100
+
+// FlushError is returned by Flush when some of the awaited requests failed. It
+// holds the error of the last attempt of every failed request.
+type FlushError struct {
+	Errs []error
+}
+
+func (e *FlushError) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+
+	if len(msgs) == 1 {
+		return fmt.Sprintf("1 request failed: %s", msgs[0])
+	}
+
+	return fmt.Sprintf("%d requests failed: %s", len(msgs), strings.Join(msgs, "; "))
+}
+
+// flight is a request handed over to the task manager that hasn't finished yet.
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// takeOff registers a new in-flight request.
+func (u *Uploader) takeOff() *flight {
+	f := &flight{done: make(chan struct{})}
+
+	u.flightMx.Lock()
+	u.flights[f] = struct{}{}
+	u.flightMx.Unlock()
+
+	return f
+}
+
+// land records the outcome of f and wakes up everyone waiting for it. Failed
+// requests are kept until the next Flush reports them.
+func (u *Uploader) land(f *flight, err error) {
+	f.err = err
+	close(f.done)
+
+	u.flightMx.Lock()
+	delete(u.flights, f)
+	if err != nil {
+		if len(u.crashed) == maxCrashedFlights {
+			u.crashed = u.crashed[1:]
+		}
+		u.crashed = append(u.crashed, f)
+	}
+	u.flightMx.Unlock()
+}
+
+// takeFlights returns the requests still in flight along with the ones that
+// failed since the last call.
+func (u *Uploader) takeFlights() []*flight {
+	u.flightMx.Lock()
+	defer u.flightMx.Unlock()
+
+	res := make([]*flight, 0, len(u.crashed)+len(u.flights))
+	res = append(res, u.crashed...)
+	for f := range u.flights {
+		res = append(res, f)
+	}
+	u.crashed = nil
+
+	return res
+}
+
+// flush sends out everything the goroutine holds, including buffered and spilled
+// objects, and returns the requests Flush has to wait for.
+func (u *Uploader) flush() []*flight {
+	u.drainBuffer()
+	if u.journal != nil {
+		u.drainSpill()
+	}
+	u.flushPending()
+
+	return u.takeFlights()
+}
+
+// Flush sends the pending actions batch along with all buffered objects and waits
+// until every request queued so far either succeeded or failed on its last retry.
+// Requests that failed since the previous Flush, up to the 100 most recent, are
+// reported as *FlushError. Flush returns ctx.Err() if ctx is
+// done before that.
+func (u *Uploader) Flush(ctx context.Context) error {
+	if u.inShutdown.IsSet() {
+		return errors.New("uploader is shutting down")
+	}
+
+	if !u.isStarted.IsSet() {
+		return nil
+	}
+
+	reply := make(chan []*flight, 1)
+	select {
+	case u.flushCh <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-u.doneCh:
+		return errors.New("uploader is shutting down")
+	}
+
+	// Handing over the batch may block on a busy task manager.
+	var flights []*flight
+	select {
+	case flights = <-reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var errs []error
+	for _, f := range flights {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if f.err != nil {
+			errs = append(errs, f.err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &FlushError{Errs: errs}
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package http
+
+import "time"
+
+// workerTaskManager is implemented by task managers that take the ID of a task
+// and tell its work which worker runs it.
+type workerTaskManager interface {
+	QueueTask(id string, work func(workerID string) error, done func(attempts int, err error)) error
+}
+
+// BatchInfo describes a batch of actions or identities to the batch hooks.
+type BatchInfo struct {
+	// ID identifies the batch. It's also the ID of its task and the batch_id in
+	// log messages. Halves of a batch the server found too large extend the ID
+	// of the batch they were split from.
+	ID          string
+	PayloadType string
+
+	// Actions and Identities hold the content of the batch. Identities holds a
+	// single identity for PayloadTypeIdentity.
+	Actions    []ActionContainer
+	Identities []IdentityContainer
+
+	// Attempt is the number of the attempt, starting at 1.
+	Attempt  int
+	WorkerID string
+
+	// Latency is the duration of the last request. Elapsed is the time since
+	// the batch was queued.
+	Latency time.Duration
+	Elapsed time.Duration
+
+	// Err is the error of the last attempt, nil if it succeeded.
+	Err error
+}
+
+func newBatchInfo(bt *batch, attempt int, workerID string, queued time.Time, err error) BatchInfo {
+	return BatchInfo{
+		ID:          bt.id,
+		PayloadType: bt.payloadType,
+		Actions:     bt.actions,
+		Identities:  bt.identities,
+		Attempt:     attempt,
+		WorkerID:    workerID,
+		Latency:     bt.latency,
+		Elapsed:     time.Since(queued),
+		Err:         err,
+	}
+}
+
+// onSent calls the hook matching the payload type of a sent batch.
+func (u *Uploader) onSent(bt *batch, attempt int, workerID string, queued time.Time) {
+	hook := u.onBatchSent
+	if bt.payloadType != PayloadTypeActions {
+		hook = u.onIdentitySent
+	}
+
+	if hook != nil {
+		hook(newBatchInfo(bt, attempt, workerID, queued, nil))
+	}
+}
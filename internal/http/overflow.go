@@ -0,0 +1,187 @@
+package http
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to new objects while the Uploader can't
+// keep up and its buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes callers wait until there's room in the buffer.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest rejects new objects with ErrBufferFull.
+	OverflowDropNewest
+
+	// OverflowDropOldest evicts the oldest buffered object to make room.
+	OverflowDropOldest
+
+	// OverflowSpillToDisk keeps new objects in the journal and reads them back
+	// once the buffer drains. It requires a journal.
+	OverflowSpillToDisk
+)
+
+// ErrBufferFull is returned for objects dropped because the buffer is full.
+var ErrBufferFull = errors.New("buffer is full")
+
+func (p OverflowPolicy) valid() bool {
+	return p >= OverflowBlock && p <= OverflowSpillToDisk
+}
+
+// offer queues t without blocking and applies the overflow policy if the buffer
+// is full.
+func (u *Uploader) offer(t uploadTask) error {
+	if u.overflow == OverflowSpillToDisk && u.spillIfSpilling(t) {
+		return nil
+	}
+
+	for {
+		select {
+		case u.tasks <- t:
+			return nil
+		default:
+		}
+
+		switch u.overflow {
+		case OverflowDropNewest:
+			u.drop(t)
+			return ErrBufferFull
+		case OverflowDropOldest:
+			select {
+			case old := <-u.tasks:
+				u.drop(old)
+			default:
+			}
+		case OverflowSpillToDisk:
+			u.spill(t)
+			return nil
+		}
+	}
+}
+
+// drop counts t as dropped and removes it from the journal.
+func (u *Uploader) drop(t uploadTask) {
+	u.logger.Warn("dropped object because the buffer is full", "type", t.objType)
+	u.dequeue(t.objects())
+
+	switch t.objType {
+	case objTypeAction:
+		atomic.AddInt64(&u.droppedActions, 1)
+	case objTypeIdentity:
+		atomic.AddInt64(&u.droppedIdentities, 1)
+	case objTypePayload:
+		obj := t.obj.(payload)
+		if obj.payloadType == PayloadTypeActions {
+			atomic.AddInt64(&u.droppedActions, int64(obj.count))
+		} else {
+			atomic.AddInt64(&u.droppedIdentities, int64(obj.count))
+		}
+	}
+
+	if u.journal != nil && t.seq != 0 {
+		u.journal.Ack(t.seq)
+	}
+
+	if t.delivery != nil {
+		t.delivery.resolve(ErrBufferFull)
+	}
+}
+
+// spillIfSpilling spills t if older objects are still spilled, which keeps
+// objects in order until the spill is drained.
+func (u *Uploader) spillIfSpilling(t uploadTask) bool {
+	u.spillMx.Lock()
+	spilling := len(u.spilled) > 0
+	u.spillMx.Unlock()
+
+	if spilling {
+		u.spill(t)
+	}
+	return spilling
+}
+
+// spill leaves t in the journal and only remembers its sequence number,
+// delivery and trace link. Objects that aren't journaled, such as resubmitted payloads, are
+// dropped instead.
+func (u *Uploader) spill(t uploadTask) {
+	if t.seq == 0 {
+		u.drop(t)
+		return
+	}
+
+	u.spillMx.Lock()
+	u.spilled = append(u.spilled, uploadTask{seq: t.seq, delivery: t.delivery, link: t.link})
+	u.spillMx.Unlock()
+
+	select {
+	case u.spillCh <- struct{}{}:
+	default:
+	}
+}
+
+// drainSpill reads spilled objects back from the journal while the buffer is
+// empty. Buffered objects are older, so draining stops as soon as there are any
+// and resumes on the next spill signal.
+func (u *Uploader) drainSpill() {
+	for len(u.tasks) == 0 {
+		u.spillMx.Lock()
+		if len(u.spilled) == 0 {
+			u.spillMx.Unlock()
+			return
+		}
+		st := u.spilled[0]
+		u.spilled = u.spilled[1:]
+		u.spillMx.Unlock()
+
+		b, err := u.journal.Read(st.seq)
+		if err != nil {
+			u.dequeue(1)
+			if st.delivery != nil {
+				st.delivery.resolve(err)
+			}
+			continue
+		}
+
+		t, ok := decodeJournalRecord(st.seq, b)
+		if !ok {
+			u.dequeue(1)
+			u.journal.Ack(st.seq)
+			if st.delivery != nil {
+				st.delivery.resolve(errors.New("spilled object can't be decoded"))
+			}
+			continue
+		}
+
+		t.delivery = st.delivery
+		t.link = st.link
+		u.handle(t)
+	}
+
+	select {
+	case u.spillCh <- struct{}{}:
+	default:
+	}
+}
+
+// releaseSpill resolves the deliveries of objects still spilled on shutdown. The
+// objects themselves stay in the journal for the next start.
+func (u *Uploader) releaseSpill() {
+	u.spillMx.Lock()
+	defer u.spillMx.Unlock()
+
+	u.dequeue(len(u.spilled))
+	for _, st := range u.spilled {
+		if st.delivery != nil {
+			st.delivery.resolve(errUndelivered)
+		}
+	}
+}
+
+// Dropped returns the number of actions and identities dropped by the overflow
+// policy so far.
+func (u *Uploader) Dropped() (actions int64, identities int64) {
+	return atomic.LoadInt64(&u.droppedActions), atomic.LoadInt64(&u.droppedIdentities)
+}
@@ -0,0 +1,206 @@
+package http
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the request latency histograms.
+var latencyBounds = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// maxStatusCode bounds the status codes counted per endpoint. Anything above
+// is counted as maxStatusCode.
+const maxStatusCode = 599
+
+// histogram counts observations per latency bucket. The last count holds the
+// observations above the largest bucket.
+type histogram struct {
+	sum    int64
+	counts [len(latencyBounds) + 1]int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// endpointStats holds the counters of requests sent to a single endpoint. All
+// fields are accessed atomically.
+type endpointStats struct {
+	requests        int64
+	transportErrors int64
+	statuses        [maxStatusCode + 1]int64
+	latency         histogram
+}
+
+func (es *endpointStats) record(status int, d time.Duration) {
+	atomic.AddInt64(&es.requests, 1)
+	es.latency.observe(d)
+
+	if status == 0 {
+		atomic.AddInt64(&es.transportErrors, 1)
+		return
+	}
+
+	if status > maxStatusCode {
+		status = maxStatusCode
+	}
+	atomic.AddInt64(&es.statuses[status], 1)
+}
+
+// uploaderStats holds the counters behind Stats. All fields are accessed
+// atomically, so the hot path never takes a lock.
+type uploaderStats struct {
+	actionsEmitted    int64
+	identitiesEmitted int64
+	batchesSent       int64
+	bytesSent         int64
+	retries           int64
+	permanentFailures int64
+	inFlight          int64
+
+	// queued is the number of objects accepted but neither sent nor given up on.
+	queued int64
+
+	actions    endpointStats
+	identities endpointStats
+}
+
+func (s *uploaderStats) endpoint(payloadType string) *endpointStats {
+	if payloadType == PayloadTypeActions {
+		return &s.actions
+	}
+
+	return &s.identities
+}
+
+// Histogram is a snapshot of a latency histogram. Counts[i] is the number of
+// observations up to Bounds[i] and above Bounds[i-1]. The last count holds the
+// observations above the largest bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []int64
+	Count  int64
+	Sum    time.Duration
+}
+
+// EndpointStats is a snapshot of the requests sent to a single endpoint.
+type EndpointStats struct {
+	// Requests is the number of requests sent, retries included.
+	Requests int64
+
+	// TransportErrors is the number of requests that got no response.
+	TransportErrors int64
+
+	// StatusCodes maps response status codes to their number of responses.
+	StatusCodes map[int]int64
+
+	// Latency is the distribution of request durations.
+	Latency Histogram
+}
+
+func (es *endpointStats) snapshot() EndpointStats {
+	res := EndpointStats{
+		Requests:        atomic.LoadInt64(&es.requests),
+		TransportErrors: atomic.LoadInt64(&es.transportErrors),
+		StatusCodes:     make(map[int]int64),
+		Latency: Histogram{
+			Bounds: append([]time.Duration(nil), latencyBounds[:]...),
+			Counts: make([]int64, len(es.latency.counts)),
+			Sum:    time.Duration(atomic.LoadInt64(&es.latency.sum)),
+		},
+	}
+
+	for code := range es.statuses {
+		if n := atomic.LoadInt64(&es.statuses[code]); n > 0 {
+			res.StatusCodes[code] = n
+		}
+	}
+
+	for i := range es.latency.counts {
+		res.Latency.Counts[i] = atomic.LoadInt64(&es.latency.counts[i])
+		res.Latency.Count += res.Latency.Counts[i]
+	}
+
+	return res
+}
+
+// Stats is a snapshot of the Uploader counters and gauges. Counters only ever
+// grow, so rates can be derived from consecutive snapshots.
+type Stats struct {
+	ActionsEmitted    int64
+	IdentitiesEmitted int64
+	ActionsDropped    int64
+	IdentitiesDropped int64
+
+	// BatchesSent is the number of requests the server accepted.
+	BatchesSent int64
+
+	// BytesSent is the size of all request bodies sent as they went over the
+	// wire, retries included.
+	BytesSent int64
+
+	// Retries is the number of request attempts after the first one.
+	Retries int64
+
+	// PermanentFailures is the number of requests given up on.
+	PermanentFailures int64
+
+	// QueueDepth is the number of objects accepted but neither sent nor given up
+	// on yet, whether they are buffered, spilled to the journal, batched or in
+	// flight.
+	QueueDepth int
+
+	// TaskQueueDepth is the number of requests waiting for a task worker.
+	TaskQueueDepth int
+
+	// InFlight is the number of requests being sent right now.
+	InFlight int64
+
+	// Endpoints holds the request stats keyed by endpoint path. Keys are the
+	// default paths even if Endpoints overrides them, so they stay stable.
+	Endpoints map[string]EndpointStats
+}
+
+// Stats returns a snapshot of the uploader counters and gauges.
+func (u *Uploader) Stats() Stats {
+	res := Stats{
+		ActionsEmitted:    atomic.LoadInt64(&u.stats.actionsEmitted),
+		IdentitiesEmitted: atomic.LoadInt64(&u.stats.identitiesEmitted),
+		ActionsDropped:    atomic.LoadInt64(&u.droppedActions),
+		IdentitiesDropped: atomic.LoadInt64(&u.droppedIdentities),
+		BatchesSent:       atomic.LoadInt64(&u.stats.batchesSent),
+		BytesSent:         atomic.LoadInt64(&u.stats.bytesSent),
+		Retries:           atomic.LoadInt64(&u.stats.retries),
+		PermanentFailures: atomic.LoadInt64(&u.stats.permanentFailures),
+		QueueDepth:        int(atomic.LoadInt64(&u.stats.queued)),
+		InFlight:          atomic.LoadInt64(&u.stats.inFlight),
+		Endpoints: map[string]EndpointStats{
+			actionsPath:    u.stats.actions.snapshot(),
+			identitiesPath: u.stats.identities.snapshot(),
+		},
+	}
+
+	if d, ok := u.tm.(interface{ QueueDepth() int }); ok {
+		res.TaskQueueDepth = d.QueueDepth()
+	}
+
+	return res
+}
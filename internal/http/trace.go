@@ -0,0 +1,48 @@
+package http
+
+import "context"
+
+// Tracer traces emitted actions and the requests carrying them. StartEmit is
+// called with the context of every emitted action and returns a link to the
+// emit, which is handed back to StartUpload for every request carrying the
+// action, and a function ending the emit once the action is queued or rejected.
+// StartUpload is called before every request attempt and returns the context to
+// send the request with and a function called once the request completes, with
+// the response status code, zero if there was no response, and the error.
+type Tracer interface {
+	StartEmit(ctx context.Context) (link interface{}, end func(err error))
+	StartUpload(ctx context.Context, info UploadInfo) (context.Context, func(status int, err error))
+}
+
+// UploadInfo describes a single request attempt to a Tracer.
+type UploadInfo struct {
+	PayloadType string
+	URL         string
+
+	// Attempt counts the attempts of sending the same batch, starting at 1.
+	Attempt int
+
+	// PayloadSize is the size of the request body in bytes as sent, after
+	// compression.
+	PayloadSize int
+
+	// EventCount is the number of objects carried by the request.
+	EventCount int
+
+	// Links holds the links returned by StartEmit for the actions carried by the
+	// request.
+	Links []interface{}
+}
+
+// emitLinks returns the links of the actions in bt, skipping those emitted
+// without tracing.
+func emitLinks(bt *batch) []interface{} {
+	var links []interface{}
+	for _, l := range bt.links {
+		if l != nil {
+			links = append(links, l)
+		}
+	}
+
+	return links
+}
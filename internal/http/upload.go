@@ -2,6 +2,9 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,145 +12,824 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dataart-ai/dataart-go/internal/pkg/atomicutil"
+	"github.com/dataart-ai/dataart-go/internal/pkg/randomutil"
 )
 
 const (
 	objTypeAction   = "action"
 	objTypeIdentity = "identity"
+	objTypePayload  = "payload"
+
+	// PayloadTypeActions marks an encoded ActionsContainer request body.
+	PayloadTypeActions = "actions"
+	// PayloadTypeIdentity marks an encoded IdentityContainer request body.
+	PayloadTypeIdentity = "identity"
+	// PayloadTypeIdentities marks an encoded IdentitiesContainer request body.
+	PayloadTypeIdentities = "identities"
 
 	minUploadInterval = time.Duration(5 * time.Second)
 )
 
 type TaskManager interface {
-	Queue(work func() error) error
-	Shutdown()
+	QueueWithCallback(work func() error, done func(attempts int, err error)) error
+	ShutdownContext(ctx context.Context) error
+}
+
+// Journal persists queued objects until they are delivered to the server so
+// they can be replayed after a crash.
+type Journal interface {
+	Append(b []byte) (uint64, error)
+	Ack(seqs ...uint64) error
+	Read(seq uint64) ([]byte, error)
+	Replay(fn func(seq uint64, b []byte) error) error
+	Close() error
+}
+
+// CircuitBreaker guards the ingest endpoint. Allow returns an error while
+// requests should not be sent, preferably one with a RetryAfter method telling
+// how long to wait. Every allowed request is followed by a call to Done.
+type CircuitBreaker interface {
+	Allow() error
+	Done(success bool)
+}
+
+// EndpointSelector picks the endpoint of every request attempt among the base URL
+// and the fallback URLs, indexed in that order. Every call to Next is followed by
+// a call to Done with the outcome of the attempt. AnyHealthy reports whether an
+// endpoint is still considered healthy.
+type EndpointSelector interface {
+	Next() int
+	Done(i int, success bool, latency time.Duration)
+	AnyHealthy() bool
+}
+
+// RateLimiter delays requests to stay below a quota. Wait blocks until a request
+// carrying given number of events may be sent.
+type RateLimiter interface {
+	Wait(ctx context.Context, events int) error
 }
 
 type uploadTask struct {
 	objType string
 	obj     interface{}
+
+	// b is the JSON encoding of obj. It's only set if the maximum payload size
+	// or the journal need it, so objects are encoded once on their way in.
+	b []byte
+
+	// seq is the journal sequence number of obj. Zero means obj is not journaled.
+	seq uint64
+
+	// delivery is resolved once obj is sent or given up on. It's nil unless the
+	// caller asked to track obj.
+	delivery *Delivery
+
+	// link is the link to the traced emit of obj, if any.
+	link interface{}
+}
+
+// objects returns the number of actions or identities t holds.
+func (t uploadTask) objects() int {
+	if p, ok := t.obj.(payload); ok {
+		return p.count
+	}
+
+	return 1
+}
+
+// dequeue counts n objects as no longer queued because they were sent, given up
+// on or dropped.
+func (u *Uploader) dequeue(n int) {
+	atomic.AddInt64(&u.stats.queued, -int64(n))
+}
+
+// UploaderOptions holds the optional collaborators of an Uploader. The zero value
+// is valid and disables all of them.
+type UploaderOptions struct {
+	// Endpoints overrides the paths requests are sent to.
+	Endpoints Endpoints
+
+	// FallbackURLs are base URLs requests may be sent to besides the primary
+	// one. They require Selector, which picks the endpoint of every attempt.
+	FallbackURLs []string
+	Selector     EndpointSelector
+
+	// Journal persists objects until they are delivered. Pending objects from
+	// earlier runs are replayed when the Uploader is created.
+	Journal Journal
+
+	// Overflow decides what happens to new objects while the buffer is full.
+	// Defaults to OverflowBlock.
+	Overflow OverflowPolicy
+
+	// BufferSize is the number of objects buffered before Overflow kicks in.
+	// It's only used with non-blocking policies and defaults to 1.
+	BufferSize int
+
+	// Compression is the encoding applied to request bodies. Defaults to
+	// CompressionNone.
+	Compression Compression
+
+	// CompressionLevel is the compression level from 1 (best speed) to 9 (best
+	// compression). Zero means the default level.
+	CompressionLevel int
+
+	// CompressionMinSize is the size in bytes below which request bodies are
+	// sent uncompressed.
+	CompressionMinSize int
+
+	// Retryable decides whether a failed request is worth retrying. Defaults to
+	// IsRetryable.
+	Retryable func(err error) bool
+
+	// Breaker, if set, is consulted before every request. Rejected requests are
+	// deferred: task workers retry them after the RetryAfter delay of the
+	// breaker's error without counting an attempt, unless BreakerFailFast is set.
+	// Once the uploader shuts down, task managers that implement FailDeferred
+	// fail them instead.
+	Breaker CircuitBreaker
+
+	// BreakerFailFast makes requests rejected by Breaker fail permanently
+	// instead of waiting for the breaker to close.
+	BreakerFailFast bool
+
+	// IdentitiesBatchSize is the number of identities sent in a single request.
+	// Identities for the same user key replace each other within a batch. Values
+	// up to 1 send each identity on its own as an IdentityContainer, otherwise
+	// batches are sent as IdentitiesContainer.
+	IdentitiesBatchSize int
+
+	// MaxPayloadSize is the maximum size in bytes of an encoded request body
+	// before compression. Action batches are cut before they exceed it and
+	// objects that can't fit on their own are rejected with a
+	// *PayloadTooLargeError. Zero means no limit.
+	MaxPayloadSize int
+
+	// RateLimiter, if set, delays every request attempt, retries included, until
+	// it's allowed. Delayed requests hold up their task worker, so a saturated
+	// limiter eventually fills the buffer and Overflow kicks in.
+	RateLimiter RateLimiter
+
+	// Tracer, if set, traces emitted actions and every request attempt.
+	Tracer Tracer
+
+	// Logger receives lifecycle events, failed requests, drops and permanent
+	// failures. Defaults to NopLogger.
+	Logger Logger
+
+	// OnBatchSent is called from a task worker after a batch of actions was
+	// delivered and OnIdentitySent after identities were. Halves of a split
+	// batch are reported one by one.
+	OnBatchSent    func(info BatchInfo)
+	OnIdentitySent func(info BatchInfo)
+
+	// OnBatchRetry is called from a task worker before a batch is retried, with
+	// the error of the previous attempt.
+	OnBatchRetry func(info BatchInfo)
+
+	// OnBatchFailed is called once a batch is given up on, before it's handed
+	// to DeadLetterHook.
+	OnBatchFailed func(info BatchInfo)
+
+	// DeadLetterHook receives request payloads that failed on their last retry.
+	// Their journal entries are acknowledged afterwards even if it fails, except
+	// for payloads abandoned on shutdown, which are only acknowledged if it
+	// returns nil.
+	DeadLetterHook func(payloadType string, payload []byte, attempts int, err error) error
+}
+
+type payload struct {
+	payloadType string
+	b           []byte
+	count       int
+	actions     []ActionContainer
+	identities  []IdentityContainer
+}
+
+// Unsent is the number of objects an Uploader gave up on because its shutdown
+// deadline expired.
+type Unsent struct {
+	Actions    int
+	Identities int
+}
+
+// journalRecord is a journal entry. Objects are kept as they were encoded on
+// their way in.
+type journalRecord struct {
+	ObjType  string          `json:"type"`
+	Action   json.RawMessage `json:"action,omitempty"`
+	Identity json.RawMessage `json:"identity,omitempty"`
 }
 
 // Uploader receives data objects and batches them if necessary in a request. These
 // requests are then executed using a task manager.
 type Uploader struct {
-	baseURL        string
+	// Accessed atomically, kept first for 64-bit alignment on 32-bit platforms.
+	unsentActions     int64
+	unsentIdentities  int64
+	droppedActions    int64
+	droppedIdentities int64
+	stats             uploaderStats
+
+	urls           []endpointURLs
+	selector       EndpointSelector
 	apiKey         string
 	batchSize      int
 	uploadInterval time.Duration
 	httpClient     *http.Client
 
-	tasks  chan uploadTask
-	doneCh chan struct{}
+	tasks    chan uploadTask
+	doneCh   chan struct{}
+	overflow OverflowPolicy
+
+	compression        Compression
+	compressionLevel   int
+	compressionMinSize int
+
+	spillMx sync.Mutex
+	spilled []uploadTask
+	spillCh chan struct{}
+
+	flightMx sync.Mutex
+	flights  map[*flight]struct{}
+	crashed  []*flight
+	flushCh  chan chan []*flight
+
+	// ctx is the parent of all requests and is canceled to abort in-flight
+	// requests once the shutdown deadline expires.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	shutdownCtx context.Context
+
+	actionsBatch      []ActionContainer
+	actionsSeqs       []uint64
+	actionsDeliveries []*Delivery
+	actionsLinks      []interface{}
+	actionsSize       int
+
+	// Identities are batched only if identitiesBatchSize is greater than 1.
+	// identitiesIndex maps user keys to their position in the batch.
+	identitiesBatchSize int
+	identitiesBatch     []IdentityContainer
+	identitiesSeqs      []uint64
+	identitiesSizes     []int
+	identitiesSize      int
+	identitiesIndex     map[string]int
 
-	actionsBatch []ActionContainer
+	maxPayloadSize int
 
-	tm TaskManager
+	tm             TaskManager
+	journal        Journal
+	deadLetterHook func(payloadType string, payload []byte, attempts int, err error) error
+	retryable      func(err error) bool
+	breaker        CircuitBreaker
+	failFast       bool
+	limiter        RateLimiter
+	tracer         Tracer
+	logger         Logger
+	onBatchSent    func(info BatchInfo)
+	onIdentitySent func(info BatchInfo)
+	onBatchRetry   func(info BatchInfo)
+	onBatchFailed  func(info BatchInfo)
+	recovered      []uploadTask
 
 	wg         sync.WaitGroup
 	once       sync.Once
 	inShutdown atomicutil.Bool
 	isStarted  atomicutil.Bool
+	abandoned  atomicutil.Bool
 }
 
-func (u *Uploader) buildRequest(url string, b []byte) func() error {
-	return func() error {
-		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
-		if err != nil {
+// idempotencyKey derives the Idempotency-Key header from the request payload, so
+// retries and resubmissions of the same payload share a key the server can use
+// for deduplication.
+func idempotencyKey(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:16])
+}
+
+// buildRequest returns a function sending bt to the endpoint picked by the
+// selector for every attempt. Every attempt is traced if there's a tracer.
+func (u *Uploader) buildRequest(bt *batch, es *endpointStats) func(attempt int) error {
+	body, encoding := u.encodeBody(bt.b)
+	key := idempotencyKey(bt.b)
+	links := emitLinks(bt)
+
+	return func(attempt int) error {
+		i := u.nextEndpoint()
+		url := u.urls[i].forPayload(bt.payloadType)
+		started := time.Now()
+
+		if u.tracer == nil {
+			_, err := u.doRequest(u.ctx, url, body, encoding, key, es)
+			u.endpointDone(i, err, time.Since(started))
 			return err
 		}
 
-		req.Header.Add("User-Agent", "dataart-go")
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("Content-Length", fmt.Sprint(len(b)))
-		req.Header.Add("X-API-Key", u.apiKey)
+		ctx, finish := u.tracer.StartUpload(u.ctx, UploadInfo{
+			PayloadType: bt.payloadType,
+			URL:         url,
+			Attempt:     attempt,
+			PayloadSize: len(body),
+			EventCount:  bt.count,
+			Links:       links,
+		})
+		status, err := u.doRequest(ctx, url, body, encoding, key, es)
+		u.endpointDone(i, err, time.Since(started))
+		finish(status, err)
 
-		res, err := u.httpClient.Do(req)
-		if err != nil {
+		return err
+	}
+}
+
+// nextEndpoint returns the index of the endpoint the next attempt goes to.
+func (u *Uploader) nextEndpoint() int {
+	if u.selector == nil {
+		return 0
+	}
+
+	return u.selector.Next()
+}
+
+// endpointDone reports the outcome of an attempt to the selector. Like with the
+// circuit breaker only failures pointing at the endpoint count: network errors
+// and retryable statuses. Other responses, such as a 400 for a malformed batch,
+// show the endpoint is up and count as healthy. Requests aborted on shutdown
+// don't count.
+func (u *Uploader) endpointDone(i int, err error, latency time.Duration) {
+	if u.selector == nil || u.ctx.Err() != nil {
+		return
+	}
+
+	u.selector.Done(i, err == nil || !IsRetryable(err), latency)
+}
+
+// doRequest posts body to url and returns the response status code, zero if
+// there was no response.
+func (u *Uploader) doRequest(ctx context.Context, url string, body []byte, encoding, key string,
+	es *endpointStats) (int, error) {
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Add("User-Agent", "dataart-go")
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Content-Length", fmt.Sprint(len(body)))
+	req.Header.Add("X-API-Key", u.apiKey)
+	req.Header.Add("Idempotency-Key", key)
+	if len(encoding) > 0 {
+		req.Header.Add("Content-Encoding", encoding)
+	}
+
+	atomic.AddInt64(&u.stats.inFlight, 1)
+	atomic.AddInt64(&u.stats.bytesSent, int64(len(body)))
+	started := time.Now()
+
+	res, err := u.httpClient.Do(req)
+	atomic.AddInt64(&u.stats.inFlight, -1)
+	if err != nil {
+		es.record(0, time.Since(started))
+		return 0, err
+	}
+	defer res.Body.Close()
+	es.record(res.StatusCode, time.Since(started))
+
+	if res.StatusCode != http.StatusOK {
+		content, err := ioutil.ReadAll(res.Body)
+		return res.StatusCode, &HTTPError{
+			StatusCode: res.StatusCode,
+			Body:       content,
+			Header:     res.Header,
+			readErr:    err,
+		}
+	}
+
+	return res.StatusCode, nil
+}
+
+// admit waits for the rate limiter and consults the circuit breaker before p is
+// sent. Requests the breaker rejects are deferred, or fail permanently with
+// BreakerFailFast.
+func (u *Uploader) admit(p *batch) error {
+	if u.limiter != nil {
+		if err := u.limiter.Wait(u.ctx, p.count); err != nil {
 			return err
 		}
-		defer res.Body.Close()
+	}
+
+	if u.breaker != nil {
+		if err := u.breaker.Allow(); err != nil {
+			if u.failFast {
+				return &permanentError{err}
+			}
+			return &deferredError{err}
+		}
+	}
+
+	return nil
+}
+
+// attempt sends p once after it was admitted. Errors that retrying can't fix
+// are wrapped as permanent.
+func (u *Uploader) attempt(p *batch) error {
+	if p.send == nil {
+		p.send = u.buildRequest(p, u.stats.endpoint(p.payloadType))
+	}
+	p.attempts++
+	started := time.Now()
+	err := p.send(p.attempts)
+	p.latency = time.Since(started)
+
+	// Only failures pointing at the endpoint count against the breaker,
+	// rejected payloads don't. Requests aborted on shutdown don't count. With
+	// fallback URLs the breaker guards all endpoints together, so failures only
+	// count once the selector has no healthy endpoint left to fail over to.
+	if u.breaker != nil && u.ctx.Err() == nil {
+		failed := err != nil && IsRetryable(err)
+		if failed && u.selector != nil && u.selector.AnyHealthy() {
+			failed = false
+		}
+		u.breaker.Done(!failed)
+	}
+
+	if err != nil && !u.retryable(err) {
+		return &permanentError{err}
+	}
+	return err
+}
+
+// settle acknowledges the journal entries of p and resolves its deliveries.
+func (u *Uploader) settle(p *batch, err error) {
+	resolveAll(p.deliveries, err)
+
+	if u.journal == nil {
+		return
+	}
+
+	seqs := make([]uint64, 0, len(p.seqs))
+	for _, seq := range p.seqs {
+		if seq != 0 {
+			seqs = append(seqs, seq)
+		}
+	}
+
+	if len(seqs) > 0 {
+		// Failing to acknowledge only causes a redelivery after the next start.
+		if err := u.journal.Ack(seqs...); err != nil {
+			u.logger.Warn("acknowledging journal entries failed", "batch_id", p.id, "err", err)
+		}
+	}
+}
+
+// queueRequest queues a request sending bt to the endpoint of its payload type.
+// An actions batch the server rejects as too large is bisected, and the halves
+// are sent one after the other. Retries only send what wasn't delivered yet.
+// Journal entries are acknowledged once their objects are either delivered or
+// accepted by the dead letter hook. Otherwise they stay in the journal.
+func (u *Uploader) queueRequest(bt *batch) {
+	bt.id = randomutil.ULID(time.Now())
+
+	parts := []*batch{bt}
+	attempts := 0
+	queued := time.Now()
+	var workerID string
+	var lastErr error
+	work := func(wid string) error {
+		workerID = wid
+		tried := false
+		for len(parts) > 0 {
+			p := parts[0]
+
+			if err := u.admit(p); err != nil {
+				derr, deferred := err.(*deferredError)
+				if deferred && !tried {
+					u.logger.Debug("batch deferred", "batch_id", p.id, "payload_type", p.payloadType,
+						"err", derr.err)
+					return err
+				}
 
-		if res.StatusCode != http.StatusOK {
-			content, err := ioutil.ReadAll(res.Body)
-			if err != nil {
-				return fmt.Errorf(
-					"request failed with status code %d. parsing response failed: %s", res.StatusCode, err.Error())
+				// Parts of the batch went out already, so this still counts as
+				// an attempt.
+				if deferred {
+					err = derr.err
+				}
+				u.logger.Warn("request failed", "batch_id", p.id, "payload_type", p.payloadType,
+					"events", p.count, "attempt", attempts, "err", err)
+				lastErr = err
+				return err
+			}
+
+			if !tried {
+				tried = true
+				if attempts > 0 {
+					atomic.AddInt64(&u.stats.retries, 1)
+					if u.onBatchRetry != nil {
+						rest := mergeBatches(parts)
+						rest.id = bt.id
+						u.onBatchRetry(newBatchInfo(rest, attempts+1, workerID, queued, lastErr))
+					}
+				}
+				attempts++
 			}
 
-			return fmt.Errorf(
-				"request failed with status code %d. got response: %s", res.StatusCode, string(content))
+			err := u.attempt(p)
+			if err == nil {
+				u.logger.Debug("batch sent", "batch_id", p.id, "payload_type", p.payloadType,
+					"events", p.count, "attempt", attempts)
+				atomic.AddInt64(&u.stats.batchesSent, 1)
+				u.dequeue(p.count)
+				u.settle(p, nil)
+				u.onSent(p, attempts, workerID, queued)
+				parts = parts[1:]
+				continue
+			}
+
+			if isTooLarge(err) && p.size() > 1 {
+				u.logger.Info("splitting batch rejected as too large", "batch_id", p.id,
+					"events", p.count, "bytes", len(p.b))
+				l, r := p.split()
+				parts = append([]*batch{l, r}, parts[1:]...)
+				continue
+			}
+
+			u.logger.Warn("request failed", "batch_id", p.id, "payload_type", p.payloadType,
+				"events", p.count, "attempt", attempts, "err", err)
+			lastErr = err
+			return err
 		}
 
 		return nil
 	}
+
+	f := u.takeOff()
+	done := func(attempts int, err error) {
+		defer u.land(f, err)
+
+		if err == nil {
+			return
+		}
+
+		atomic.AddInt64(&u.stats.permanentFailures, 1)
+		rest := mergeBatches(parts)
+		rest.id = bt.id
+		u.dequeue(rest.count)
+		defer resolveAll(rest.deliveries, err)
+
+		u.logger.Error("giving up on batch", "batch_id", rest.id, "payload_type", rest.payloadType,
+			"events", rest.count, "attempts", attempts, "err", err)
+		if u.onBatchFailed != nil {
+			u.onBatchFailed(newBatchInfo(rest, attempts, workerID, queued, err))
+		}
+
+		abandoned := u.abandoned.IsSet()
+		if abandoned {
+			if rest.payloadType == PayloadTypeActions {
+				atomic.AddInt64(&u.unsentActions, int64(rest.count))
+			} else {
+				atomic.AddInt64(&u.unsentIdentities, int64(rest.count))
+			}
+		}
+
+		handled := true
+		if u.deadLetterHook != nil {
+			if herr := u.deadLetterHook(rest.payloadType, rest.b, attempts, err); herr != nil {
+				u.logger.Error("dead letter hook failed", "batch_id", rest.id, "err", herr)
+				handled = false
+			}
+		}
+
+		// Batches given up on are dropped from the journal, otherwise every
+		// restart would send them again and their segments would never be
+		// removed. Only batches abandoned on shutdown stay for the next run
+		// unless the dead letter hook took them.
+		if abandoned && (u.deadLetterHook == nil || !handled) {
+			return
+		}
+
+		u.settle(rest, err)
+	}
+
+	var err error
+	if wtm, ok := u.tm.(workerTaskManager); ok {
+		err = wtm.QueueTask(bt.id, work, done)
+	} else {
+		err = u.tm.QueueWithCallback(func() error { return work("") }, done)
+	}
+
+	if err != nil {
+		u.logger.Error("queueing request failed", "batch_id", bt.id, "err", err)
+		done(0, err)
+	}
 }
 
-func (u *Uploader) flushIdentity(cnt IdentityContainer) {
-	b, _ := json.Marshal(cnt)
+// discard gives up on a batch that can't be encoded. Its objects can never be
+// sent, so their journal entries are acknowledged.
+func (u *Uploader) discard(bt *batch, err error) {
+	atomic.AddInt64(&u.stats.permanentFailures, 1)
+	u.dequeue(bt.count)
+	u.logger.Error("encoding batch failed", "payload_type", bt.payloadType, "events", bt.count, "err", err)
+	u.settle(bt, err)
+}
 
-	// Error checking is skipped since we validate baseURL in initialization.
-	iurl, _ := buildIdentitiesURL(u.baseURL)
+func (u *Uploader) flushIdentity(cnt IdentityContainer, seq uint64, delivery *Delivery) {
+	b, err := json.Marshal(cnt)
+	bt := &batch{
+		payloadType: PayloadTypeIdentity,
+		b:           b,
+		count:       1,
+		identities:  []IdentityContainer{cnt},
+		seqs:        []uint64{seq},
+		deliveries:  []*Delivery{delivery},
+	}
 
-	u.tm.Queue(
-		u.buildRequest(iurl, b),
-	)
+	if err != nil {
+		u.discard(bt, err)
+		return
+	}
+
+	u.queueRequest(bt)
 }
 
 func (u *Uploader) flushActions() {
-	dup := make([]ActionContainer, len(u.actionsBatch))
-	copy(dup, u.actionsBatch)
+	bt, err := newActionsBatch(u.actionsBatch, u.actionsSeqs, u.actionsDeliveries, u.actionsLinks)
+	if err != nil {
+		u.discard(bt, err)
+	} else {
+		u.queueRequest(bt)
+	}
+
+	u.actionsBatch = make([]ActionContainer, 0)
+	u.actionsSeqs = make([]uint64, 0)
+	u.actionsDeliveries = make([]*Delivery, 0)
+	u.actionsLinks = make([]interface{}, 0)
+	u.actionsSize = 0
+}
+
+// flushPending sends the pending batches of actions and identities.
+func (u *Uploader) flushPending() {
+	if len(u.actionsBatch) > 0 {
+		u.flushActions()
+	}
+	if len(u.identitiesBatch) > 0 {
+		u.flushIdentities()
+	}
+}
 
-	cnt := ActionsContainer{
-		Timestamp: time.Now(),
-		Actions:   dup,
+func (u *Uploader) flushIdentities() {
+	bt, err := newIdentitiesBatch(u.identitiesBatch, u.identitiesSeqs)
+	if err != nil {
+		u.discard(bt, err)
+	} else {
+		u.queueRequest(bt)
 	}
 
-	b, _ := json.Marshal(cnt)
+	u.identitiesBatch = make([]IdentityContainer, 0)
+	u.identitiesSeqs = make([]uint64, 0)
+	u.identitiesSizes = make([]int, 0)
+	u.identitiesSize = 0
+	u.identitiesIndex = make(map[string]int)
+}
 
-	// Error checking is skipped since we validate baseURL in initialization.
-	aurl, _ := buildActionsURL(u.baseURL)
+// batchIdentity adds the identity of t to the identities batch. An identity for a
+// user key already in the batch replaces the older one, whose journal entry is
+// acknowledged right away since the newer entry supersedes it.
+func (u *Uploader) batchIdentity(t uploadTask) {
+	obj := t.obj.(IdentityContainer)
 
-	u.tm.Queue(
-		u.buildRequest(aurl, b),
-	)
+	size := 0
+	if u.maxPayloadSize > 0 {
+		size, _ = u.checkSize(t)
+	}
 
-	u.actionsBatch = make([]ActionContainer, 0)
+	if i, ok := u.identitiesIndex[obj.UserKey]; ok {
+		// Sizes stored for all but the first identity include the separator.
+		replaced := size
+		if i > 0 && u.maxPayloadSize > 0 {
+			replaced++
+		}
+		grown := identitiesEnvelopeSize + u.identitiesSize - u.identitiesSizes[i] + replaced
+		if u.maxPayloadSize == 0 || grown <= u.maxPayloadSize {
+			if old := u.identitiesSeqs[i]; u.journal != nil && old != 0 {
+				u.journal.Ack(old)
+			}
+			u.dequeue(1)
+
+			u.identitiesBatch[i] = obj
+			u.identitiesSeqs[i] = t.seq
+			u.identitiesSize += replaced - u.identitiesSizes[i]
+			u.identitiesSizes[i] = replaced
+			return
+		}
+
+		// The newer identity doesn't fit in place of the older one. Send the
+		// older one first, so the newer one still wins.
+		u.flushIdentities()
+	}
+
+	if u.maxPayloadSize > 0 {
+		if len(u.identitiesBatch) > 0 && identitiesEnvelopeSize+u.identitiesSize+1+size > u.maxPayloadSize {
+			u.flushIdentities()
+		}
+		if len(u.identitiesBatch) > 0 {
+			size++
+		}
+		u.identitiesSize += size
+	}
+
+	u.identitiesIndex[obj.UserKey] = len(u.identitiesBatch)
+	u.identitiesBatch = append(u.identitiesBatch, obj)
+	u.identitiesSeqs = append(u.identitiesSeqs, t.seq)
+	u.identitiesSizes = append(u.identitiesSizes, size)
+	if len(u.identitiesBatch) == u.identitiesBatchSize {
+		u.flushIdentities()
+	}
+}
+
+func (u *Uploader) handle(t uploadTask) {
+	switch t.objType {
+	case objTypeAction:
+		obj := t.obj.(ActionContainer)
+		if u.maxPayloadSize > 0 {
+			// Cut the batch if the action would push it over the limit. The
+			// action itself always fits, which send made sure of.
+			size, _ := u.checkSize(t)
+			if len(u.actionsBatch) > 0 && actionsEnvelopeSize+u.actionsSize+1+size > u.maxPayloadSize {
+				u.flushActions()
+			}
+			if len(u.actionsBatch) > 0 {
+				size++
+			}
+			u.actionsSize += size
+		}
+
+		u.actionsBatch = append(u.actionsBatch, obj)
+		u.actionsSeqs = append(u.actionsSeqs, t.seq)
+		u.actionsDeliveries = append(u.actionsDeliveries, t.delivery)
+		u.actionsLinks = append(u.actionsLinks, t.link)
+		if len(u.actionsBatch) == u.batchSize {
+			u.flushActions()
+		}
+	case objTypeIdentity:
+		if u.identitiesBatchSize > 1 {
+			u.batchIdentity(t)
+			return
+		}
+
+		obj := t.obj.(IdentityContainer)
+		u.flushIdentity(obj, t.seq, t.delivery)
+	case objTypePayload:
+		obj := t.obj.(payload)
+		u.queueRequest(&batch{
+			payloadType: obj.payloadType,
+			b:           obj.b,
+			count:       obj.count,
+			actions:     obj.actions,
+			identities:  obj.identities,
+		})
+	}
 }
 
 func (u *Uploader) start() {
 	u.isStarted.SetTrue()
+	u.logger.Debug("uploader started")
 
 	u.wg.Add(1)
 	go func() {
+		// Objects recovered from the journal go first, in their original order.
+		for _, t := range u.recovered {
+			u.handle(t)
+		}
+		u.recovered = nil
+
+		// A ticker rather than a timer per loop, so pending objects are flushed
+		// even while new ones keep arriving.
+		ticker := time.NewTicker(u.uploadInterval)
 		for {
-			t := time.NewTimer(u.uploadInterval)
 			select {
 			case t := <-u.tasks:
-				switch t.objType {
-				case objTypeAction:
-					obj := t.obj.(ActionContainer)
-					u.actionsBatch = append(u.actionsBatch, obj)
-					if len(u.actionsBatch) == u.batchSize {
-						u.flushActions()
-					}
-				case objTypeIdentity:
-					obj := t.obj.(IdentityContainer)
-					u.flushIdentity(obj)
-				}
-			case <-t.C:
-				if len(u.actionsBatch) > 0 {
-					u.flushActions()
-				}
+				u.handle(t)
+			case <-ticker.C:
+				u.flushPending()
+			case <-u.spillCh:
+				u.drainSpill()
+			case reply := <-u.flushCh:
+				reply <- u.flush()
 			case <-u.doneCh:
-				t.Stop()
-				if len(u.actionsBatch) > 0 {
-					u.flushActions()
+				ticker.Stop()
+				u.drainBuffer()
+				u.flushPending()
+				u.releaseSpill()
+				u.tm.ShutdownContext(u.shutdownCtx)
+				if u.journal != nil {
+					u.journal.Close()
 				}
-				u.tm.Shutdown()
 				u.wg.Done()
 				return
 			}
@@ -155,62 +837,368 @@ func (u *Uploader) start() {
 	}()
 }
 
-// UploadAction queues given action object to be uploaded to server.
-func (u *Uploader) UploadAction(cnt ActionContainer) error {
-	if u.inShutdown.IsSet() {
-		return errors.New("uploader is shutting down")
+// drainBuffer handles everything left in the buffer on shutdown. Spilled objects
+// stay in the journal for the next start.
+func (u *Uploader) drainBuffer() {
+	for {
+		select {
+		case t := <-u.tasks:
+			u.handle(t)
+		default:
+			return
+		}
 	}
+}
 
-	u.once.Do(u.start)
+// encode sets the encoding of the task object if the maximum payload size or
+// the journal need it. Otherwise objects are only encoded as part of a batch.
+func (u *Uploader) encode(t *uploadTask) error {
+	if u.maxPayloadSize == 0 && u.journal == nil {
+		return nil
+	}
 
-	t := uploadTask{
-		objType: objTypeAction,
-		obj:     cnt,
+	b, err := json.Marshal(t.obj)
+	if err != nil {
+		return err
 	}
 
-	u.tasks <- t
+	t.b = b
 	return nil
 }
 
-// UploadIdentity queues given identity object to be uploaded to server.
-func (u *Uploader) UploadIdentity(cnt IdentityContainer) error {
+// persist appends the encoded task object to the journal, if there's one, and
+// records its sequence number in the task. Resubmitted payloads are left out.
+func (u *Uploader) persist(t *uploadTask) error {
+	if u.journal == nil || t.objType == objTypePayload {
+		return nil
+	}
+
+	rec := journalRecord{ObjType: t.objType}
+	switch t.obj.(type) {
+	case ActionContainer:
+		rec.Action = t.b
+	case IdentityContainer:
+		rec.Identity = t.b
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	seq, err := u.journal.Append(b)
+	if err != nil {
+		return err
+	}
+
+	t.seq = seq
+	return nil
+}
+
+// decodeJournalRecord turns a journal entry back into an upload task. It
+// reports false for entries that can never be delivered.
+func decodeJournalRecord(seq uint64, b []byte) (uploadTask, bool) {
+	rec := journalRecord{}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return uploadTask{}, false
+	}
+
+	t := uploadTask{objType: rec.ObjType, seq: seq}
+	switch {
+	case rec.ObjType == objTypeAction && len(rec.Action) > 0:
+		obj := ActionContainer{}
+		if err := json.Unmarshal(rec.Action, &obj); err != nil {
+			return uploadTask{}, false
+		}
+		t.obj, t.b = obj, rec.Action
+	case rec.ObjType == objTypeIdentity && len(rec.Identity) > 0:
+		obj := IdentityContainer{}
+		if err := json.Unmarshal(rec.Identity, &obj); err != nil {
+			return uploadTask{}, false
+		}
+		t.obj, t.b = obj, rec.Identity
+	default:
+		return uploadTask{}, false
+	}
+
+	return t, true
+}
+
+func (u *Uploader) recover() error {
+	return u.journal.Replay(func(seq uint64, b []byte) error {
+		t, ok := decodeJournalRecord(seq, b)
+		if !ok {
+			// A record we can't decode can never be delivered, so drop it.
+			return u.journal.Ack(seq)
+		}
+
+		u.recovered = append(u.recovered, t)
+		atomic.AddInt64(&u.stats.queued, 1)
+		return nil
+	})
+}
+
+func (u *Uploader) countEmitted(t uploadTask) {
+	switch t.objType {
+	case objTypeAction:
+		atomic.AddInt64(&u.stats.actionsEmitted, 1)
+	case objTypeIdentity:
+		atomic.AddInt64(&u.stats.identitiesEmitted, 1)
+	}
+}
+
+// send hands t over to the uploader goroutine, giving up once ctx is done or
+// the uploader shuts down.
+func (u *Uploader) send(ctx context.Context, t uploadTask) error {
 	if u.inShutdown.IsSet() {
 		return errors.New("uploader is shutting down")
 	}
 
+	if t.objType != objTypePayload {
+		if err := u.encode(&t); err != nil {
+			return err
+		}
+		if _, err := u.checkSize(t); err != nil {
+			return err
+		}
+	}
+
 	u.once.Do(u.start)
 
+	err := u.persist(&t)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&u.stats.queued, int64(t.objects()))
+
+	if u.overflow != OverflowBlock && t.objType != objTypePayload {
+		err = u.offer(t)
+		if err == nil {
+			u.countEmitted(t)
+		}
+		return err
+	}
+
+	select {
+	case u.tasks <- t:
+		u.countEmitted(t)
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-u.doneCh:
+		err = errors.New("uploader is shutting down")
+	}
+
+	// The object was never accepted, so don't replay it after a restart.
+	u.dequeue(t.objects())
+	if u.journal != nil && t.seq != 0 {
+		u.journal.Ack(t.seq)
+	}
+
+	return err
+}
+
+// sendAction sends an action task, tracing the emit if there's a tracer.
+func (u *Uploader) sendAction(ctx context.Context, cnt ActionContainer, d *Delivery) error {
+	if len(cnt.ID) == 0 {
+		cnt.ID = randomutil.ULID(time.Now())
+	}
+
 	t := uploadTask{
+		objType:  objTypeAction,
+		obj:      cnt,
+		delivery: d,
+	}
+
+	if u.tracer == nil {
+		return u.send(ctx, t)
+	}
+
+	link, end := u.tracer.StartEmit(ctx)
+	t.link = link
+	err := u.send(ctx, t)
+	end(err)
+
+	return err
+}
+
+// UploadAction queues given action object to be uploaded to server. When a
+// journal is configured the action is persisted before UploadAction returns.
+func (u *Uploader) UploadAction(cnt ActionContainer) error {
+	return u.UploadActionContext(context.Background(), cnt)
+}
+
+// UploadActionContext works like UploadAction but returns ctx.Err() if the
+// action can't be queued before ctx is done. Actions without an ID get a
+// generated ULID.
+func (u *Uploader) UploadActionContext(ctx context.Context, cnt ActionContainer) error {
+	return u.sendAction(ctx, cnt, nil)
+}
+
+// UploadActionAsync works like UploadActionContext and additionally returns a
+// Delivery that's resolved once the request carrying the action either succeeded
+// or failed on its last retry.
+func (u *Uploader) UploadActionAsync(ctx context.Context, cnt ActionContainer) (*Delivery, error) {
+	d := newDelivery()
+	if err := u.sendAction(ctx, cnt, d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// UploadIdentity queues given identity object to be uploaded to server. When a
+// journal is configured the identity is persisted before UploadIdentity returns.
+func (u *Uploader) UploadIdentity(cnt IdentityContainer) error {
+	return u.UploadIdentityContext(context.Background(), cnt)
+}
+
+// UploadIdentityContext works like UploadIdentity but returns ctx.Err() if the
+// identity can't be queued before ctx is done.
+func (u *Uploader) UploadIdentityContext(ctx context.Context, cnt IdentityContainer) error {
+	return u.send(ctx, uploadTask{
 		objType: objTypeIdentity,
 		obj:     cnt,
+	})
+}
+
+// Resubmit queues an already encoded request payload, such as a dead letter, to
+// be sent to the endpoint of payloadType. The payload is not journaled.
+func (u *Uploader) Resubmit(payloadType string, b []byte) error {
+	if err := checkPayloadType(payloadType); err != nil {
+		return err
 	}
 
-	u.tasks <- t
-	return nil
+	p := payload{payloadType: payloadType, b: b, count: 1}
+	switch payloadType {
+	case PayloadTypeActions:
+		cnt := ActionsContainer{}
+		if err := json.Unmarshal(b, &cnt); err != nil {
+			return err
+		}
+		p.count = len(cnt.Actions)
+		p.actions = cnt.Actions
+	case PayloadTypeIdentity:
+		cnt := IdentityContainer{}
+		if err := json.Unmarshal(b, &cnt); err != nil {
+			return err
+		}
+		p.identities = []IdentityContainer{cnt}
+	case PayloadTypeIdentities:
+		cnt := IdentitiesContainer{}
+		if err := json.Unmarshal(b, &cnt); err != nil {
+			return err
+		}
+		p.count = len(cnt.Identities)
+		p.identities = cnt.Identities
+	}
+
+	return u.send(context.Background(), uploadTask{
+		objType: objTypePayload,
+		obj:     p,
+	})
 }
 
 // Shutdown terminates Uploader gracefully. It will flush all requests before
 // closing the buffer and then returns.
 func (u *Uploader) Shutdown() {
-	if u.inShutdown.IsSet() || !u.isStarted.IsSet() {
-		return
+	u.ShutdownContext(context.Background())
+}
+
+// ShutdownContext works like Shutdown but stops waiting for pending requests once
+// ctx is done. In-flight requests are then aborted, remaining ones are given up on
+// and ShutdownContext returns ctx.Err() along with the number of objects left
+// unsent. Journaled objects among them stay in the journal.
+func (u *Uploader) ShutdownContext(ctx context.Context) (Unsent, error) {
+	if u.inShutdown.IsSet() {
+		return Unsent{}, nil
+	}
+
+	if !u.isStarted.IsSet() {
+		if u.journal != nil {
+			u.journal.Close()
+		}
+		return Unsent{}, nil
 	}
 	u.inShutdown.SetTrue()
 
-	u.doneCh <- struct{}{}
-	u.wg.Wait()
+	// Requests held back by the circuit breaker would keep the shutdown waiting
+	// for the endpoint to recover. They fail instead, like with BreakerFailFast.
+	if f, ok := u.tm.(interface{ FailDeferred() }); ok {
+		f.FailDeferred()
+	}
+
+	// The task manager watches its own context which is canceled only after
+	// abandoned is set, so every callback of an abandoned request sees the flag.
+	tmCtx, abandon := context.WithCancel(context.Background())
+	defer abandon()
+
+	u.shutdownCtx = tmCtx
+	close(u.doneCh)
+
+	finished := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(finished)
+	}()
+
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+		u.abandoned.SetTrue()
+		abandon()
+		u.cancel()
+
+		// The uploader goroutine only reaches the task manager's shutdown once
+		// the buffer is drained, which may wait on workers sleeping through
+		// their backoff. Abandon the tasks right away instead.
+		if a, ok := u.tm.(interface{ Abandon() }); ok {
+			a.Abandon()
+		}
+		<-finished
+	}
+	u.cancel()
+
+	unsent := Unsent{
+		Actions:    int(atomic.LoadInt64(&u.unsentActions)),
+		Identities: int(atomic.LoadInt64(&u.unsentIdentities)),
+	}
+
+	if err != nil {
+		u.logger.Warn("uploader shut down before all requests completed", "unsent_actions", unsent.Actions,
+			"unsent_identities", unsent.Identities, "err", err)
+	} else {
+		u.logger.Info("uploader shut down")
+	}
+
+	return unsent, err
 }
 
 // NewUploader creates a new Uploader instance using provided values. Use this
 // function to instantiate a concrete Uploader type.
 func NewUploader(baseURL string, apiKey string, batchSize int, uploadInterval time.Duration,
-	httpClient *http.Client, tm TaskManager) (*Uploader, error) {
+	httpClient *http.Client, tm TaskManager, opts UploaderOptions) (*Uploader, error) {
 
 	_, err := url.Parse(baseURL)
 	if len(baseURL) == 0 || err != nil {
 		return nil, errors.New("baseURL is not valid")
 	}
 
+	if len(opts.FallbackURLs) > 0 && opts.Selector == nil {
+		return nil, errors.New("fallback URLs require a selector")
+	}
+
+	urls := make([]endpointURLs, 0, len(opts.FallbackURLs)+1)
+	for _, base := range append([]string{baseURL}, opts.FallbackURLs...) {
+		eu, err := buildEndpointURLs(base, opts.Endpoints)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, eu)
+	}
+
 	if len(apiKey) == 0 {
 		return nil, errors.New("apiKey must not be empty")
 	}
@@ -231,16 +1219,101 @@ func NewUploader(baseURL string, apiKey string, batchSize int, uploadInterval ti
 		return nil, errors.New("taskManager can't be nil")
 	}
 
+	if !opts.Overflow.valid() {
+		return nil, errors.New("overflow policy is not valid")
+	}
+
+	if opts.Overflow == OverflowSpillToDisk && opts.Journal == nil {
+		return nil, errors.New("spilling to disk requires a journal")
+	}
+
+	if !opts.Compression.valid() {
+		return nil, errors.New("compression is not valid")
+	}
+
+	if !validCompressionLevel(opts.CompressionLevel) {
+		return nil, errors.New("compressionLevel must be between 1 and 9")
+	}
+
+	if opts.CompressionMinSize < 0 {
+		return nil, errors.New("compressionMinSize can't be negative")
+	}
+
+	if opts.IdentitiesBatchSize < 0 {
+		return nil, errors.New("identitiesBatchSize can't be negative")
+	}
+
+	if opts.MaxPayloadSize < 0 {
+		return nil, errors.New("maxPayloadSize can't be negative")
+	}
+
+	bufferSize := 0
+	if opts.Overflow != OverflowBlock {
+		bufferSize = opts.BufferSize
+		if bufferSize < 1 {
+			bufferSize = 1
+		}
+	}
+
 	u := &Uploader{
-		baseURL:        baseURL,
-		apiKey:         apiKey,
-		batchSize:      batchSize,
-		uploadInterval: uploadInterval,
-		httpClient:     httpClient,
-		tm:             tm,
-		actionsBatch:   make([]ActionContainer, 0),
-		tasks:          make(chan uploadTask),
-		doneCh:         make(chan struct{}),
+		urls:                urls,
+		selector:            opts.Selector,
+		apiKey:              apiKey,
+		batchSize:           batchSize,
+		uploadInterval:      uploadInterval,
+		httpClient:          httpClient,
+		tm:                  tm,
+		journal:             opts.Journal,
+		deadLetterHook:      opts.DeadLetterHook,
+		retryable:           opts.Retryable,
+		breaker:             opts.Breaker,
+		failFast:            opts.BreakerFailFast,
+		limiter:             opts.RateLimiter,
+		tracer:              opts.Tracer,
+		logger:              opts.Logger,
+		onBatchSent:         opts.OnBatchSent,
+		onIdentitySent:      opts.OnIdentitySent,
+		onBatchRetry:        opts.OnBatchRetry,
+		onBatchFailed:       opts.OnBatchFailed,
+		maxPayloadSize:      opts.MaxPayloadSize,
+		identitiesBatchSize: opts.IdentitiesBatchSize,
+		identitiesBatch:     make([]IdentityContainer, 0),
+		identitiesSeqs:      make([]uint64, 0),
+		identitiesSizes:     make([]int, 0),
+		identitiesIndex:     make(map[string]int),
+		actionsBatch:        make([]ActionContainer, 0),
+		actionsSeqs:         make([]uint64, 0),
+		actionsDeliveries:   make([]*Delivery, 0),
+		actionsLinks:        make([]interface{}, 0),
+		tasks:               make(chan uploadTask, bufferSize),
+		doneCh:              make(chan struct{}),
+		overflow:            opts.Overflow,
+		compression:         opts.Compression,
+		compressionLevel:    opts.CompressionLevel,
+		compressionMinSize:  opts.CompressionMinSize,
+		spillCh:             make(chan struct{}, 1),
+		flights:             make(map[*flight]struct{}),
+		flushCh:             make(chan chan []*flight),
+	}
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+
+	if u.retryable == nil {
+		u.retryable = IsRetryable
+	}
+
+	if u.logger == nil {
+		u.logger = NopLogger{}
+	}
+
+	if u.journal != nil {
+		if err := u.recover(); err != nil {
+			return nil, err
+		}
+
+		if len(u.recovered) > 0 {
+			u.logger.Info("recovered objects from journal", "count", len(u.recovered))
+			u.once.Do(u.start)
+		}
 	}
 
 	return u, nil
@@ -1,8 +1,19 @@
 package http
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -20,6 +31,16 @@ func (m *mockAcceptingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	w.Write(nil)
 }
 
+type mockCountingHandler struct {
+	received int32
+}
+
+func (m *mockCountingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&m.received, 1)
+	w.WriteHeader(http.StatusOK)
+	w.Write(nil)
+}
+
 type mockRejectingHandler struct{}
 
 func (m *mockRejectingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -27,49 +48,131 @@ func (m *mockRejectingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	w.Write(nil)
 }
 
+type mockThrottlingHandler struct{}
+
+func (m *mockThrottlingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "7")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(nil)
+}
+
 type mockWorkingTaskManager struct{}
 
-func (m *mockWorkingTaskManager) Queue(work func() error) error {
-	work()
+func (m *mockWorkingTaskManager) QueueWithCallback(work func() error, done func(attempts int, err error)) error {
+	err := work()
+	if done != nil {
+		done(1, err)
+	}
+	return nil
+}
+
+func (m *mockWorkingTaskManager) ShutdownContext(ctx context.Context) error {
+	return nil
+}
+
+type mockBlockingTaskManager struct {
+	releaseCh chan struct{}
+}
+
+func (m *mockBlockingTaskManager) QueueWithCallback(work func() error, done func(attempts int, err error)) error {
+	<-m.releaseCh
+
+	err := work()
+	if done != nil {
+		done(1, err)
+	}
+	return nil
+}
+
+func (m *mockBlockingTaskManager) ShutdownContext(ctx context.Context) error {
+	return nil
+}
+
+type mockJournal struct {
+	mx      sync.Mutex
+	entries map[uint64][]byte
+	nextSeq uint64
+	acked   []uint64
+}
+
+func newMockJournal() *mockJournal {
+	return &mockJournal{entries: make(map[uint64][]byte), nextSeq: 1}
+}
+
+func (m *mockJournal) Append(b []byte) (uint64, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	seq := m.nextSeq
+	m.entries[seq] = b
+	m.nextSeq++
+	return seq, nil
+}
+
+func (m *mockJournal) Ack(seqs ...uint64) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.acked = append(m.acked, seqs...)
+	return nil
+}
+
+func (m *mockJournal) Read(seq uint64) ([]byte, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	b, ok := m.entries[seq]
+	if !ok {
+		return nil, errors.New("entry is not pending")
+	}
+	return b, nil
+}
+
+func (m *mockJournal) Replay(fn func(seq uint64, b []byte) error) error {
+	for seq, b := range m.entries {
+		if err := fn(seq, b); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (m *mockWorkingTaskManager) Shutdown() {}
+func (m *mockJournal) Close() error { return nil }
 
 func TestNewUploader(t *testing.T) {
 	t.Parallel()
 
-	_, err := NewUploader("", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient, &mockWorkingTaskManager{})
+	_, err := NewUploader("", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient, &mockWorkingTaskManager{}, UploaderOptions{})
 	if err == nil {
 		t.Error("given baseURL is invalid")
 		t.Fail()
 	}
 
-	_, err = NewUploader("localhost:9090", "", 1, time.Duration(5*time.Second), http.DefaultClient, &mockWorkingTaskManager{})
+	_, err = NewUploader("localhost:9090", "", 1, time.Duration(5*time.Second), http.DefaultClient, &mockWorkingTaskManager{}, UploaderOptions{})
 	if err == nil {
 		t.Error("given apiKey is invalid")
 		t.Fail()
 	}
 
-	_, err = NewUploader("https://something.com", "api-key", 0, time.Duration(5*time.Second), http.DefaultClient, &mockWorkingTaskManager{})
+	_, err = NewUploader("https://something.com", "api-key", 0, time.Duration(5*time.Second), http.DefaultClient, &mockWorkingTaskManager{}, UploaderOptions{})
 	if err == nil {
 		t.Error("given batchSize is invalid")
 		t.Fail()
 	}
 
-	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(1*time.Second), http.DefaultClient, &mockWorkingTaskManager{})
+	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(1*time.Second), http.DefaultClient, &mockWorkingTaskManager{}, UploaderOptions{})
 	if err == nil {
 		t.Error("given uploadInterval is invalid")
 		t.Fail()
 	}
 
-	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), nil, &mockWorkingTaskManager{})
+	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), nil, &mockWorkingTaskManager{}, UploaderOptions{})
 	if err == nil {
 		t.Error("given httpClient is invalid")
 		t.Fail()
 	}
 
-	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient, nil)
+	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient, nil, UploaderOptions{})
 	if err == nil {
 		t.Error("given TaskManager is invalid")
 		t.Fail()
@@ -88,7 +191,8 @@ func TestUploader_WithAcceptingHandlerAndUploadActions(t *testing.T) {
 		1,
 		time.Duration(5*time.Second),
 		http.DefaultClient,
-		&mockWorkingTaskManager{})
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
 
 	u.UploadAction(ActionContainer{
 		Key:             "some-event-key",
@@ -117,7 +221,8 @@ func TestUploader_WithRejectingHandlerAndUploadActions(t *testing.T) {
 		1,
 		time.Duration(5*time.Second),
 		http.DefaultClient,
-		&mockWorkingTaskManager{})
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
 
 	u.UploadAction(ActionContainer{
 		Key:             "some-event-key",
@@ -146,7 +251,8 @@ func TestUploader_WithAcceptingHandlerAndUploadIdentity(t *testing.T) {
 		1,
 		time.Duration(5*time.Second),
 		http.DefaultClient,
-		&mockWorkingTaskManager{})
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
 
 	u.UploadIdentity(IdentityContainer{
 		UserKey: "some-user-key",
@@ -171,7 +277,8 @@ func TestUploader_WithRejectingHandlerAndUploadIdentity(t *testing.T) {
 		1,
 		time.Duration(5*time.Second),
 		http.DefaultClient,
-		&mockWorkingTaskManager{})
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
 
 	u.UploadIdentity(IdentityContainer{
 		UserKey: "some-user-key",
@@ -199,7 +306,8 @@ func TestUploader_WithTimerFeedbackChannel(t *testing.T) {
 		1,
 		time.Duration(5*time.Second),
 		http.DefaultClient,
-		&mockWorkingTaskManager{})
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
 
 	go func() {
 		reqReceivedByServer = <-feedbackCh
@@ -233,7 +341,8 @@ func TestUploader_WithShutdownUploader(t *testing.T) {
 		1,
 		time.Duration(5*time.Second),
 		http.DefaultClient,
-		&mockWorkingTaskManager{})
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
 
 	u.UploadIdentity(IdentityContainer{
 		UserKey: "some-user-key",
@@ -280,7 +389,8 @@ func TestUploader_WithPrematureShutdown(t *testing.T) {
 		100,
 		time.Duration(20*time.Second),
 		http.DefaultClient,
-		&mockWorkingTaskManager{})
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
 
 	go func() {
 		reqReceivedByServer = <-feedbackCh
@@ -301,3 +411,1681 @@ func TestUploader_WithPrematureShutdown(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestUploader_WithJournalAndAcceptingHandler(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockAcceptingHandler{nil})
+	defer s.Close()
+
+	j := newMockJournal()
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{Journal: j})
+
+	u.UploadAction(ActionContainer{
+		Key:       "some-event-key",
+		UserKey:   "some-user-key",
+		Timestamp: time.Now(),
+	})
+	u.UploadIdentity(IdentityContainer{
+		UserKey: "some-user-key",
+	})
+	u.Shutdown()
+
+	if len(j.entries) != 2 || len(j.acked) != 2 {
+		t.Errorf("expected 2 persisted and acked entries, got %d and %d", len(j.entries), len(j.acked))
+		t.Fail()
+	}
+}
+
+func TestUploader_WithJournalAndRejectingHandler(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingHandler{})
+	defer s.Close()
+
+	j := newMockJournal()
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{Journal: j})
+
+	u.UploadAction(ActionContainer{
+		Key:       "some-event-key",
+		UserKey:   "some-user-key",
+		Timestamp: time.Now(),
+	})
+	u.Shutdown()
+
+	// Rejected entries are given up on, so they must not be replayed after a
+	// restart.
+	if len(j.entries) != 1 || len(j.acked) != 1 {
+		t.Errorf("expected the rejected entry to be acked, got %v", j.acked)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithJournalAndFailingDeadLetterHook(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingHandler{})
+	defer s.Close()
+
+	j := newMockJournal()
+	hooked := 0
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{
+			Journal: j,
+			DeadLetterHook: func(payloadType string, b []byte, attempts int, err error) error {
+				hooked++
+				return errors.New("sink is full")
+			},
+		})
+
+	u.UploadAction(ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+	u.Shutdown()
+
+	if hooked != 1 || len(j.acked) != 1 {
+		t.Errorf("expected the entry to be acked after the hook failed, got %d calls and %v", hooked, j.acked)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithJournalShouldNotPersistResubmittedPayloads(t *testing.T) {
+	t.Parallel()
+
+	h := &mockCountingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	j := newMockJournal()
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{Journal: j})
+
+	if err := u.Resubmit(PayloadTypeIdentity, []byte(`{"user_key":"some-user-key"}`)); err != nil {
+		t.Fatalf("resubmitting payload failed with error: %s", err.Error())
+	}
+	u.Shutdown()
+
+	if atomic.LoadInt32(&h.received) != 1 {
+		t.Errorf("expected the payload to be sent once, got %d requests", h.received)
+		t.Fail()
+	}
+
+	if len(j.entries) != 0 {
+		t.Errorf("expected no persisted entries, got %d", len(j.entries))
+		t.Fail()
+	}
+}
+
+func TestUploader_WithJournalShouldReplayRecoveredObjects(t *testing.T) {
+	t.Parallel()
+
+	feedbackCh := make(chan bool, 1)
+
+	s := httptest.NewServer(&mockAcceptingHandler{feedbackCh})
+	defer s.Close()
+
+	j := newMockJournal()
+	seq, _ := j.Append([]byte(`{"type":"identity","identity":{"user_key":"some-user-key"}}`))
+
+	u, err := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{Journal: j})
+	if err != nil {
+		t.Fatalf("creating uploader failed with error: %s", err.Error())
+	}
+	u.Shutdown()
+
+	select {
+	case <-feedbackCh:
+	default:
+		t.Error("recovered identity should have been sent to server")
+		t.Fail()
+	}
+
+	if len(j.acked) != 1 || j.acked[0] != seq {
+		t.Fail()
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	d, ok := parseRetryAfter("120", now)
+	if !ok || d != 2*time.Minute {
+		t.Errorf("expected 2m, got %s", d)
+		t.Fail()
+	}
+
+	d, ok = parseRetryAfter("Sat, 01 May 2021 12:00:30 GMT", now)
+	if !ok || d != 30*time.Second {
+		t.Errorf("expected 30s, got %s", d)
+		t.Fail()
+	}
+
+	_, ok = parseRetryAfter("soon", now)
+	if ok {
+		t.Error("given value is invalid")
+		t.Fail()
+	}
+}
+
+func TestUploader_WithThrottlingHandlerShouldReturnRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockThrottlingHandler{})
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
+
+	err := u.buildRequest(&batch{payloadType: PayloadTypeActions, b: []byte("{}")}, &u.stats.actions)(1)
+	herr, ok := err.(*HTTPError)
+	if !ok || herr.RetryAfter() != 7*time.Second {
+		t.Errorf("expected a retry after error of 7s, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{errors.New("connection reset by peer"), true},
+		{&HTTPError{StatusCode: http.StatusRequestTimeout}, true},
+		{&HTTPError{StatusCode: http.StatusTooManyRequests}, true},
+		{&HTTPError{StatusCode: http.StatusInternalServerError}, true},
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&HTTPError{StatusCode: http.StatusBadRequest}, false},
+		{&HTTPError{StatusCode: http.StatusUnauthorized}, false},
+		{&HTTPError{StatusCode: http.StatusNotFound}, false},
+	}
+
+	for _, c := range cases {
+		if IsRetryable(c.err) != c.retryable {
+			t.Errorf("%v: expected retryable to be %t", c.err, c.retryable)
+			t.Fail()
+		}
+	}
+}
+
+func TestUploader_WithRejectingHandlerShouldFailPermanently(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingHandler{})
+	defer s.Close()
+
+	var hookErr error
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{
+			DeadLetterHook: func(payloadType string, b []byte, attempts int, err error) error {
+				hookErr = err
+				return nil
+			},
+		})
+
+	u.UploadIdentity(IdentityContainer{
+		UserKey: "some-user-key",
+	})
+	u.Shutdown()
+
+	perr, ok := hookErr.(*permanentError)
+	if !ok {
+		t.Fatalf("expected a permanent error, got %v", hookErr)
+	}
+
+	herr, ok := perr.Unwrap().(*HTTPError)
+	if !ok || herr.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected an HTTP error with status 400, got %v", perr.Unwrap())
+		t.Fail()
+	}
+}
+
+func TestUploader_WithContextAndBlockedTaskManager(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockAcceptingHandler{nil})
+	defer s.Close()
+
+	tm := &mockBlockingTaskManager{make(chan struct{})}
+	j := newMockJournal()
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		tm,
+		UploaderOptions{Journal: j})
+
+	// The first action fills the batch and blocks the uploader in the task manager.
+	u.UploadAction(ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := u.UploadActionContext(ctx, ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+		t.Fail()
+	}
+
+	// The rejected action must not be replayed after a restart.
+	if len(j.acked) != 1 || j.acked[0] != 2 {
+		t.Errorf("rejected action should have been removed from journal, got %v", j.acked)
+		t.Fail()
+	}
+
+	close(tm.releaseCh)
+	u.Shutdown()
+}
+
+// newOverflowingUploader returns an Uploader that is blocked in its task manager
+// with one action and has a full buffer of one action.
+func newOverflowingUploader(t *testing.T, url string, policy OverflowPolicy,
+	j Journal) (*Uploader, *mockBlockingTaskManager) {
+
+	tm := &mockBlockingTaskManager{make(chan struct{})}
+	u, err := NewUploader(
+		url,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		tm,
+		UploaderOptions{Journal: j, Overflow: policy, BufferSize: 1})
+	if err != nil {
+		t.Fatalf("creating uploader failed with error: %s", err.Error())
+	}
+
+	u.UploadAction(ActionContainer{Key: "first", Timestamp: time.Now()})
+	for len(u.tasks) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the uploader goroutine time to block in the task manager.
+	time.Sleep(10 * time.Millisecond)
+
+	err = u.UploadAction(ActionContainer{Key: "second", Timestamp: time.Now()})
+	if err != nil {
+		t.Fatalf("buffer should have had room, got error: %s", err.Error())
+	}
+
+	return u, tm
+}
+
+func TestNewUploader_WithOverflowPolicy(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{Overflow: OverflowPolicy(42)})
+	if err == nil {
+		t.Error("given overflow policy is invalid")
+		t.Fail()
+	}
+
+	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{Overflow: OverflowSpillToDisk})
+	if err == nil {
+		t.Error("spilling to disk without a journal is invalid")
+		t.Fail()
+	}
+}
+
+func TestUploader_WithDropNewestOverflow(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockAcceptingHandler{nil})
+	defer s.Close()
+
+	u, tm := newOverflowingUploader(t, s.URL, OverflowDropNewest, nil)
+
+	err := u.UploadAction(ActionContainer{Key: "third", Timestamp: time.Now()})
+	if err != ErrBufferFull {
+		t.Errorf("expected buffer full error, got %v", err)
+		t.Fail()
+	}
+
+	actions, identities := u.Dropped()
+	if actions != 1 || identities != 0 {
+		t.Errorf("expected 1 dropped action, got %d actions and %d identities", actions, identities)
+		t.Fail()
+	}
+
+	close(tm.releaseCh)
+	u.Shutdown()
+}
+
+func TestUploader_WithDropOldestOverflow(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockAcceptingHandler{nil})
+	defer s.Close()
+
+	u, tm := newOverflowingUploader(t, s.URL, OverflowDropOldest, nil)
+
+	err := u.UploadAction(ActionContainer{Key: "third", Timestamp: time.Now()})
+	if err != nil {
+		t.Errorf("newest action should have been accepted, got %v", err)
+		t.Fail()
+	}
+
+	actions, _ := u.Dropped()
+	if actions != 1 {
+		t.Errorf("expected 1 dropped action, got %d", actions)
+		t.Fail()
+	}
+
+	buffered := <-u.tasks
+	if buffered.obj.(ActionContainer).Key != "third" {
+		t.Error("oldest buffered action should have been evicted")
+		t.Fail()
+	}
+
+	close(tm.releaseCh)
+	u.Shutdown()
+}
+
+func TestUploader_WithSpillToDiskOverflow(t *testing.T) {
+	t.Parallel()
+
+	h := &mockCountingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	j := newMockJournal()
+	u, tm := newOverflowingUploader(t, s.URL, OverflowSpillToDisk, j)
+
+	for i := 0; i < 3; i++ {
+		err := u.UploadAction(ActionContainer{Key: "spilled", Timestamp: time.Now()})
+		if err != nil {
+			t.Errorf("spilled action should have been accepted, got %v", err)
+			t.Fail()
+		}
+	}
+
+	close(tm.releaseCh)
+
+	// Spilled actions are read back from the journal once the buffer drains.
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&h.received) < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	u.Shutdown()
+
+	if n := atomic.LoadInt32(&h.received); n != 5 {
+		t.Errorf("expected 5 requests, got %d", n)
+		t.Fail()
+	}
+
+	actions, _ := u.Dropped()
+	if actions != 0 || len(j.acked) != 5 {
+		t.Errorf("expected no drops and 5 acked entries, got %d and %d", actions, len(j.acked))
+		t.Fail()
+	}
+
+	if st := u.Stats(); st.QueueDepth != 0 {
+		t.Errorf("expected no queued objects, got %d", st.QueueDepth)
+		t.Fail()
+	}
+}
+
+type mockDecompressingHandler struct {
+	mx        sync.Mutex
+	encodings []string
+	bodies    []string
+}
+
+func (m *mockDecompressingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "gzip":
+		body, _ = gzip.NewReader(r.Body)
+	case "deflate":
+		body, _ = zlib.NewReader(r.Body)
+	}
+
+	b, _ := ioutil.ReadAll(body)
+
+	m.mx.Lock()
+	m.encodings = append(m.encodings, r.Header.Get("Content-Encoding"))
+	m.bodies = append(m.bodies, string(b))
+	m.mx.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(nil)
+}
+
+func TestUploader_WithCompression(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []Compression{CompressionGzip, CompressionDeflate} {
+		h := &mockDecompressingHandler{}
+		s := httptest.NewServer(h)
+
+		u, _ := NewUploader(
+			s.URL,
+			"some-api-key",
+			1,
+			time.Duration(5*time.Second),
+			http.DefaultClient,
+			&mockWorkingTaskManager{},
+			UploaderOptions{Compression: c, CompressionMinSize: 100})
+
+		// Only the identity with large metadata passes the size threshold.
+		u.UploadIdentity(IdentityContainer{
+			UserKey: "small",
+		})
+		u.UploadIdentity(IdentityContainer{
+			UserKey:  "large",
+			Metadata: map[string]interface{}{"bio": strings.Repeat("lorem ipsum ", 50)},
+		})
+		u.Shutdown()
+		s.Close()
+
+		if len(h.encodings) != 2 || h.encodings[0] != "" || h.encodings[1] != c.encoding() {
+			t.Errorf("unexpected content encodings: %v", h.encodings)
+			t.Fail()
+		}
+
+		if len(h.bodies) != 2 || !strings.Contains(h.bodies[1], `"user_key":"large"`) {
+			t.Errorf("compressed body could not be decoded: %v", h.bodies)
+			t.Fail()
+		}
+	}
+}
+
+func TestNewUploader_WithCompression(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{Compression: Compression(42)})
+	if err == nil {
+		t.Error("given compression is invalid")
+		t.Fail()
+	}
+
+	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{Compression: CompressionGzip, CompressionLevel: 10})
+	if err == nil {
+		t.Error("given compressionLevel is invalid")
+		t.Fail()
+	}
+}
+
+type mockFlakyHandler struct {
+	mx     sync.Mutex
+	keys   []string
+	bodies []string
+}
+
+func (m *mockFlakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+
+	m.mx.Lock()
+	m.keys = append(m.keys, r.Header.Get("Idempotency-Key"))
+	m.bodies = append(m.bodies, string(b))
+	first := len(m.keys) == 1
+	m.mx.Unlock()
+
+	if first {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(nil)
+}
+
+type mockRetryingTaskManager struct{}
+
+func (m *mockRetryingTaskManager) QueueWithCallback(work func() error, done func(attempts int, err error)) error {
+	attempts, err := 1, work()
+	if err != nil {
+		attempts, err = 2, work()
+	}
+	if done != nil {
+		done(attempts, err)
+	}
+	return nil
+}
+
+func (m *mockRetryingTaskManager) ShutdownContext(ctx context.Context) error {
+	return nil
+}
+
+func TestUploader_WithRetriesShouldKeepEventIDsAndIdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	h := &mockFlakyHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		2,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockRetryingTaskManager{},
+		UploaderOptions{})
+
+	u.UploadAction(ActionContainer{Key: "generated", Timestamp: time.Now()})
+	u.UploadAction(ActionContainer{ID: "custom-id", Key: "custom", Timestamp: time.Now()})
+	u.Shutdown()
+
+	if len(h.keys) != 2 || len(h.keys[0]) == 0 || h.keys[0] != h.keys[1] {
+		t.Errorf("idempotency key should be set and stable across retries: %v", h.keys)
+		t.FailNow()
+	}
+
+	if h.bodies[0] != h.bodies[1] {
+		t.Error("retried payload should not change")
+		t.Fail()
+	}
+
+	res := ActionsContainer{}
+	json.Unmarshal([]byte(h.bodies[1]), &res)
+
+	if len(res.Actions) != 2 || len(res.Actions[0].ID) != 26 || res.Actions[1].ID != "custom-id" {
+		t.Errorf("unexpected event IDs: %+v", res.Actions)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithFlush(t *testing.T) {
+	t.Parallel()
+
+	h := &mockCountingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		10,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
+	defer u.Shutdown()
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Errorf("flushing an idle uploader failed with error: %s", err.Error())
+		t.Fail()
+	}
+
+	u.UploadAction(ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+	u.UploadIdentity(IdentityContainer{UserKey: "some-user-key"})
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Errorf("flush failed with error: %s", err.Error())
+		t.Fail()
+	}
+
+	if atomic.LoadInt32(&h.received) != 2 {
+		t.Errorf("flush should wait for the batch and the identity, got %d requests", h.received)
+		t.Fail()
+	}
+
+	// The uploader stays usable after a flush.
+	u.UploadAction(ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+	u.Flush(context.Background())
+	if atomic.LoadInt32(&h.received) != 3 {
+		t.Fail()
+	}
+}
+
+func TestUploader_WithFlushAndRejectingHandler(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingHandler{})
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		10,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
+	defer u.Shutdown()
+
+	u.UploadAction(ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+	u.UploadIdentity(IdentityContainer{UserKey: "some-user-key"})
+
+	err := u.Flush(context.Background())
+	ferr, ok := err.(*FlushError)
+	if !ok || len(ferr.Errs) != 2 {
+		t.Errorf("expected a flush error with 2 errors, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithFlushAndBlockedTaskManager(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockAcceptingHandler{nil})
+	defer s.Close()
+
+	tm := &mockBlockingTaskManager{releaseCh: make(chan struct{})}
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		10,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		tm,
+		UploaderOptions{})
+
+	u.UploadAction(ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := u.Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		t.Fail()
+	}
+
+	close(tm.releaseCh)
+	u.Shutdown()
+}
+
+func TestUploader_WithUploadActionAsync(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		handler http.Handler
+		status  int
+	}{
+		{&mockAcceptingHandler{nil}, 0},
+		{&mockRejectingHandler{}, http.StatusBadRequest},
+	} {
+		s := httptest.NewServer(tc.handler)
+
+		u, _ := NewUploader(
+			s.URL,
+			"some-api-key",
+			2,
+			time.Duration(time.Minute),
+			http.DefaultClient,
+			&mockWorkingTaskManager{},
+			UploaderOptions{})
+
+		d, err := u.UploadActionAsync(context.Background(), ActionContainer{Key: "tracked", Timestamp: time.Now()})
+		if err != nil {
+			t.Fatalf("uploading action failed with error: %s", err.Error())
+		}
+
+		select {
+		case <-d.Done():
+			t.Error("delivery should not resolve before the batch is sent")
+			t.Fail()
+		default:
+		}
+
+		u.UploadAction(ActionContainer{Key: "untracked", Timestamp: time.Now()})
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = d.Wait(ctx)
+		cancel()
+
+		if tc.status == 0 && err != nil {
+			t.Errorf("expected delivery to succeed, got %v", err)
+			t.Fail()
+		}
+
+		// The mock task manager doesn't unwrap permanent errors like Manager does.
+		if perr, ok := err.(*permanentError); ok {
+			err = perr.Unwrap()
+		}
+
+		if herr, ok := err.(*HTTPError); tc.status != 0 && (!ok || herr.StatusCode != tc.status) {
+			t.Errorf("expected an HTTP error with status %d, got %v", tc.status, err)
+			t.Fail()
+		}
+
+		if (d.Err() == nil) != (err == nil) {
+			t.Fail()
+		}
+
+		u.Shutdown()
+		s.Close()
+	}
+}
+
+func TestUploader_WithUploadActionAsyncAndDropOldestOverflow(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockAcceptingHandler{nil})
+	defer s.Close()
+
+	tm := &mockBlockingTaskManager{make(chan struct{})}
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		tm,
+		UploaderOptions{Overflow: OverflowDropOldest, BufferSize: 1})
+
+	u.UploadAction(ActionContainer{Key: "first", Timestamp: time.Now()})
+	for len(u.tasks) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	d, _ := u.UploadActionAsync(context.Background(), ActionContainer{Key: "second", Timestamp: time.Now()})
+	u.UploadAction(ActionContainer{Key: "third", Timestamp: time.Now()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := d.Wait(ctx); err != ErrBufferFull {
+		t.Errorf("evicted action should resolve with %v, got %v", ErrBufferFull, err)
+		t.Fail()
+	}
+
+	close(tm.releaseCh)
+	u.Shutdown()
+}
+
+type mockSizeLimitingHandler struct {
+	maxActions int
+
+	mx        sync.Mutex
+	batches   []int
+	delivered []string
+}
+
+func (m *mockSizeLimitingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cnt := ActionsContainer{}
+	json.NewDecoder(r.Body).Decode(&cnt)
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.batches = append(m.batches, len(cnt.Actions))
+	if len(cnt.Actions) > m.maxActions {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	for _, a := range cnt.Actions {
+		m.delivered = append(m.delivered, a.Key)
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(nil)
+}
+
+func TestNewUploader_WithMaxPayloadSize(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{MaxPayloadSize: -1})
+	if err == nil {
+		t.Error("given maxPayloadSize is invalid")
+		t.Fail()
+	}
+	_, err = NewUploader("localhost:9090", "api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{IdentitiesBatchSize: -1})
+	if err == nil {
+		t.Error("given identitiesBatchSize is invalid")
+		t.Fail()
+	}
+}
+
+func TestUploader_WithMaxPayloadSizeShouldCutBatches(t *testing.T) {
+	t.Parallel()
+
+	h := &mockSizeLimitingHandler{maxActions: 10}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	action := ActionContainer{ID: "01ARZ3NDEKTSV4RRFFQ69G5FAV", Key: "some-event-key", Timestamp: time.Now()}
+	b, _ := json.Marshal(action)
+
+	// Room for two actions but not for three.
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		10,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{MaxPayloadSize: actionsEnvelopeSize + 3*len(b)})
+
+	for i := 0; i < 5; i++ {
+		if err := u.UploadAction(action); err != nil {
+			t.Fatalf("uploading action failed with error: %s", err.Error())
+		}
+	}
+	u.Shutdown()
+
+	if len(h.batches) != 3 || h.batches[0] != 2 || h.batches[1] != 2 || h.batches[2] != 1 {
+		t.Errorf("unexpected batch sizes: %v", h.batches)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithMaxPayloadSizeShouldRejectLargeObjects(t *testing.T) {
+	t.Parallel()
+
+	u, _ := NewUploader(
+		"localhost:9090",
+		"some-api-key",
+		10,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{MaxPayloadSize: 256})
+	defer u.Shutdown()
+
+	large := map[string]interface{}{"bio": strings.Repeat("lorem ipsum ", 50)}
+
+	err := u.UploadAction(ActionContainer{Key: "some-event-key", Metadata: large})
+	if perr, ok := err.(*PayloadTooLargeError); !ok || perr.Limit != 256 || perr.Size <= 256 {
+		t.Errorf("expected a payload too large error, got %v", err)
+		t.Fail()
+	}
+
+	err = u.UploadIdentity(IdentityContainer{UserKey: "some-user-key", Metadata: large})
+	if _, ok := err.(*PayloadTooLargeError); !ok {
+		t.Errorf("expected a payload too large error, got %v", err)
+		t.Fail()
+	}
+}
+
+type mockCountingMarshaler struct {
+	calls int32
+}
+
+func (m *mockCountingMarshaler) MarshalJSON() ([]byte, error) {
+	atomic.AddInt32(&m.calls, 1)
+	return []byte(`"value"`), nil
+}
+
+func TestUploader_WithJournalAndMaxPayloadSizeShouldEncodeOnce(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockAcceptingHandler{nil})
+	defer s.Close()
+
+	j := newMockJournal()
+	u, _ := NewUploader(s.URL, "some-api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{Journal: j, MaxPayloadSize: 1024})
+
+	m := &mockCountingMarshaler{}
+	err := u.UploadAction(ActionContainer{Key: "key", Timestamp: time.Now(), Metadata: map[string]interface{}{"m": m}})
+	if err != nil {
+		t.Fatalf("uploading action failed with error: %s", err.Error())
+	}
+	u.Shutdown()
+
+	// Once on the way in and once as part of the request body.
+	if n := atomic.LoadInt32(&m.calls); n != 2 {
+		t.Errorf("expected the action to be encoded twice, got %d", n)
+		t.Fail()
+	}
+
+	if len(j.acked) != 1 {
+		t.Errorf("expected the journaled action to be acked, got %d", len(j.acked))
+		t.Fail()
+	}
+}
+
+func TestUploader_WithTooLargeResponseShouldBisectBatch(t *testing.T) {
+	t.Parallel()
+
+	h := &mockSizeLimitingHandler{maxActions: 1}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		4,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{})
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		u.UploadAction(ActionContainer{Key: key, Timestamp: time.Now()})
+	}
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Errorf("bisected batch should be delivered, got %v", err)
+		t.Fail()
+	}
+	u.Shutdown()
+
+	if strings.Join(h.delivered, "") != "abcd" {
+		t.Errorf("actions should be delivered once and in order, got %v", h.delivered)
+		t.Fail()
+	}
+
+	if len(h.batches) != 7 {
+		t.Errorf("expected 7 requests, got batch sizes %v", h.batches)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithTooLargeSingleActionShouldFailPermanently(t *testing.T) {
+	t.Parallel()
+
+	h := &mockSizeLimitingHandler{maxActions: 0}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	var letters int32
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		2,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{
+			DeadLetterHook: func(payloadType string, b []byte, attempts int, err error) error {
+				cnt := ActionsContainer{}
+				json.Unmarshal(b, &cnt)
+				atomic.AddInt32(&letters, int32(len(cnt.Actions)))
+				return nil
+			},
+		})
+
+	u.UploadAction(ActionContainer{Key: "a", Timestamp: time.Now()})
+	u.UploadAction(ActionContainer{Key: "b", Timestamp: time.Now()})
+	u.Shutdown()
+
+	// 2 actions (413), then "a" alone (413, permanent). "b" is never tried.
+	if len(h.batches) != 2 {
+		t.Errorf("single actions should not be split, got batch sizes %v", h.batches)
+		t.Fail()
+	}
+
+	if atomic.LoadInt32(&letters) != 2 {
+		t.Errorf("undelivered actions should be dead-lettered, got %d", letters)
+		t.Fail()
+	}
+}
+
+type mockIdentitiesHandler struct {
+	maxIdentities int
+
+	mx      sync.Mutex
+	batches [][]IdentityContainer
+}
+
+func (m *mockIdentitiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cnt := IdentitiesContainer{}
+	json.NewDecoder(r.Body).Decode(&cnt)
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.maxIdentities > 0 && len(cnt.Identities) > m.maxIdentities {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	m.batches = append(m.batches, cnt.Identities)
+	w.WriteHeader(http.StatusOK)
+	w.Write(nil)
+}
+
+func TestUploader_WithIdentitiesBatchAndMaxPayloadSizeShouldCountSeparators(t *testing.T) {
+	t.Parallel()
+
+	h := &mockIdentitiesHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	short := IdentityContainer{UserKey: "third", Metadata: map[string]interface{}{"v": "x"}}
+	b, _ := json.Marshal(short)
+
+	// Room for exactly three identities of the same size, separators included.
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{IdentitiesBatchSize: 10, MaxPayloadSize: identitiesEnvelopeSize + 3*len(b) + 2})
+
+	u.UploadIdentity(IdentityContainer{UserKey: "first", Metadata: map[string]interface{}{"v": "x"}})
+	u.UploadIdentity(IdentityContainer{UserKey: "secnd", Metadata: map[string]interface{}{"v": "x"}})
+	u.UploadIdentity(short)
+
+	// A byte longer than the identity it replaces, so it no longer fits.
+	u.UploadIdentity(IdentityContainer{UserKey: "third", Metadata: map[string]interface{}{"v": "xy"}})
+	u.Shutdown()
+
+	if len(h.batches) != 2 || len(h.batches[0]) != 3 || len(h.batches[1]) != 1 ||
+		h.batches[1][0].Metadata["v"] != "xy" {
+		t.Errorf("unexpected identity batches: %v", h.batches)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithIdentitiesBatchShouldFlushWhileActionsArrive(t *testing.T) {
+	t.Parallel()
+
+	h := &mockIdentitiesHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		100,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{IdentitiesBatchSize: 10})
+	defer u.Shutdown()
+
+	// Below the minimum NewUploader accepts, to keep the test short. The
+	// uploader only starts with the first upload.
+	u.uploadInterval = 100 * time.Millisecond
+
+	u.UploadIdentity(IdentityContainer{UserKey: "some-user-key"})
+
+	// Actions keep arriving more often than the upload interval.
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		u.UploadAction(ActionContainer{Key: "some-event-key", Timestamp: time.Now()})
+		time.Sleep(10 * time.Millisecond)
+
+		h.mx.Lock()
+		for _, b := range h.batches {
+			if len(b) > 0 {
+				h.mx.Unlock()
+				return
+			}
+		}
+		h.mx.Unlock()
+	}
+
+	t.Fatal("identity should have been flushed within the upload interval")
+}
+
+func TestUploader_WithIdentitiesBatchShouldCoalesceUserKeys(t *testing.T) {
+	t.Parallel()
+
+	h := &mockIdentitiesHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	j := newMockJournal()
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{Journal: j, IdentitiesBatchSize: 3})
+
+	u.UploadIdentity(IdentityContainer{UserKey: "first", Metadata: map[string]interface{}{"plan": "free"}})
+	u.UploadIdentity(IdentityContainer{UserKey: "second"})
+	u.UploadIdentity(IdentityContainer{UserKey: "first", Metadata: map[string]interface{}{"plan": "pro"}})
+	u.UploadIdentity(IdentityContainer{UserKey: "third"})
+	u.UploadIdentity(IdentityContainer{UserKey: "fourth"})
+	u.Shutdown()
+
+	if len(h.batches) != 2 || len(h.batches[0]) != 3 || len(h.batches[1]) != 1 {
+		t.Fatalf("unexpected identity batches: %v", h.batches)
+	}
+
+	first := h.batches[0][0]
+	if first.UserKey != "first" || first.Metadata["plan"] != "pro" {
+		t.Errorf("the last identity for a user key should win, got %v", first)
+		t.Fail()
+	}
+
+	if len(j.entries) != 5 || len(j.acked) != 5 {
+		t.Errorf("expected 5 persisted and acked entries, got %d and %d", len(j.entries), len(j.acked))
+		t.Fail()
+	}
+}
+
+func TestUploader_WithIdentitiesBatchAndTooLargeResponse(t *testing.T) {
+	t.Parallel()
+
+	h := &mockIdentitiesHandler{maxIdentities: 1}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{IdentitiesBatchSize: 10})
+
+	u.UploadIdentity(IdentityContainer{UserKey: "first"})
+	u.UploadIdentity(IdentityContainer{UserKey: "second"})
+
+	if err := u.Flush(context.Background()); err != nil {
+		t.Errorf("bisected batch should be delivered, got %v", err)
+		t.Fail()
+	}
+	u.Shutdown()
+
+	if len(h.batches) != 2 || h.batches[0][0].UserKey != "first" || h.batches[1][0].UserKey != "second" {
+		t.Errorf("unexpected identity batches: %v", h.batches)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithStats(t *testing.T) {
+	t.Parallel()
+
+	h := &mockFlakyHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		2,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockRetryingTaskManager{},
+		UploaderOptions{})
+
+	u.UploadAction(ActionContainer{Key: "first", Timestamp: time.Now()})
+	u.UploadAction(ActionContainer{Key: "second", Timestamp: time.Now()})
+	u.Shutdown()
+
+	st := u.Stats()
+	if st.ActionsEmitted != 2 || st.IdentitiesEmitted != 0 || st.BatchesSent != 1 || st.Retries != 1 ||
+		st.PermanentFailures != 0 || st.InFlight != 0 || st.QueueDepth != 0 {
+		t.Errorf("unexpected stats: %+v", st)
+		t.Fail()
+	}
+
+	if st.BytesSent != int64(2*len(h.bodies[0])) {
+		t.Errorf("expected %d bytes sent, got %d", 2*len(h.bodies[0]), st.BytesSent)
+		t.Fail()
+	}
+
+	es := st.Endpoints[actionsPath]
+	if es.Requests != 2 || es.StatusCodes[http.StatusServiceUnavailable] != 1 ||
+		es.StatusCodes[http.StatusOK] != 1 || es.Latency.Count != 2 {
+		t.Errorf("unexpected endpoint stats: %+v", es)
+		t.Fail()
+	}
+
+	if st.Endpoints[identitiesPath].Requests != 0 {
+		t.Fail()
+	}
+}
+
+func TestUploader_WithStatsShouldCountQueuedObjects(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	tm := &mockBlockingTaskManager{releaseCh: make(chan struct{})}
+	u, _ := NewUploader(s.URL, "some-api-key", 2, time.Duration(time.Minute), http.DefaultClient,
+		tm, UploaderOptions{})
+
+	u.UploadAction(ActionContainer{Key: "first", Timestamp: time.Now()})
+	u.UploadAction(ActionContainer{Key: "second", Timestamp: time.Now()})
+
+	// Both actions left the buffer for a batch that wasn't sent yet.
+	if st := u.Stats(); st.QueueDepth != 2 {
+		t.Errorf("expected 2 queued objects, got %d", st.QueueDepth)
+		t.Fail()
+	}
+
+	close(tm.releaseCh)
+	u.Shutdown()
+
+	if st := u.Stats(); st.QueueDepth != 0 {
+		t.Errorf("expected no queued objects, got %d", st.QueueDepth)
+		t.Fail()
+	}
+}
+
+func TestHistogram_WithObserve(t *testing.T) {
+	t.Parallel()
+
+	es := &endpointStats{}
+	es.record(http.StatusOK, time.Millisecond)
+	es.record(http.StatusOK, 5*time.Millisecond)
+	es.record(0, 7*time.Millisecond)
+	es.record(1000, time.Minute)
+
+	snap := es.snapshot()
+	if snap.Latency.Counts[0] != 2 || snap.Latency.Counts[1] != 1 || snap.Latency.Counts[len(latencyBounds)] != 1 {
+		t.Errorf("unexpected latency counts: %v", snap.Latency.Counts)
+		t.Fail()
+	}
+
+	if snap.TransportErrors != 1 || snap.StatusCodes[maxStatusCode] != 1 || snap.StatusCodes[http.StatusOK] != 2 {
+		t.Errorf("unexpected endpoint stats: %+v", snap)
+		t.Fail()
+	}
+}
+
+type mockTraceKey struct{}
+
+type mockUpload struct {
+	info   UploadInfo
+	status int
+	err    error
+}
+
+type mockTracer struct {
+	mx      sync.Mutex
+	emits   int
+	ended   int
+	uploads []mockUpload
+}
+
+func (m *mockTracer) StartEmit(ctx context.Context) (interface{}, func(err error)) {
+	m.mx.Lock()
+	m.emits++
+	m.mx.Unlock()
+
+	return ctx.Value(mockTraceKey{}), func(err error) {
+		m.mx.Lock()
+		m.ended++
+		m.mx.Unlock()
+	}
+}
+
+func (m *mockTracer) StartUpload(ctx context.Context, info UploadInfo) (context.Context, func(int, error)) {
+	return ctx, func(status int, err error) {
+		m.mx.Lock()
+		m.uploads = append(m.uploads, mockUpload{info, status, err})
+		m.mx.Unlock()
+	}
+}
+
+func TestUploader_WithTracer(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockFlakyHandler{})
+	defer s.Close()
+
+	tr := &mockTracer{}
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		3,
+		time.Duration(time.Minute),
+		http.DefaultClient,
+		&mockRetryingTaskManager{},
+		UploaderOptions{Tracer: tr})
+
+	u.UploadActionContext(context.WithValue(context.Background(), mockTraceKey{}, "first"),
+		ActionContainer{Key: "first", Timestamp: time.Now()})
+	u.UploadActionContext(context.Background(), ActionContainer{Key: "untraced", Timestamp: time.Now()})
+	u.UploadActionAsync(context.WithValue(context.Background(), mockTraceKey{}, "second"),
+		ActionContainer{Key: "second", Timestamp: time.Now()})
+	u.Shutdown()
+
+	if tr.emits != 3 || tr.ended != 3 {
+		t.Errorf("expected 3 emits started and ended, got %d and %d", tr.emits, tr.ended)
+		t.Fail()
+	}
+
+	if len(tr.uploads) != 2 {
+		t.Fatalf("expected 2 upload attempts, got %d", len(tr.uploads))
+	}
+
+	for i, up := range tr.uploads {
+		if up.info.Attempt != i+1 || up.info.EventCount != 3 || up.info.PayloadSize == 0 ||
+			up.info.PayloadType != PayloadTypeActions {
+			t.Errorf("unexpected upload info: %+v", up.info)
+			t.Fail()
+		}
+
+		if len(up.info.Links) != 2 || up.info.Links[0] != "first" || up.info.Links[1] != "second" {
+			t.Errorf("expected links to traced emits, got %v", up.info.Links)
+			t.Fail()
+		}
+	}
+
+	if tr.uploads[0].status != http.StatusServiceUnavailable || tr.uploads[0].err == nil ||
+		tr.uploads[1].status != http.StatusOK || tr.uploads[1].err != nil {
+		t.Errorf("unexpected upload results: %+v", tr.uploads)
+		t.Fail()
+	}
+}
+
+type mockLogEntry struct {
+	level         string
+	msg           string
+	keysAndValues []interface{}
+}
+
+type mockLogger struct {
+	mx      sync.Mutex
+	entries []mockLogEntry
+}
+
+func (m *mockLogger) log(level, msg string, keysAndValues []interface{}) {
+	m.mx.Lock()
+	m.entries = append(m.entries, mockLogEntry{level, msg, keysAndValues})
+	m.mx.Unlock()
+}
+
+func (m *mockLogger) Debug(msg string, keysAndValues ...interface{}) {
+	m.log("debug", msg, keysAndValues)
+}
+func (m *mockLogger) Info(msg string, keysAndValues ...interface{}) {
+	m.log("info", msg, keysAndValues)
+}
+func (m *mockLogger) Warn(msg string, keysAndValues ...interface{}) {
+	m.log("warn", msg, keysAndValues)
+}
+func (m *mockLogger) Error(msg string, keysAndValues ...interface{}) {
+	m.log("error", msg, keysAndValues)
+}
+
+func (m *mockLogger) find(msg string) (mockLogEntry, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	for _, e := range m.entries {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+
+	return mockLogEntry{}, false
+}
+
+func TestUploader_WithLoggerAndRejectingHandler(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingHandler{})
+	defer s.Close()
+
+	l := &mockLogger{}
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{Logger: l})
+
+	u.UploadAction(ActionContainer{Key: "rejected", Timestamp: time.Now()})
+	u.Shutdown()
+
+	failed, ok := l.find("request failed")
+	if !ok || failed.level != "warn" {
+		t.Fatalf("expected a failed request warning, got %+v", l.entries)
+	}
+
+	gaveUp, ok := l.find("giving up on batch")
+	if !ok || gaveUp.level != "error" {
+		t.Fatalf("expected a permanent failure error, got %+v", l.entries)
+	}
+
+	if failed.keysAndValues[0] != "batch_id" || len(failed.keysAndValues[1].(string)) != 26 ||
+		gaveUp.keysAndValues[1] != failed.keysAndValues[1] {
+		t.Errorf("expected both entries to carry the same batch ID: %v, %v",
+			failed.keysAndValues, gaveUp.keysAndValues)
+		t.Fail()
+	}
+
+	if _, ok := l.find("uploader shut down"); !ok {
+		t.Error("expected shutdown to be logged")
+		t.Fail()
+	}
+}
+
+func TestUploader_WithLoggerAndUnencodableAction(t *testing.T) {
+	t.Parallel()
+
+	h := &mockCountingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	l := &mockLogger{}
+	u, _ := NewUploader(
+		s.URL,
+		"some-api-key",
+		1,
+		time.Duration(5*time.Second),
+		http.DefaultClient,
+		&mockWorkingTaskManager{},
+		UploaderOptions{Logger: l})
+
+	d, _ := u.UploadActionAsync(context.Background(), ActionContainer{
+		Key:       "unencodable",
+		Timestamp: time.Now(),
+		Metadata:  map[string]interface{}{"callback": func() {}},
+	})
+	u.Shutdown()
+
+	if e, ok := l.find("encoding batch failed"); !ok || e.level != "error" {
+		t.Errorf("expected an encoding error, got %+v", l.entries)
+		t.Fail()
+	}
+
+	if d.Err() == nil {
+		t.Error("delivery should fail with the encoding error")
+		t.Fail()
+	}
+
+	if u.Stats().PermanentFailures != 1 || atomic.LoadInt32(&h.received) != 0 {
+		t.Errorf("unexpected stats: %+v", u.Stats())
+		t.Fail()
+	}
+}
+
+func TestBuildURL_WithEndpoints(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		baseURL    string
+		endpoints  Endpoints
+		actions    string
+		identities string
+	}{
+		{"https://example.com", Endpoints{}, "https://example.com/events/send-actions", "https://example.com/users/identify"},
+		{"https://example.com/ingest/", Endpoints{}, "https://example.com/ingest/events/send-actions", "https://example.com/ingest/users/identify"},
+		{"https://example.com", Endpoints{APIVersion: "v2"}, "https://example.com/v2/events/send-actions", "https://example.com/v2/users/identify"},
+		{"https://example.com/eu", Endpoints{APIVersion: "/v2/", ActionsPath: "actions", IdentitiesPath: "/identities"},
+			"https://example.com/eu/v2/actions", "https://example.com/eu/v2/identities"},
+	}
+
+	for _, c := range cases {
+		actions, err := buildActionsURL(c.baseURL, c.endpoints)
+		if err != nil || actions != c.actions {
+			t.Errorf("expected actions URL %s, got %s (%v)", c.actions, actions, err)
+			t.Fail()
+		}
+
+		identities, err := buildIdentitiesURL(c.baseURL, c.endpoints)
+		if err != nil || identities != c.identities {
+			t.Errorf("expected identities URL %s, got %s (%v)", c.identities, identities, err)
+			t.Fail()
+		}
+	}
+}
+
+type mockSelector struct {
+	next  []int
+	dones []string
+	down  bool
+}
+
+func (m *mockSelector) Next() int {
+	i := m.next[0]
+	m.next = m.next[1:]
+	return i
+}
+
+func (m *mockSelector) Done(i int, success bool, latency time.Duration) {
+	m.dones = append(m.dones, fmt.Sprintf("%d:%t", i, success))
+}
+
+func (m *mockSelector) AnyHealthy() bool {
+	return !m.down
+}
+
+type mockBreaker struct {
+	dones []bool
+}
+
+func (m *mockBreaker) Allow() error {
+	return nil
+}
+
+func (m *mockBreaker) Done(success bool) {
+	m.dones = append(m.dones, success)
+}
+
+func TestUploader_WithFallbackURLsShouldAskSelector(t *testing.T) {
+	t.Parallel()
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != actionsPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	_, err := NewUploader(down.URL, "some-api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{FallbackURLs: []string{up.URL}})
+	if err == nil {
+		t.Error("fallback URLs without a selector are invalid")
+		t.Fail()
+	}
+
+	rejecting := httptest.NewServer(&mockRejectingHandler{})
+	defer rejecting.Close()
+
+	sel := &mockSelector{next: []int{0, 1, 2}}
+	u, err := NewUploader(down.URL, "some-api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{FallbackURLs: []string{up.URL, rejecting.URL}, Selector: sel})
+	if err != nil {
+		t.Fatalf("creating uploader failed with error: %s", err.Error())
+	}
+
+	send := u.buildRequest(&batch{payloadType: PayloadTypeActions, b: []byte("{}")}, &u.stats.actions)
+	if err := send(1); err == nil {
+		t.Error("expected the first attempt to hit the failing primary")
+		t.Fail()
+	}
+	if err := send(2); err != nil {
+		t.Errorf("expected the second attempt to hit the fallback, got %v", err)
+		t.Fail()
+	}
+
+	if err := send(3); err == nil {
+		t.Error("expected the third attempt to be rejected")
+		t.Fail()
+	}
+
+	// A rejected payload shows the endpoint is up.
+	if len(sel.dones) != 3 || sel.dones[0] != "0:false" || sel.dones[1] != "1:true" || sel.dones[2] != "2:true" {
+		t.Errorf("expected outcomes to be reported per endpoint, got %v", sel.dones)
+		t.Fail()
+	}
+}
+
+func TestUploader_WithFallbackURLsShouldOnlyTripBreakerWhenAllDown(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	sel := &mockSelector{next: []int{0, 1}}
+	br := &mockBreaker{}
+	u, err := NewUploader(s.URL, "some-api-key", 1, time.Duration(5*time.Second), http.DefaultClient,
+		&mockWorkingTaskManager{}, UploaderOptions{FallbackURLs: []string{s.URL}, Selector: sel, Breaker: br})
+	if err != nil {
+		t.Fatalf("creating uploader failed with error: %s", err.Error())
+	}
+
+	p := &batch{payloadType: PayloadTypeActions, b: []byte("{}")}
+	if err := u.attempt(p); err == nil {
+		t.Error("expected the attempt to fail")
+		t.Fail()
+	}
+
+	sel.down = true
+	if err := u.attempt(p); err == nil {
+		t.Error("expected the attempt to fail")
+		t.Fail()
+	}
+
+	if len(br.dones) != 2 || !br.dones[0] || br.dones[1] {
+		t.Errorf("expected only the failure without healthy endpoints to count, got %v", br.dones)
+		t.Fail()
+	}
+}
@@ -0,0 +1,51 @@
+package randomutil
+
+import (
+	crand "crypto/rand"
+	"math/rand"
+	"time"
+)
+
+var (
+	crockford = []byte("0123456789ABCDEFGHJKMNPQRSTVWXYZ")
+
+	// cryptoRead fills the random part. math/rand takes over if it fails.
+	cryptoRead = crand.Read
+)
+
+// ULID returns a 26 character, lexicographically sortable identifier made of a
+// 48-bit millisecond timestamp followed by 80 random bits, encoded in Crockford
+// base32.
+func ULID(t time.Time) string {
+	var b [16]byte
+
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+
+	if _, err := cryptoRead(b[6:]); err != nil {
+		rand.Read(b[6:])
+	}
+
+	// 128 bits are encoded as 26 characters of 5 bits each, starting with the
+	// 3 most significant bits.
+	out := make([]byte, 26)
+	out[0] = crockford[(b[0]&224)>>5]
+	acc := uint32(b[0] & 31)
+	accBits := uint(5)
+	pos := 1
+	for i := 1; i < len(b); i++ {
+		acc = acc<<8 | uint32(b[i])
+		accBits += 8
+		for accBits >= 5 {
+			accBits -= 5
+			out[pos] = crockford[(acc>>accBits)&31]
+			pos++
+		}
+		acc &= (1 << accBits) - 1
+	}
+
+	return string(out)
+}
@@ -0,0 +1,81 @@
+package randomutil
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func assertULID(t *testing.T, id string) {
+	t.Helper()
+
+	if len(id) != 26 {
+		t.Errorf("expected 26 characters, got %d in %q", len(id), id)
+		t.Fail()
+	}
+
+	for _, c := range id {
+		if !strings.ContainsRune(string(crockford), c) {
+			t.Errorf("unexpected character %q in %q", c, id)
+			t.Fail()
+		}
+	}
+}
+
+func TestULID(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := ULID(now)
+		assertULID(t, id)
+
+		if seen[id] {
+			t.Fatalf("duplicate id %q", id)
+		}
+		seen[id] = true
+	}
+
+	// The timestamp of the example in the ULID spec.
+	if id := ULID(time.Unix(0, 1469918176385*int64(time.Millisecond))); id[:10] != "01ARYZ6S41" {
+		t.Errorf("expected timestamp 01ARYZ6S41, got %s", id[:10])
+		t.Fail()
+	}
+}
+
+func TestULID_WithIncreasingTime(t *testing.T) {
+	t.Parallel()
+
+	start := time.Unix(1600000000, 0)
+	prev := ULID(start)
+	for i := 1; i < 1000; i++ {
+		id := ULID(start.Add(time.Duration(i) * time.Millisecond))
+		if id <= prev {
+			t.Fatalf("expected %q to sort after %q", id, prev)
+		}
+		prev = id
+	}
+}
+
+func TestULID_WithFailingCryptoRand(t *testing.T) {
+	// Not parallel since it replaces the package level reader.
+	cryptoRead = func(b []byte) (int, error) {
+		return 0, errors.New("entropy source unavailable")
+	}
+	defer func() {
+		cryptoRead = crand.Read
+	}()
+
+	now := time.Now()
+	a, b := ULID(now), ULID(now)
+	assertULID(t, a)
+	assertULID(t, b)
+
+	if a == b || a[:10] != b[:10] {
+		t.Errorf("expected the fallback to keep the timestamp and randomize the rest, got %q and %q", a, b)
+		t.Fail()
+	}
+}
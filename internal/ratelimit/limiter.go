@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket refilled at rate tokens per second up to burst tokens.
+// Reservations may take more tokens than available, leaving the bucket in debt
+// which later reservations have to wait out.
+type bucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mx     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, burst int, now func() time.Time) *bucket {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+		if burst < 1 {
+			burst = 1
+		}
+	}
+
+	return &bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		now:    now,
+		tokens: float64(burst),
+		last:   now(),
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes n tokens and returns how long to wait until they are available.
+func (b *bucket) reserve(n int) time.Duration {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.refill(b.now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back n tokens of a reservation that wasn't used.
+func (b *bucket) cancel(n int) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.refill(b.now())
+	b.tokens = math.Min(b.burst, b.tokens+float64(n))
+}
+
+// Limiter limits both the number of requests and the number of events they carry
+// per second. Waiting callers are delayed, never rejected.
+type Limiter struct {
+	requests *bucket
+	events   *bucket
+}
+
+// Wait blocks until a request carrying given number of events may be sent. It
+// returns ctx.Err() if ctx is done first, in which case nothing is taken.
+func (l *Limiter) Wait(ctx context.Context, events int) error {
+	var delay time.Duration
+	if l.requests != nil {
+		delay = l.requests.reserve(1)
+	}
+	if l.events != nil && events > 0 {
+		if d := l.events.reserve(events); d > delay {
+			delay = d
+		}
+	}
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		if l.requests != nil {
+			l.requests.cancel(1)
+		}
+		if l.events != nil && events > 0 {
+			l.events.cancel(events)
+		}
+		return ctx.Err()
+	}
+}
+
+// NewLimiter creates a new Limiter instance allowing requestRate requests and
+// eventRate events per second. Either rate may be zero to leave it unlimited.
+// Bursts are the number of requests and events allowed at once and default to
+// one second's worth when zero. Use this function to instantiate a concrete
+// Limiter type.
+func NewLimiter(requestRate float64, requestBurst int, eventRate float64, eventBurst int) (*Limiter, error) {
+	if requestRate < 0 || eventRate < 0 {
+		return nil, errors.New("rates can't be negative")
+	}
+
+	if requestBurst < 0 || eventBurst < 0 {
+		return nil, errors.New("bursts can't be negative")
+	}
+
+	if requestRate == 0 && eventRate == 0 {
+		return nil, errors.New("at least one rate must be positive")
+	}
+
+	l := &Limiter{}
+	if requestRate > 0 {
+		l.requests = newBucket(requestRate, requestBurst, time.Now)
+	}
+	if eventRate > 0 {
+		l.events = newBucket(eventRate, eventBurst, time.Now)
+	}
+
+	return l, nil
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type mockClock struct {
+	t time.Time
+}
+
+func (m *mockClock) now() time.Time {
+	return m.t
+}
+
+func TestNewLimiter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		requestRate  float64
+		requestBurst int
+		eventRate    float64
+		eventBurst   int
+	}{
+		{0, 0, 0, 0},
+		{-1, 0, 0, 0},
+		{1, -1, 0, 0},
+		{0, 0, -1, 0},
+		{0, 0, 1, -1},
+	}
+
+	for _, tc := range tests {
+		_, err := NewLimiter(tc.requestRate, tc.requestBurst, tc.eventRate, tc.eventBurst)
+		if err == nil {
+			t.Errorf("given values %v are invalid", tc)
+			t.Fail()
+		}
+	}
+}
+
+func TestBucket_WithReserve(t *testing.T) {
+	t.Parallel()
+
+	clock := &mockClock{time.Now()}
+	b := newBucket(10, 2, clock.now)
+
+	// The burst is available right away.
+	if b.reserve(1) != 0 || b.reserve(1) != 0 {
+		t.Error("burst should not be delayed")
+		t.Fail()
+	}
+
+	if d := b.reserve(1); d != 100*time.Millisecond {
+		t.Errorf("expected 100ms delay, got %s", d)
+		t.Fail()
+	}
+
+	// Reservations larger than the burst are allowed but have to wait longer.
+	if d := b.reserve(5); d != 600*time.Millisecond {
+		t.Errorf("expected 600ms delay, got %s", d)
+		t.Fail()
+	}
+
+	clock.t = clock.t.Add(time.Second)
+	if d := b.reserve(1); d != 0 {
+		t.Errorf("debt should have been paid off, got %s delay", d)
+		t.Fail()
+	}
+
+	// Refilling never exceeds the burst.
+	clock.t = clock.t.Add(time.Hour)
+	b.reserve(2)
+	if d := b.reserve(1); d != 100*time.Millisecond {
+		t.Errorf("expected 100ms delay, got %s", d)
+		t.Fail()
+	}
+}
+
+func TestNewBucket_WithDefaultBurst(t *testing.T) {
+	t.Parallel()
+
+	clock := &mockClock{time.Now()}
+	if b := newBucket(2.5, 0, clock.now); b.burst != 3 {
+		t.Errorf("expected burst of 3, got %v", b.burst)
+		t.Fail()
+	}
+
+	if b := newBucket(0.5, 0, clock.now); b.burst != 1 {
+		t.Errorf("expected burst of 1, got %v", b.burst)
+		t.Fail()
+	}
+}
+
+func TestLimiter_WithWait(t *testing.T) {
+	t.Parallel()
+
+	l, _ := NewLimiter(20, 1, 0, 0)
+
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(context.Background(), 100); err != nil {
+			t.Fatalf("waiting failed with error: %s", err.Error())
+		}
+	}
+
+	if elapsed := time.Since(started); elapsed < 90*time.Millisecond {
+		t.Errorf("3 requests at 20/s should take about 100ms, took %s", elapsed)
+		t.Fail()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	l, _ = NewLimiter(0, 0, 1, 1)
+	l.Wait(context.Background(), 1)
+	if err := l.Wait(ctx, 1); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+		t.Fail()
+	}
+}
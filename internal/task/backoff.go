@@ -0,0 +1,47 @@
+package task
+
+import (
+	"time"
+)
+
+// Backoff computes how long a worker waits before retrying a failed task.
+type Backoff interface {
+	// Next returns the delay before the given retry, starting at 1. prev is the
+	// delay used before the previous retry and zero before the first one.
+	Next(retry int, prev time.Duration) time.Duration
+}
+
+// RetryAfterError is implemented by errors that carry the exact delay requested
+// by the other side, such as an HTTP Retry-After header.
+type RetryAfterError interface {
+	error
+	RetryAfter() time.Duration
+}
+
+// PermanentError is implemented by errors marking a failure that retrying can't
+// fix. The Manager gives up on the task right away and reports Unwrap() to hooks
+// and callbacks instead of the marker itself.
+type PermanentError interface {
+	error
+	Permanent() bool
+	Unwrap() error
+}
+
+// DeferredError is implemented by errors marking a task that couldn't run yet,
+// such as a request held back by a circuit breaker. The Manager retries it after
+// the delay of Unwrap() without counting an attempt, so only MaxElapsed and a
+// shutdown deadline bound how long a task keeps being deferred.
+type DeferredError interface {
+	error
+	Deferred() bool
+	Unwrap() error
+}
+
+// linearBackoff adds a constant step for each retry.
+type linearBackoff struct {
+	step time.Duration
+}
+
+func (b linearBackoff) Next(retry int, prev time.Duration) time.Duration {
+	return b.step * time.Duration(retry)
+}
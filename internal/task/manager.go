@@ -1,6 +1,7 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -9,18 +10,50 @@ import (
 	"github.com/dataart-ai/dataart-go/internal/pkg/atomicutil"
 )
 
+// ErrAbandoned is reported for tasks that were skipped or cut short because a
+// shutdown deadline expired.
+var ErrAbandoned = errors.New("task abandoned on shutdown")
+
+// DefaultMaxRetryAfter caps the delays requested through RetryAfterError unless
+// ManagerOptions.MaxRetryAfter says otherwise.
+const DefaultMaxRetryAfter = 5 * time.Minute
+
+// ManagerOptions holds the optional settings of a Manager. The zero value is
+// valid and keeps the linear backoff derived from backoffRatio.
+type ManagerOptions struct {
+	// Backoff computes the delay between retries. It replaces backoffRatio.
+	Backoff Backoff
+
+	// MaxElapsed bounds the total time spent on a task, including the delays
+	// between retries. A task is given up on if the next retry would start
+	// after MaxElapsed. Zero means no limit.
+	MaxElapsed time.Duration
+
+	// MaxRetryAfter caps the delays requested through RetryAfterError, so a
+	// misbehaving server can't stall a worker for hours. Defaults to
+	// DefaultMaxRetryAfter when zero.
+	MaxRetryAfter time.Duration
+}
+
 // Manager receives task functions and distributes them among worker goroutines.
 // If any given function returns an error it will be retried when numRetries > 0.
 type Manager struct {
-	numWorkers   int
-	bufferSize   int
-	numRetries   int
-	backoffRatio int
+	numWorkers    int
+	bufferSize    int
+	numRetries    int
+	backoffRatio  int
+	backoff       Backoff
+	maxElapsed    time.Duration
+	maxRetryAfter time.Duration
 
 	doneHook func(taskUID string, workerID string)
 	failHook func(taskUID string, workerID string, err error)
 
-	buffer chan task
+	buffer        chan task
+	abandonCh     chan struct{}
+	abandonOnce   sync.Once
+	failDeferCh   chan struct{}
+	failDeferOnce sync.Once
 
 	once       sync.Once
 	wg         sync.WaitGroup
@@ -28,41 +61,140 @@ type Manager struct {
 	isStarted  atomicutil.Bool
 }
 
+// retryDelay returns how long to wait before given retry. A delay requested by
+// the error itself takes precedence over the backoff policy, up to maxRetryAfter.
+func (m *Manager) retryDelay(retry int, prev time.Duration, err error) time.Duration {
+	if rerr, ok := err.(RetryAfterError); ok {
+		if d := rerr.RetryAfter(); d > 0 {
+			if d > m.maxRetryAfter {
+				d = m.maxRetryAfter
+			}
+			return d
+		}
+	}
+
+	return m.backoff.Next(retry, prev)
+}
+
+func (m *Manager) failsDeferred() bool {
+	select {
+	case <-m.failDeferCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Manager) isAbandoned() bool {
+	select {
+	case <-m.abandonCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// run executes t until it succeeds or runs out of retries and returns the number
+// of attempts made along with the error of the last one. Deferred runs don't
+// count as attempts.
+func (m *Manager) run(t task, workerID string) (int, error) {
+	var err error
+	var delay time.Duration
+	started := time.Now()
+
+	// failDeferCh is only watched while waiting to rerun a deferred task.
+	var failDeferCh chan struct{}
+
+	attempts := 0
+	for n := 0; ; n++ {
+		if n > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-m.abandonCh:
+				timer.Stop()
+				return attempts, ErrAbandoned
+			case <-failDeferCh:
+				timer.Stop()
+				return attempts, err
+			}
+		}
+		failDeferCh = nil
+
+		err = t.work(workerID)
+		if err == nil {
+			if m.doneHook != nil {
+				m.doneHook(t.id, workerID)
+			}
+
+			return attempts + 1, nil
+		}
+
+		if derr, ok := err.(DeferredError); ok && derr.Deferred() {
+			err = derr.Unwrap()
+			if m.isAbandoned() {
+				return attempts, ErrAbandoned
+			}
+			if m.failsDeferred() {
+				return attempts, err
+			}
+
+			delay = m.retryDelay(attempts+1, delay, err)
+			if m.maxElapsed > 0 && time.Since(started)+delay > m.maxElapsed {
+				return attempts, err
+			}
+			failDeferCh = m.failDeferCh
+			continue
+		}
+		attempts++
+
+		permanent := false
+		if perr, ok := err.(PermanentError); ok && perr.Permanent() {
+			permanent = true
+			err = perr.Unwrap()
+		}
+
+		// Job failed. Worker will wait for the backoff delay and retry.
+		if m.failHook != nil {
+			m.failHook(t.id, workerID, err)
+		}
+
+		// We add 1 to numRetries for the first run.
+		if permanent || attempts == m.numRetries+1 {
+			return attempts, err
+		}
+
+		if m.isAbandoned() {
+			return attempts, ErrAbandoned
+		}
+
+		delay = m.retryDelay(attempts, delay, err)
+		if m.maxElapsed > 0 && time.Since(started)+delay > m.maxElapsed {
+			return attempts, err
+		}
+	}
+}
+
 func (m *Manager) start() {
 	m.isStarted.SetTrue()
 
 	for i := 0; i < m.numWorkers; i++ {
-		go func(wid, numRetries, backoffRatio int, wg *sync.WaitGroup, buffer <-chan task,
-			doneHook func(taskUID string, workerID string),
-			failHook func(taskUID string, workerID string, err error)) {
-
+		go func(wid int) {
 			workerID := fmt.Sprintf("worker-%d", wid)
 
-			for t := range buffer {
-				// We add 1 to numRetries for the first run.
-				for r := 0; r < numRetries+1; r++ {
-					err := t.work()
-					if err != nil {
-						// Job failed. Worker will sleep for (backoffRatio*r) seconds and retry.
-						if failHook != nil {
-							failHook(t.id, workerID, err)
-						}
-
-						// We add 1 to r since it starts with 0.
-						backoff := backoffRatio * (r + 1)
-						time.Sleep(time.Duration(backoff) * time.Second)
-					} else if err == nil {
-						if doneHook != nil {
-							doneHook(t.id, workerID)
-						}
-
-						break
-					}
+			for t := range m.buffer {
+				attempts, err := 0, ErrAbandoned
+				if !m.isAbandoned() {
+					attempts, err = m.run(t, workerID)
+				}
+
+				if t.done != nil {
+					t.done(attempts, err)
 				}
 
-				wg.Done()
+				m.wg.Done()
 			}
-		}(i, m.numRetries, m.backoffRatio, &m.wg, m.buffer, m.doneHook, m.failHook)
+		}(i)
 	}
 }
 
@@ -70,6 +202,23 @@ func (m *Manager) start() {
 // it will be retried numRetries times until giving up. Queue returns an error
 // if the manager instance is shutting down.
 func (m *Manager) Queue(work func() error) error {
+	return m.QueueWithCallback(work, nil)
+}
+
+// QueueWithCallback works like Queue and additionally calls done once the work
+// has either succeeded or failed on its last retry. done receives the number
+// of attempts made and the error of the last one, which is nil on success.
+func (m *Manager) QueueWithCallback(work func() error, done func(attempts int, err error)) error {
+	return m.QueueTask("", func(string) error { return work() }, done)
+}
+
+// QueueTask works like QueueWithCallback but identifies the task with given id,
+// which is passed to the hooks, and tells work the ID of the worker running it.
+// An empty id is replaced with a random one. It returns ErrAbandoned without
+// queueing the task if the manager is abandoned while waiting for room.
+func (m *Manager) QueueTask(id string, work func(workerID string) error,
+	done func(attempts int, err error)) error {
+
 	if m.inShutdown.IsSet() {
 		return errors.New("manager is shutting down")
 	}
@@ -77,27 +226,80 @@ func (m *Manager) Queue(work func() error) error {
 	m.once.Do(m.start)
 
 	m.wg.Add(1)
-	m.buffer <- newTask(work)
-	return nil
+	select {
+	case m.buffer <- newTask(id, work, done):
+		return nil
+	case <-m.abandonCh:
+		m.wg.Done()
+		return ErrAbandoned
+	}
+}
+
+// Abandon makes workers give up retrying and skip the remaining tasks, whose
+// callbacks receive ErrAbandoned, and makes QueueTask stop waiting for room in
+// the buffer. Tasks already running are not interrupted. It's safe to call more
+// than once.
+func (m *Manager) Abandon() {
+	m.abandonOnce.Do(func() {
+		close(m.abandonCh)
+	})
+}
+
+// FailDeferred makes deferred tasks fail with their last error instead of
+// waiting to run again, including those waiting already. It's safe to call more
+// than once.
+func (m *Manager) FailDeferred() {
+	m.failDeferOnce.Do(func() {
+		close(m.failDeferCh)
+	})
+}
+
+// QueueDepth returns the number of tasks waiting for a worker.
+func (m *Manager) QueueDepth() int {
+	return len(m.buffer)
 }
 
 // Shutdown terminates Manager gracefully. It waits for all workers to return
 // then closes the buffer channel and returns.
 func (m *Manager) Shutdown() {
+	m.ShutdownContext(context.Background())
+}
+
+// ShutdownContext works like Shutdown but stops waiting for pending tasks once
+// ctx is done. Workers then give up retrying and skip the remaining tasks, whose
+// callbacks receive ErrAbandoned. Tasks already running are waited for. It
+// returns ctx.Err() if the deadline cut the shutdown short.
+func (m *Manager) ShutdownContext(ctx context.Context) error {
 	if m.inShutdown.IsSet() || !m.isStarted.IsSet() {
-		return
+		return nil
 	}
 	m.inShutdown.SetTrue()
 
-	m.wg.Wait()
+	finished := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(finished)
+	}()
+
+	var err error
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		err = ctx.Err()
+		m.Abandon()
+		<-finished
+	}
+
 	close(m.buffer)
+	return err
 }
 
 // NewManager creates a new Manager instance using provided values. Use this
 // function to instantiate a concrete Manager type.
 func NewManager(numWorkers, bufferSize, numRetries, backoffRatio int,
 	doneHook func(taskUID, workerID string),
-	failHook func(taskUID, workerID string, err error)) (*Manager, error) {
+	failHook func(taskUID, workerID string, err error),
+	opts ManagerOptions) (*Manager, error) {
 
 	if numWorkers < 1 {
 		return nil, errors.New("numWorkers must be at least 1")
@@ -111,18 +313,41 @@ func NewManager(numWorkers, bufferSize, numRetries, backoffRatio int,
 		return nil, errors.New("numRetries can't be negative")
 	}
 
-	if backoffRatio < 1 {
+	if backoffRatio < 1 && opts.Backoff == nil {
 		return nil, errors.New("backoffRatio must be at least 1")
 	}
 
+	if opts.MaxElapsed < 0 {
+		return nil, errors.New("maxElapsed can't be negative")
+	}
+
+	if opts.MaxRetryAfter < 0 {
+		return nil, errors.New("maxRetryAfter can't be negative")
+	}
+
+	maxRetryAfter := opts.MaxRetryAfter
+	if maxRetryAfter == 0 {
+		maxRetryAfter = DefaultMaxRetryAfter
+	}
+
+	backoff := opts.Backoff
+	if backoff == nil {
+		backoff = linearBackoff{step: time.Duration(backoffRatio) * time.Second}
+	}
+
 	tm := &Manager{
-		numWorkers:   numWorkers,
-		bufferSize:   bufferSize,
-		numRetries:   numRetries,
-		backoffRatio: backoffRatio,
-		doneHook:     doneHook,
-		failHook:     failHook,
-		buffer:       make(chan task, bufferSize),
+		numWorkers:    numWorkers,
+		bufferSize:    bufferSize,
+		numRetries:    numRetries,
+		backoffRatio:  backoffRatio,
+		backoff:       backoff,
+		maxElapsed:    opts.MaxElapsed,
+		maxRetryAfter: maxRetryAfter,
+		doneHook:      doneHook,
+		failHook:      failHook,
+		buffer:        make(chan task, bufferSize),
+		abandonCh:     make(chan struct{}),
+		failDeferCh:   make(chan struct{}),
 	}
 
 	return tm, nil
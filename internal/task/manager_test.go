@@ -1,6 +1,7 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"math/rand"
 	"sync"
@@ -11,25 +12,25 @@ import (
 func TestNewManager(t *testing.T) {
 	t.Parallel()
 
-	_, err := NewManager(0, 1, 1, 1, nil, nil)
+	_, err := NewManager(0, 1, 1, 1, nil, nil, ManagerOptions{})
 	if err == nil {
 		t.Error("given numWorkers is invalid")
 		t.Fail()
 	}
 
-	_, err = NewManager(1, 0, 1, 1, nil, nil)
+	_, err = NewManager(1, 0, 1, 1, nil, nil, ManagerOptions{})
 	if err == nil {
 		t.Error("given bufferSize is invalid")
 		t.Fail()
 	}
 
-	_, err = NewManager(1, 1, -1, 1, nil, nil)
+	_, err = NewManager(1, 1, -1, 1, nil, nil, ManagerOptions{})
 	if err == nil {
 		t.Error("given numRetries is invalid")
 		t.Fail()
 	}
 
-	_, err = NewManager(1, 1, 1, 0, nil, nil)
+	_, err = NewManager(1, 1, 1, 0, nil, nil, ManagerOptions{})
 	if err == nil {
 		t.Error("given backoffRatio is invalid")
 		t.Fail()
@@ -48,7 +49,7 @@ func TestManager_WithWorkersLessThanTasks(t *testing.T) {
 		doneTasks += 1
 		mx.Unlock()
 	}
-	tm, _ := NewManager(numWorkers, 1, 1, 1, doneHook, nil)
+	tm, _ := NewManager(numWorkers, 1, 1, 1, doneHook, nil, ManagerOptions{})
 
 	for i := 0; i < numTasks; i++ {
 		tm.Queue(func() error {
@@ -75,7 +76,7 @@ func TestManager_WithWorkersEqualToTasks(t *testing.T) {
 		doneTasks += 1
 		mx.Unlock()
 	}
-	tm, _ := NewManager(numWorkers, 1, 1, 1, doneHook, nil)
+	tm, _ := NewManager(numWorkers, 1, 1, 1, doneHook, nil, ManagerOptions{})
 
 	for i := 0; i < numTasks; i++ {
 		tm.Queue(func() error {
@@ -102,7 +103,7 @@ func TestManager_WithWorkersMoreThanTasks(t *testing.T) {
 		doneTasks += 1
 		mx.Unlock()
 	}
-	tm, _ := NewManager(numWorkers, 1, 1, 1, doneHook, nil)
+	tm, _ := NewManager(numWorkers, 1, 1, 1, doneHook, nil, ManagerOptions{})
 
 	for i := 0; i < numTasks; i++ {
 		tm.Queue(func() error {
@@ -130,7 +131,7 @@ func TestManager_WithFailingTaskShouldRetryEnoughTimes(t *testing.T) {
 		numTries += 1
 		mx.Unlock()
 	}
-	tm, _ := NewManager(numWorkers, 1, numRetries, 1, nil, failHook)
+	tm, _ := NewManager(numWorkers, 1, numRetries, 1, nil, failHook, ManagerOptions{})
 
 	for i := 0; i < numTasks; i++ {
 		tm.Queue(func() error {
@@ -152,7 +153,7 @@ func TestManager_WithFailingTaskShouldRetryEnoughTimes(t *testing.T) {
 func TestManager_WithQueueAfterShutdown(t *testing.T) {
 	t.Parallel()
 
-	tm, _ := NewManager(1, 1, 1, 1, nil, nil)
+	tm, _ := NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{})
 
 	tm.Queue(func() error {
 		return nil
@@ -171,3 +172,481 @@ func TestManager_WithQueueAfterShutdown(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestManager_WithCallbackShouldReportAttempts(t *testing.T) {
+	t.Parallel()
+
+	numRetries := 2
+	mx := sync.Mutex{}
+	results := make(map[string]int)
+	errs := make(map[string]error)
+	tm, _ := NewManager(2, 1, numRetries, 1, nil, nil, ManagerOptions{})
+
+	tm.QueueWithCallback(func() error {
+		return nil
+	}, func(attempts int, err error) {
+		mx.Lock()
+		results["ok"] = attempts
+		errs["ok"] = err
+		mx.Unlock()
+	})
+
+	tm.QueueWithCallback(func() error {
+		return errors.New("tasks failed for some reason")
+	}, func(attempts int, err error) {
+		mx.Lock()
+		results["failing"] = attempts
+		errs["failing"] = err
+		mx.Unlock()
+	})
+
+	tm.Shutdown()
+
+	if results["ok"] != 1 || errs["ok"] != nil {
+		t.Errorf("succeeding task should report 1 attempt, got %d", results["ok"])
+		t.Fail()
+	}
+
+	if results["failing"] != numRetries+1 || errs["failing"] == nil {
+		t.Errorf("failing task should report %d attempts, got %d", numRetries+1, results["failing"])
+		t.Fail()
+	}
+}
+
+type mockRecordingBackoff struct {
+	mx      sync.Mutex
+	retries []int
+}
+
+func (m *mockRecordingBackoff) Next(retry int, prev time.Duration) time.Duration {
+	m.mx.Lock()
+	m.retries = append(m.retries, retry)
+	m.mx.Unlock()
+
+	return time.Millisecond
+}
+
+type mockRetryAfterError struct {
+	after time.Duration
+}
+
+func (m *mockRetryAfterError) Error() string {
+	return "server asked to retry later"
+}
+
+func (m *mockRetryAfterError) RetryAfter() time.Duration {
+	return m.after
+}
+
+func TestNewManager_WithOptions(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewManager(1, 1, 1, 0, nil, nil, ManagerOptions{Backoff: &mockRecordingBackoff{}})
+	if err != nil {
+		t.Error("backoffRatio should be ignored when a backoff policy is given")
+		t.Fail()
+	}
+
+	_, err = NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{MaxElapsed: -1})
+	if err == nil {
+		t.Error("given maxElapsed is invalid")
+		t.Fail()
+	}
+
+	_, err = NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{MaxRetryAfter: -1})
+	if err == nil {
+		t.Error("given maxRetryAfter is invalid")
+		t.Fail()
+	}
+}
+
+func TestManager_WithBackoffPolicy(t *testing.T) {
+	t.Parallel()
+
+	b := &mockRecordingBackoff{}
+	tm, _ := NewManager(1, 1, 3, 0, nil, nil, ManagerOptions{Backoff: b})
+
+	tm.Queue(func() error {
+		return errors.New("tasks failed for some reason")
+	})
+	tm.Shutdown()
+
+	// The policy is asked once per retry, never after the last attempt.
+	if len(b.retries) != 3 || b.retries[0] != 1 || b.retries[2] != 3 {
+		t.Errorf("unexpected backoff calls: %v", b.retries)
+		t.Fail()
+	}
+}
+
+func TestManager_WithRetryAfterError(t *testing.T) {
+	t.Parallel()
+
+	b := &mockRecordingBackoff{}
+	tm, _ := NewManager(1, 1, 1, 0, nil, nil, ManagerOptions{Backoff: b})
+
+	var attempts []time.Time
+	tm.Queue(func() error {
+		attempts = append(attempts, time.Now())
+		return &mockRetryAfterError{after: 200 * time.Millisecond}
+	})
+	tm.Shutdown()
+
+	if len(b.retries) != 0 {
+		t.Error("retry after delay should take precedence over backoff policy")
+		t.Fail()
+	}
+
+	if len(attempts) != 2 || attempts[1].Sub(attempts[0]) < 200*time.Millisecond {
+		t.Error("worker should have waited for the requested delay")
+		t.Fail()
+	}
+}
+
+func TestManager_WithRetryAfterErrorShouldBeCapped(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{MaxRetryAfter: 50 * time.Millisecond})
+
+	var attempts []time.Time
+	tm.Queue(func() error {
+		attempts = append(attempts, time.Now())
+		return &mockRetryAfterError{after: time.Hour}
+	})
+	tm.Shutdown()
+
+	if len(attempts) != 2 || attempts[1].Sub(attempts[0]) > time.Second {
+		t.Error("worker should have waited no longer than maxRetryAfter")
+		t.Fail()
+	}
+
+	tm, _ = NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{})
+	if d := tm.retryDelay(1, 0, &mockRetryAfterError{after: time.Hour}); d != DefaultMaxRetryAfter {
+		t.Errorf("expected the default cap, got %s", d)
+		t.Fail()
+	}
+}
+
+func TestManager_WithMaxElapsedShouldGiveUpEarly(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 1, 5, 1, nil, nil, ManagerOptions{MaxElapsed: 500 * time.Millisecond})
+
+	attempts := 0
+	tm.QueueWithCallback(func() error {
+		return errors.New("tasks failed for some reason")
+	}, func(n int, err error) {
+		attempts = n
+	})
+	tm.Shutdown()
+
+	// The first retry would start after 1 second which exceeds the limit.
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+		t.Fail()
+	}
+}
+
+type mockPermanentError struct {
+	err error
+}
+
+func (m *mockPermanentError) Error() string {
+	return m.err.Error()
+}
+
+func (m *mockPermanentError) Permanent() bool {
+	return true
+}
+
+func (m *mockPermanentError) Unwrap() error {
+	return m.err
+}
+
+func TestManager_WithPermanentErrorShouldNotRetry(t *testing.T) {
+	t.Parallel()
+
+	cause := errors.New("request is malformed")
+	tm, _ := NewManager(1, 1, 3, 1, nil, nil, ManagerOptions{})
+
+	attempts := 0
+	var lastErr error
+	tm.QueueWithCallback(func() error {
+		return &mockPermanentError{cause}
+	}, func(n int, err error) {
+		attempts = n
+		lastErr = err
+	})
+	tm.Shutdown()
+
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+		t.Fail()
+	}
+
+	if lastErr != cause {
+		t.Error("callback should receive the unwrapped error")
+		t.Fail()
+	}
+}
+
+type mockDeferredError struct {
+	err error
+}
+
+func (m *mockDeferredError) Error() string {
+	return m.err.Error()
+}
+
+func (m *mockDeferredError) Deferred() bool {
+	return true
+}
+
+func (m *mockDeferredError) Unwrap() error {
+	return m.err
+}
+
+func TestManager_WithDeferredErrorShouldNotCountAttempts(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{})
+
+	runs := 0
+	attempts := 0
+	var lastErr error
+	tm.QueueWithCallback(func() error {
+		runs++
+		if runs < 4 {
+			return &mockDeferredError{&mockRetryAfterError{after: time.Millisecond}}
+		}
+		return errors.New("tasks failed for some reason")
+	}, func(n int, err error) {
+		attempts = n
+		lastErr = err
+	})
+	tm.Shutdown()
+
+	// Deferred runs come on top of the first attempt and the single retry.
+	if runs != 5 || attempts != 2 {
+		t.Errorf("expected 5 runs and 2 attempts, got %d runs and %d attempts", runs, attempts)
+		t.Fail()
+	}
+
+	if lastErr == nil {
+		t.Error("callback should receive the error of the last attempt")
+		t.Fail()
+	}
+}
+
+func TestManager_WithDeferredErrorAndMaxElapsed(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{MaxElapsed: 100 * time.Millisecond})
+
+	cause := &mockRetryAfterError{after: 20 * time.Millisecond}
+	runs := 0
+	attempts := -1
+	var lastErr error
+	tm.QueueWithCallback(func() error {
+		runs++
+		return &mockDeferredError{cause}
+	}, func(n int, err error) {
+		attempts = n
+		lastErr = err
+	})
+	tm.Shutdown()
+
+	if runs < 2 || attempts != 0 {
+		t.Errorf("expected the task to be deferred until MaxElapsed, got %d runs and %d attempts",
+			runs, attempts)
+		t.Fail()
+	}
+
+	if lastErr != cause {
+		t.Error("callback should receive the unwrapped error")
+		t.Fail()
+	}
+}
+
+func TestManager_WithFailDeferredShouldStopWaiting(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 1, 1, 1, nil, nil, ManagerOptions{})
+
+	cause := &mockRetryAfterError{after: time.Minute}
+	runCh := make(chan struct{}, 1)
+	doneCh := make(chan error, 2)
+	done := func(n int, err error) {
+		doneCh <- err
+	}
+
+	tm.QueueWithCallback(func() error {
+		runCh <- struct{}{}
+		return &mockDeferredError{cause}
+	}, done)
+	<-runCh
+
+	// The task waits a minute before its next run unless told to fail.
+	tm.FailDeferred()
+
+	select {
+	case err := <-doneCh:
+		if err != cause {
+			t.Errorf("expected the unwrapped error, got %v", err)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("deferred task should have failed without waiting")
+	}
+
+	// Later deferrals fail right away.
+	tm.QueueWithCallback(func() error {
+		return &mockDeferredError{cause}
+	}, done)
+	tm.Shutdown()
+
+	if err := <-doneCh; err != cause {
+		t.Errorf("expected the unwrapped error, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestManager_WithShutdownDeadlineShouldAbandonTasks(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 2, 3, 10, nil, nil, ManagerOptions{})
+
+	mx := sync.Mutex{}
+	errs := make([]error, 0)
+	done := func(attempts int, err error) {
+		mx.Lock()
+		errs = append(errs, err)
+		mx.Unlock()
+	}
+
+	// The first task fails and makes the only worker wait 10 seconds before its
+	// retry, so the second one is still in the buffer when the deadline expires.
+	tm.QueueWithCallback(func() error {
+		return errors.New("tasks failed for some reason")
+	}, done)
+	tm.QueueWithCallback(func() error {
+		return nil
+	}, done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err := tm.ShutdownContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+		t.Fail()
+	}
+
+	if time.Since(started) > 2*time.Second {
+		t.Error("shutdown should not wait for backoff delays after the deadline")
+		t.Fail()
+	}
+
+	if len(errs) != 2 || errs[0] != ErrAbandoned || errs[1] != ErrAbandoned {
+		t.Errorf("both tasks should have been abandoned, got %v", errs)
+		t.Fail()
+	}
+}
+
+func TestManager_WithAbandonShouldUnblockQueue(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 1, 0, 1, nil, nil, ManagerOptions{})
+
+	releaseCh := make(chan struct{})
+	startedCh := make(chan struct{})
+	tm.Queue(func() error {
+		close(startedCh)
+		<-releaseCh
+		return nil
+	})
+	<-startedCh
+
+	// The only worker is busy and the buffer is full, so the next task waits
+	// for room until the manager is abandoned.
+	tm.Queue(func() error { return nil })
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tm.Queue(func() error { return nil })
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	tm.Abandon()
+
+	select {
+	case err := <-errCh:
+		if err != ErrAbandoned {
+			t.Errorf("expected abandoned error, got %v", err)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queueing should stop waiting once the manager is abandoned")
+	}
+
+	close(releaseCh)
+	tm.Shutdown()
+}
+
+func TestManager_WithQueueDepth(t *testing.T) {
+	t.Parallel()
+
+	tm, _ := NewManager(1, 3, 0, 1, nil, nil, ManagerOptions{})
+
+	releaseCh := make(chan struct{})
+	startedCh := make(chan struct{})
+	tm.Queue(func() error {
+		close(startedCh)
+		<-releaseCh
+		return nil
+	})
+	<-startedCh
+
+	// The only worker is busy, so the next tasks wait in the buffer.
+	tm.Queue(func() error { return nil })
+	tm.Queue(func() error { return nil })
+
+	if d := tm.QueueDepth(); d != 2 {
+		t.Errorf("expected queue depth of 2, got %d", d)
+		t.Fail()
+	}
+
+	close(releaseCh)
+	tm.Shutdown()
+
+	if tm.QueueDepth() != 0 {
+		t.Fail()
+	}
+}
+
+func TestManager_WithQueueTask(t *testing.T) {
+	t.Parallel()
+
+	var hookTaskID, hookWorkerID string
+	doneHook := func(tid, wid string) {
+		hookTaskID, hookWorkerID = tid, wid
+	}
+	tm, _ := NewManager(1, 1, 1, 1, doneHook, nil, ManagerOptions{})
+
+	var workerID string
+	tm.QueueTask("some-batch-id", func(wid string) error {
+		workerID = wid
+		return nil
+	}, nil)
+	tm.Shutdown()
+
+	if hookTaskID != "some-batch-id" {
+		t.Errorf("expected task ID to be passed to the hook, got %q", hookTaskID)
+		t.Fail()
+	}
+
+	if workerID != "worker-0" || hookWorkerID != workerID {
+		t.Errorf("expected work and hook to see worker-0, got %q and %q", workerID, hookWorkerID)
+		t.Fail()
+	}
+}
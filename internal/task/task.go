@@ -10,12 +10,21 @@ const (
 
 type task struct {
 	id   string
-	work func() error
+	work func(workerID string) error
+
+	// done is called once the task succeeds or exhausts its retries. It may be nil.
+	done func(attempts int, err error)
 }
 
-func newTask(work func() error) task {
+// newTask creates a task with given id, or a random one if id is empty.
+func newTask(id string, work func(workerID string) error, done func(attempts int, err error)) task {
+	if len(id) == 0 {
+		id = randomutil.String(taskIDLength)
+	}
+
 	return task{
-		id:   randomutil.String(taskIDLength),
+		id:   id,
 		work: work,
+		done: done,
 	}
 }
@@ -0,0 +1,542 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recordKindEntry byte = 1
+	recordKindAck   byte = 2
+
+	// kind (1) + seq (8) + payload length (4) + payload checksum (4)
+	recordHeaderSize = 17
+
+	segmentExt = ".seg"
+
+	// DefaultSegmentSize is used when Open is called with a non-positive segment size.
+	DefaultSegmentSize = int64(16 * 1024 * 1024)
+)
+
+type segment struct {
+	id      uint64
+	path    string
+	pending int
+
+	// acks holds the IDs of the older segments whose entries this segment
+	// acknowledges.
+	acks map[uint64]struct{}
+}
+
+func (s *segment) addAck(owner *segment) {
+	if owner == s {
+		return
+	}
+
+	if s.acks == nil {
+		s.acks = make(map[uint64]struct{})
+	}
+	s.acks[owner.id] = struct{}{}
+}
+
+type entry struct {
+	seq  uint64
+	data []byte
+}
+
+// Log is an append-only queue persisted as segment files in a directory. Each
+// appended entry gets an increasing sequence number and stays in the log until
+// it is acknowledged. Segments are removed once they contain no pending entries
+// and no acknowledgements of entries in segments still on disk.
+type Log struct {
+	dir          string
+	segmentSize  int64
+	syncInterval time.Duration
+	stopCh       chan struct{}
+	stoppedCh    chan struct{}
+
+	mx         sync.Mutex
+	nextSeq    uint64
+	active     *os.File
+	activeSize int64
+	segments   []*segment
+	owners     map[uint64]*segment
+	offsets    map[uint64]int64
+	recovered  []entry
+	dirty      bool
+	closed     bool
+}
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func encodeRecord(buf *bytes.Buffer, kind byte, seq uint64, data []byte) {
+	var hdr [recordHeaderSize]byte
+	hdr[0] = kind
+	binary.BigEndian.PutUint64(hdr[1:9], seq)
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[13:17], crc32.ChecksumIEEE(data))
+
+	buf.Write(hdr[:])
+	buf.Write(data)
+}
+
+// readSegment calls fn for every intact record in the segment file along with
+// its offset. A torn or corrupted record ends the segment since nothing after
+// it can be trusted.
+func readSegment(path string, fn func(kind byte, seq uint64, data []byte, off int64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var hdr [recordHeaderSize]byte
+	var off int64
+	for {
+		if _, err := io.ReadFull(f, hdr[:]); err != nil {
+			return nil
+		}
+
+		kind := hdr[0]
+		seq := binary.BigEndian.Uint64(hdr[1:9])
+		size := binary.BigEndian.Uint32(hdr[9:13])
+		sum := binary.BigEndian.Uint32(hdr[13:17])
+
+		if kind != recordKindEntry && kind != recordKindAck {
+			return nil
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(f, data); err != nil {
+			return nil
+		}
+
+		if crc32.ChecksumIEEE(data) != sum {
+			return nil
+		}
+
+		fn(kind, seq, data, off)
+		off += recordHeaderSize + int64(size)
+	}
+}
+
+func (l *Log) load() error {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]uint64, 0, len(files))
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		var id uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentExt), "%d", &id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	pending := make(map[uint64]entry)
+	for _, id := range ids {
+		s := &segment{id: id, path: segmentPath(l.dir, id)}
+		err := readSegment(s.path, func(kind byte, seq uint64, data []byte, off int64) {
+			if seq >= l.nextSeq {
+				l.nextSeq = seq + 1
+			}
+
+			switch kind {
+			case recordKindEntry:
+				pending[seq] = entry{seq: seq, data: data}
+				l.owners[seq] = s
+				l.offsets[seq] = off
+				s.pending++
+			case recordKindAck:
+				if owner, ok := l.owners[seq]; ok {
+					owner.pending--
+					s.addAck(owner)
+					delete(l.owners, seq)
+					delete(l.offsets, seq)
+					delete(pending, seq)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		l.segments = append(l.segments, s)
+	}
+
+	l.recovered = make([]entry, 0, len(pending))
+	for _, e := range pending {
+		l.recovered = append(l.recovered, e)
+	}
+	sort.Slice(l.recovered, func(i, j int) bool { return l.recovered[i].seq < l.recovered[j].seq })
+
+	return nil
+}
+
+func (l *Log) rotate() error {
+	var id uint64
+	if len(l.segments) > 0 {
+		id = l.segments[len(l.segments)-1].id + 1
+	}
+
+	s := &segment{id: id, path: segmentPath(l.dir, id)}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	if l.active != nil {
+		// Whatever the rotated segment holds must be durable before records
+		// land in the next one.
+		if err := l.active.Sync(); err != nil {
+			f.Close()
+			os.Remove(s.path)
+			return err
+		}
+		l.active.Close()
+		l.dirty = false
+	}
+
+	l.active = f
+	l.activeSize = 0
+	l.segments = append(l.segments, s)
+	return nil
+}
+
+// compact removes all segments but the active one that hold no pending entries.
+// A segment acknowledging entries of a segment still on disk is kept, since
+// dropping the acknowledgements first would resurrect the entries on the next
+// Open. Acknowledgements always live in the same or a newer segment than their
+// entry, so a single pass from the oldest segment suffices. Segments that can't
+// be removed are kept and retried by the next compaction.
+func (l *Log) compact() error {
+	live := make(map[uint64]bool, len(l.segments))
+	for _, s := range l.segments {
+		live[s.id] = true
+	}
+
+	var firstErr error
+	last := len(l.segments) - 1
+	kept := make([]*segment, 0, len(l.segments))
+	for i, s := range l.segments {
+		if i == last || s.pending > 0 || acksLive(s, live) {
+			kept = append(kept, s)
+			continue
+		}
+
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = err
+			}
+			kept = append(kept, s)
+			continue
+		}
+
+		delete(live, s.id)
+	}
+
+	l.segments = kept
+	return firstErr
+}
+
+func acksLive(s *segment, live map[uint64]bool) bool {
+	for id := range s.acks {
+		if live[id] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sync flushes the active segment to stable storage if it has unsynced records.
+func (l *Log) sync() error {
+	if !l.dirty {
+		return nil
+	}
+
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+
+	return nil
+}
+
+// syncLoop syncs the active segment every syncInterval until the log is closed.
+func (l *Log) syncLoop() {
+	defer close(l.stoppedCh)
+
+	ticker := time.NewTicker(l.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			l.mx.Lock()
+			if !l.closed {
+				l.sync()
+			}
+			l.mx.Unlock()
+		case <-l.stopCh:
+			return
+		}
+	}
+}
+
+func (l *Log) write(b []byte) error {
+	n, err := l.active.Write(b)
+	l.activeSize += int64(n)
+	l.dirty = l.dirty || n > 0
+	if err != nil {
+		return err
+	}
+
+	if l.activeSize >= l.segmentSize {
+		return l.rotate()
+	}
+
+	return nil
+}
+
+// Append persists data and returns its sequence number. Sequence numbers start
+// at 1 and keep increasing across reopens of the same directory. With a zero
+// sync interval the entry is synced to stable storage before Append returns.
+func (l *Log) Append(data []byte) (uint64, error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.closed {
+		return 0, errors.New("log is closed")
+	}
+
+	seq := l.nextSeq
+	buf := bytes.NewBuffer(make([]byte, 0, recordHeaderSize+len(data)))
+	encodeRecord(buf, recordKindEntry, seq, data)
+
+	s := l.segments[len(l.segments)-1]
+	off := l.activeSize
+	if err := l.write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+
+	if l.syncInterval == 0 {
+		if err := l.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	l.nextSeq++
+	l.owners[seq] = s
+	l.offsets[seq] = off
+	s.pending++
+	return seq, nil
+}
+
+// Ack marks the entries with given sequence numbers as processed. Unknown or
+// already acknowledged sequence numbers are ignored. Acknowledgements aren't
+// synced right away since losing them only causes a redelivery. An error from
+// removing fully acknowledged segments doesn't undo the acknowledgements.
+func (l *Log) Ack(seqs ...uint64) error {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.closed {
+		return errors.New("log is closed")
+	}
+
+	active := l.segments[len(l.segments)-1]
+	buf := &bytes.Buffer{}
+	acked := make([]*segment, 0, len(seqs))
+	for _, seq := range seqs {
+		s, ok := l.owners[seq]
+		if !ok {
+			continue
+		}
+
+		encodeRecord(buf, recordKindAck, seq, nil)
+		delete(l.owners, seq)
+		delete(l.offsets, seq)
+		acked = append(acked, s)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	if err := l.write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for _, s := range acked {
+		s.pending--
+		active.addAck(s)
+	}
+
+	return l.compact()
+}
+
+// Read returns the data of the pending entry with given sequence number.
+func (l *Log) Read(seq uint64) ([]byte, error) {
+	l.mx.Lock()
+	s, ok := l.owners[seq]
+	off := l.offsets[seq]
+	l.mx.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("entry %d is not pending", seq)
+	}
+
+	// Segments with pending entries are never removed, so reading outside the
+	// lock is safe.
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hdr [recordHeaderSize]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint64(hdr[1:9]) != seq {
+		return nil, fmt.Errorf("entry %d is corrupted", seq)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(hdr[9:13]))
+	if _, err := f.ReadAt(data, off+recordHeaderSize); err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(hdr[13:17]) {
+		return nil, fmt.Errorf("entry %d is corrupted", seq)
+	}
+
+	return data, nil
+}
+
+// Replay calls fn for every entry that was pending when the log was opened, in
+// the order they were appended. Recovered entries are handed out only once.
+func (l *Log) Replay(fn func(seq uint64, data []byte) error) error {
+	l.mx.Lock()
+	recovered := l.recovered
+	l.recovered = nil
+	l.mx.Unlock()
+
+	for _, e := range recovered {
+		if err := fn(e.seq, e.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the number of entries that are not acknowledged yet.
+func (l *Log) Pending() int {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	return len(l.owners)
+}
+
+// Close syncs and releases the underlying segment file. Pending entries are
+// kept on disk and recovered by the next Open of the same directory.
+func (l *Log) Close() error {
+	l.mx.Lock()
+	if l.closed {
+		l.mx.Unlock()
+		return nil
+	}
+	l.closed = true
+	l.mx.Unlock()
+
+	if l.stopCh != nil {
+		close(l.stopCh)
+		<-l.stoppedCh
+	}
+
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	err := l.sync()
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Open opens the log stored in dir, creating the directory if necessary. Pending
+// entries from earlier runs are available through Replay. Appended entries are
+// synced to stable storage every syncInterval, or right away if it's zero. Use
+// this function to instantiate a concrete Log type.
+func Open(dir string, segmentSize int64, syncInterval time.Duration) (*Log, error) {
+	if len(dir) == 0 {
+		return nil, errors.New("dir must not be empty")
+	}
+
+	if syncInterval < 0 {
+		return nil, errors.New("syncInterval can't be negative")
+	}
+
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		dir:          dir,
+		segmentSize:  segmentSize,
+		syncInterval: syncInterval,
+		nextSeq:      1,
+		owners:       make(map[uint64]*segment),
+		offsets:      make(map[uint64]int64),
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	// Always append to a fresh segment so that a torn tail of the previous run
+	// never precedes new records.
+	if err := l.rotate(); err != nil {
+		return nil, err
+	}
+
+	// Leftovers that can't be removed now are retried by the next compaction.
+	l.compact()
+
+	if syncInterval > 0 {
+		l.stopCh = make(chan struct{})
+		l.stoppedCh = make(chan struct{})
+		go l.syncLoop()
+	}
+
+	return l, nil
+}
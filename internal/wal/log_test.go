@@ -0,0 +1,274 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dataart-wal")
+	if err != nil {
+		t.Fatalf("creating temp dir failed with error: %s", err.Error())
+	}
+
+	return dir
+}
+
+func replayAll(l *Log) map[uint64]string {
+	res := make(map[uint64]string)
+	l.Replay(func(seq uint64, data []byte) error {
+		res[seq] = string(data)
+		return nil
+	})
+
+	return res
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	_, err := Open("", 0, 0)
+	if err == nil {
+		t.Error("given dir is invalid")
+		t.Fail()
+	}
+}
+
+func TestLog_WithReopenShouldReplayPendingEntries(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, 0, 0)
+	s1, _ := l.Append([]byte("first"))
+	s2, _ := l.Append([]byte("second"))
+	s3, _ := l.Append([]byte("third"))
+	l.Ack(s2)
+	l.Close()
+
+	l, err := Open(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("reopening log failed with error: %s", err.Error())
+	}
+	defer l.Close()
+
+	got := replayAll(l)
+	if len(got) != 2 || got[s1] != "first" || got[s3] != "third" {
+		t.Errorf("unexpected replayed entries: %v", got)
+		t.Fail()
+	}
+
+	// Sequence numbers must not be reused after a reopen.
+	s4, _ := l.Append([]byte("fourth"))
+	if s4 <= s3 {
+		t.Errorf("sequence number %d should be greater than %d", s4, s3)
+		t.Fail()
+	}
+
+	// Recovered entries are handed out only once.
+	if len(replayAll(l)) != 0 {
+		t.Fail()
+	}
+}
+
+func TestLog_WithAckedSegmentsShouldRemoveFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// A tiny segment size makes every append start a new segment.
+	l, _ := Open(dir, 1, 0)
+	seqs := make([]uint64, 0)
+	for i := 0; i < 5; i++ {
+		seq, _ := l.Append([]byte("payload"))
+		seqs = append(seqs, seq)
+	}
+	l.Ack(seqs...)
+	defer l.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(files) != 1 {
+		t.Errorf("only the active segment should be left, got %d files", len(files))
+		t.Fail()
+	}
+
+	if l.Pending() != 0 {
+		t.Fail()
+	}
+}
+
+func TestLog_WithTornTailShouldKeepIntactEntries(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, 0, 0)
+	seq, _ := l.Append([]byte("intact"))
+	l.Close()
+
+	// Simulate a crash in the middle of writing a record.
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	f, _ := os.OpenFile(files[len(files)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{recordKindEntry, 0, 0, 0})
+	f.Close()
+
+	l, err := Open(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("reopening log failed with error: %s", err.Error())
+	}
+	defer l.Close()
+
+	got := replayAll(l)
+	if len(got) != 1 || got[seq] != "intact" {
+		t.Errorf("unexpected replayed entries: %v", got)
+		t.Fail()
+	}
+}
+
+func TestLog_WithRead(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, 0, 0)
+	s1, _ := l.Append([]byte("first"))
+	s2, _ := l.Append([]byte("second"))
+	l.Close()
+
+	l, _ = Open(dir, 0, 0)
+	defer l.Close()
+	s3, _ := l.Append([]byte("third"))
+
+	for seq, want := range map[uint64]string{s1: "first", s2: "second", s3: "third"} {
+		b, err := l.Read(seq)
+		if err != nil || string(b) != want {
+			t.Errorf("reading entry %d: expected %q, got %q and error %v", seq, want, b, err)
+			t.Fail()
+		}
+	}
+
+	l.Ack(s2)
+	if _, err := l.Read(s2); err == nil {
+		t.Error("acknowledged entries should not be readable")
+		t.Fail()
+	}
+}
+
+func TestLog_WithStuckEntryShouldRemoveLaterSegments(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	l, _ := Open(dir, 1, 0)
+	seqs := make([]uint64, 0)
+	for i := 0; i < 5; i++ {
+		seq, _ := l.Append([]byte("payload"))
+		seqs = append(seqs, seq)
+	}
+	l.Ack(seqs[1:]...)
+
+	// The segment of the first entry and the active one are left.
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(files) != 2 {
+		t.Errorf("expected 2 segments to be left, got %d", len(files))
+		t.Fail()
+	}
+	l.Close()
+
+	l, _ = Open(dir, 1, 0)
+	defer l.Close()
+
+	var replayed []uint64
+	l.Replay(func(seq uint64, data []byte) error {
+		replayed = append(replayed, seq)
+		return nil
+	})
+
+	if len(replayed) != 1 || replayed[0] != seqs[0] {
+		t.Errorf("expected only entry %d to be replayed, got %v", seqs[0], replayed)
+		t.Fail()
+	}
+}
+
+func TestLog_WithAcksOfLiveSegmentShouldKeepThem(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Every entry record takes 24 bytes and an ack 17, so the first segment
+	// holds a and b, the second the ack of a along with c and d.
+	l, _ := Open(dir, 48, 0)
+	a, _ := l.Append([]byte("payload"))
+	b, _ := l.Append([]byte("payload"))
+	l.Ack(a)
+	c, _ := l.Append([]byte("payload"))
+	d, _ := l.Append([]byte("payload"))
+	l.Ack(c, d)
+	l.Close()
+
+	// Removing the second segment would resurrect a.
+	l, _ = Open(dir, 48, 0)
+
+	var replayed []uint64
+	l.Replay(func(seq uint64, data []byte) error {
+		replayed = append(replayed, seq)
+		return nil
+	})
+
+	if len(replayed) != 1 || replayed[0] != b {
+		t.Errorf("expected only entry %d to be replayed, got %v", b, replayed)
+		t.Fail()
+	}
+
+	l.Ack(b)
+	l.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(files) != 1 {
+		t.Errorf("only the active segment should be left, got %d files", len(files))
+		t.Fail()
+	}
+}
+
+func TestLog_WithSyncInterval(t *testing.T) {
+	t.Parallel()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := Open(dir, 0, -time.Second); err == nil {
+		t.Error("negative sync interval is invalid")
+		t.Fail()
+	}
+
+	l, err := Open(dir, 0, time.Millisecond)
+	if err != nil {
+		t.Fatalf("opening log failed with error: %s", err.Error())
+	}
+
+	l.Append([]byte("payload"))
+	time.Sleep(10 * time.Millisecond)
+
+	l.mx.Lock()
+	dirty := l.dirty
+	l.mx.Unlock()
+
+	if dirty {
+		t.Error("expected the appended entry to be synced")
+		t.Fail()
+	}
+
+	if err := l.Close(); err != nil {
+		t.Errorf("closing log failed with error: %s", err.Error())
+		t.Fail()
+	}
+}
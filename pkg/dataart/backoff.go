@@ -0,0 +1,119 @@
+package dataart
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// BackoffPolicy computes how long a worker waits before retrying a failed request.
+// Delays requested by the server through a Retry-After header take precedence.
+type BackoffPolicy interface {
+	// Next returns the delay before the given retry, starting at 1. prev is the
+	// delay used before the previous retry and zero before the first one.
+	Next(retry int, prev time.Duration) time.Duration
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after each retry, starting
+// with Initial and never exceeding Max.
+type ExponentialBackoff struct {
+	// Initial is the delay before the first retry. It must be positive.
+	Initial time.Duration
+
+	// Max caps the delay. Zero means no cap, otherwise it can't be less than
+	// Initial.
+	Max time.Duration
+
+	// Multiplier is the growth factor of the delay. Values below 1 default to 2.
+	Multiplier float64
+
+	// Jitter picks a random delay between zero and the computed one ("full jitter"),
+	// which spreads retries of many clients over time.
+	Jitter bool
+}
+
+// Next returns the delay before the given retry.
+func (b ExponentialBackoff) Next(retry int, prev time.Duration) time.Duration {
+	mul := b.Multiplier
+	if mul < 1 {
+		mul = 2
+	}
+
+	d := float64(b.Initial)
+	for i := 1; i < retry; i++ {
+		d *= mul
+		if b.Max > 0 && d >= float64(b.Max) {
+			break
+		}
+	}
+
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+
+	if b.Jitter && d > 0 {
+		d = rand.Float64() * d
+	}
+
+	return time.Duration(d)
+}
+
+// validate reports the problems of the settings. A non-positive Initial would
+// retry in a tight loop.
+func (b ExponentialBackoff) validate() []error {
+	var errs []error
+	if b.Initial <= 0 {
+		errs = append(errs, errors.New("FlushBackoff Initial must be positive"))
+	}
+
+	if b.Max != 0 && b.Max < b.Initial {
+		errs = append(errs, errors.New("FlushBackoff Max can't be less than Initial"))
+	}
+
+	return errs
+}
+
+// DecorrelatedJitterBackoff picks a random delay between Base and three times the
+// previous delay, never exceeding Max. It grows about as fast as an exponential
+// backoff while keeping retries of different clients apart.
+type DecorrelatedJitterBackoff struct {
+	// Base is the minimum delay. It must be positive.
+	Base time.Duration
+
+	// Max caps the delay. Zero means no cap, otherwise it can't be less than
+	// Base.
+	Max time.Duration
+}
+
+// Next returns the delay before the given retry.
+func (b DecorrelatedJitterBackoff) Next(retry int, prev time.Duration) time.Duration {
+	if prev < b.Base {
+		prev = b.Base
+	}
+
+	d := b.Base
+	if upper := prev * 3; upper > b.Base {
+		d += time.Duration(rand.Int63n(int64(upper - b.Base)))
+	}
+
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	return d
+}
+
+// validate reports the problems of the settings. A non-positive Base would
+// retry in a tight loop, since the delay never grows past it.
+func (b DecorrelatedJitterBackoff) validate() []error {
+	var errs []error
+	if b.Base <= 0 {
+		errs = append(errs, errors.New("FlushBackoff Base must be positive"))
+	}
+
+	if b.Max != 0 && b.Max < b.Base {
+		errs = append(errs, errors.New("FlushBackoff Max can't be less than Base"))
+	}
+
+	return errs
+}
@@ -0,0 +1,137 @@
+package dataart
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := ExponentialBackoff{
+		Initial: 100 * time.Millisecond,
+		Max:     time.Second,
+	}
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+
+	for i, want := range expected {
+		got := b.Next(i+1, 0)
+		if got != want {
+			t.Errorf("retry %d: expected %s, got %s", i+1, want, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestExponentialBackoff_WithJitter(t *testing.T) {
+	t.Parallel()
+
+	b := ExponentialBackoff{
+		Initial: 100 * time.Millisecond,
+		Max:     time.Second,
+		Jitter:  true,
+	}
+
+	for i := 1; i < 100; i++ {
+		got := b.Next(i, 0)
+		if got < 0 || got > time.Second {
+			t.Errorf("retry %d: delay %s is out of bounds", i, got)
+			t.Fail()
+		}
+	}
+}
+
+func TestExponentialBackoff_WithInvalidSettings(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		b    ExponentialBackoff
+		errs int
+	}{
+		{ExponentialBackoff{Initial: time.Second}, 0},
+		{ExponentialBackoff{Initial: time.Second, Max: time.Second}, 0},
+		{ExponentialBackoff{}, 1},
+		{ExponentialBackoff{Initial: -time.Second}, 1},
+		{ExponentialBackoff{Initial: time.Second, Max: time.Millisecond}, 1},
+		{ExponentialBackoff{Max: -time.Second}, 2},
+	}
+
+	for _, tt := range tests {
+		if errs := tt.b.validate(); len(errs) != tt.errs {
+			t.Errorf("%+v: expected %d problems, got %v", tt.b, tt.errs, errs)
+			t.Fail()
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.APIKey = "api-key"
+	cfg.FlushBackoff = &ExponentialBackoff{Max: time.Second}
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("expected a zero Initial to be rejected")
+		t.Fail()
+	}
+}
+
+func TestDecorrelatedJitterBackoff_WithInvalidSettings(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		b    DecorrelatedJitterBackoff
+		errs int
+	}{
+		{DecorrelatedJitterBackoff{Base: time.Second}, 0},
+		{DecorrelatedJitterBackoff{Base: time.Second, Max: time.Second}, 0},
+		{DecorrelatedJitterBackoff{}, 1},
+		{DecorrelatedJitterBackoff{Base: -time.Second}, 1},
+		{DecorrelatedJitterBackoff{Base: time.Second, Max: time.Millisecond}, 1},
+		{DecorrelatedJitterBackoff{Max: -time.Second}, 2},
+	}
+
+	for _, tt := range tests {
+		if errs := tt.b.validate(); len(errs) != tt.errs {
+			t.Errorf("%+v: expected %d problems, got %v", tt.b, tt.errs, errs)
+			t.Fail()
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.APIKey = "api-key"
+	cfg.FlushBackoff = DecorrelatedJitterBackoff{Max: time.Second}
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("expected a zero Base to be rejected")
+		t.Fail()
+	}
+
+	cfg.FlushBackoff = &DecorrelatedJitterBackoff{Base: time.Second, Max: time.Millisecond}
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("expected a Max below Base to be rejected")
+		t.Fail()
+	}
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := DecorrelatedJitterBackoff{
+		Base: 100 * time.Millisecond,
+		Max:  2 * time.Second,
+	}
+
+	var prev time.Duration
+	for i := 1; i < 100; i++ {
+		got := b.Next(i, prev)
+		if got < b.Base || got > b.Max {
+			t.Errorf("retry %d: delay %s is out of bounds", i, got)
+			t.Fail()
+		}
+		prev = got
+	}
+}
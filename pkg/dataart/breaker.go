@@ -0,0 +1,29 @@
+package dataart
+
+import (
+	"time"
+
+	"github.com/dataart-ai/dataart-go/internal/breaker"
+)
+
+// defaultCircuitBreakerCoolDown is used when ClientConfig.CircuitBreakerCoolDown
+// is zero.
+const defaultCircuitBreakerCoolDown = 30 * time.Second
+
+// CircuitState is the state of the circuit breaker guarding the ingest endpoint.
+type CircuitState = breaker.State
+
+const (
+	// CircuitClosed lets all requests through. This is the initial state.
+	CircuitClosed = breaker.Closed
+
+	// CircuitOpen rejects all requests until CircuitBreakerCoolDown has passed.
+	CircuitOpen = breaker.Open
+
+	// CircuitHalfOpen lets a single probe request through at a time.
+	CircuitHalfOpen = breaker.HalfOpen
+)
+
+// CircuitOpenError is the error of requests rejected while the circuit breaker
+// is open. RetryIn tells how long until the next probe.
+type CircuitOpenError = breaker.OpenError
@@ -1,38 +1,137 @@
 package dataart
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 
+	"github.com/dataart-ai/dataart-go/internal/breaker"
+	"github.com/dataart-ai/dataart-go/internal/failover"
 	"github.com/dataart-ai/dataart-go/internal/http"
+	"github.com/dataart-ai/dataart-go/internal/pkg/randomutil"
+	"github.com/dataart-ai/dataart-go/internal/ratelimit"
 	"github.com/dataart-ai/dataart-go/internal/task"
+	"github.com/dataart-ai/dataart-go/internal/wal"
 )
 
 const (
-	sourcingURL = "https://src.datartproject.com"
+	// DefaultEndpoint is the DataArt ingest endpoint used when
+	// ClientConfig.Endpoint is empty.
+	DefaultEndpoint = "https://src.datartproject.com"
 )
 
 type httpUploader interface {
-	UploadAction(cnt http.ActionContainer) error
-	UploadIdentity(cnt http.IdentityContainer) error
-	Shutdown()
+	UploadActionContext(ctx context.Context, cnt http.ActionContainer) error
+	UploadActionAsync(ctx context.Context, cnt http.ActionContainer) (*http.Delivery, error)
+	UploadIdentityContext(ctx context.Context, cnt http.IdentityContainer) error
+	Resubmit(payloadType string, b []byte) error
+	Flush(ctx context.Context) error
+	ShutdownContext(ctx context.Context) (http.Unsent, error)
+	Dropped() (actions int64, identities int64)
+	Stats() http.Stats
+}
+
+// CloseError is returned by CloseContext if its deadline expired before all pending
+// actions and identities were sent. With a QueueDir the unsent objects stay in the
+// on-disk queue, and with a DeadLetterSink they are handed over to it.
+type CloseError struct {
+	// Err is the error of the context passed to CloseContext.
+	Err error
+
+	// UnsentActions is the number of actions that were given up on.
+	UnsentActions int
+
+	// UnsentIdentities is the number of identities that were given up on.
+	UnsentIdentities int
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("closing client: %s. %d actions and %d identities left unsent",
+		e.Err.Error(), e.UnsentActions, e.UnsentIdentities)
+}
+
+// Delivery tracks an action emitted with EmitActionAsync. It's resolved once the
+// batch carrying the action is delivered, or with the error of the last attempt
+// once the batch is given up on or handed to the DeadLetterSink.
+type Delivery = http.Delivery
+
+// NewResolvedDelivery returns a Delivery that's already resolved with err. It's
+// meant for decorators and test doubles of Tracker.
+func NewResolvedDelivery(err error) *Delivery {
+	return http.NewResolvedDelivery(err)
+}
+
+// JoinDeliveries returns a Delivery that's resolved once all of ds are, with the
+// first error among them in order. Nil deliveries are skipped.
+func JoinDeliveries(ds ...*Delivery) *Delivery {
+	return http.JoinDeliveries(ds...)
+}
+
+// NewEventID returns a new event ID like the ones assigned to actions emitted
+// without one. IDs are ULIDs, so they sort by the time they were created.
+func NewEventID() string {
+	return randomutil.ULID(time.Now())
 }
 
 // Client encapsulates a DataArt client.
 type Client struct {
 	Config ClientConfig
 	hu     httpUploader
+	cb     *breaker.Breaker
 }
 
 // EmitAction creates an action object with given properties and uploads it to server.
 func (c *Client) EmitAction(key string, userKey string, isAnonymousUser bool,
 	timestamp time.Time, metadata map[string]interface{}) error {
 
+	return c.EmitActionContext(context.Background(), key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+// EmitActionContext works like EmitAction but gives up once ctx is done. It returns
+// ctx.Err() if the buffer couldn't accept the action in time.
+func (c *Client) EmitActionContext(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	return c.EmitActionWithID(ctx, "", key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+// EmitActionWithID works like EmitActionContext but uses given id as the event ID
+// instead of generating one. The server deduplicates actions by their ID, so use
+// this to make your own retries of the same event idempotent. An empty id behaves
+// like EmitActionContext.
+func (c *Client) EmitActionWithID(ctx context.Context, id string, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
 	if len(key) == 0 {
 		return errors.New("event key identifier must not empty")
 	}
 
-	return c.hu.UploadAction(
+	return c.hu.UploadActionContext(
+		ctx,
+		http.ActionContainer{
+			ID:              id,
+			Key:             key,
+			UserKey:         userKey,
+			IsAnonymousUser: isAnonymousUser,
+			Timestamp:       timestamp,
+			Metadata:        metadata,
+		},
+	)
+}
+
+// EmitActionAsync works like EmitActionContext and additionally returns a Delivery
+// to wait for the action to be acknowledged by the server. Use it for critical
+// events without making every emit synchronous.
+func (c *Client) EmitActionAsync(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) (*Delivery, error) {
+
+	if len(key) == 0 {
+		return nil, errors.New("event key identifier must not empty")
+	}
+
+	return c.hu.UploadActionAsync(
+		ctx,
 		http.ActionContainer{
 			Key:             key,
 			UserKey:         userKey,
@@ -45,11 +144,18 @@ func (c *Client) EmitAction(key string, userKey string, isAnonymousUser bool,
 
 // Identify creates an identity object with given properties and uploads it to server.
 func (c *Client) Identify(userKey string, metadata map[string]interface{}) error {
+	return c.IdentifyContext(context.Background(), userKey, metadata)
+}
+
+// IdentifyContext works like Identify but gives up once ctx is done. It returns
+// ctx.Err() if the buffer couldn't accept the identity in time.
+func (c *Client) IdentifyContext(ctx context.Context, userKey string, metadata map[string]interface{}) error {
 	if len(userKey) == 0 {
 		return errors.New("userKey must not empty")
 	}
 
-	return c.hu.UploadIdentity(
+	return c.hu.UploadIdentityContext(
+		ctx,
 		http.IdentityContainer{
 			UserKey:  userKey,
 			Metadata: metadata,
@@ -57,40 +163,246 @@ func (c *Client) Identify(userKey string, metadata map[string]interface{}) error
 	)
 }
 
+// ReplayDeadLetters takes all dead letters from the configured DeadLetterSink and
+// queues them to be sent again. It returns the number of resubmitted dead letters.
+// Dead letters that fail again end up in the sink once more.
+func (c *Client) ReplayDeadLetters() (int, error) {
+	sink := c.Config.DeadLetterSink
+	if sink == nil {
+		return 0, errors.New("no DeadLetterSink is configured")
+	}
+
+	letters, err := sink.Take()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, dl := range letters {
+		err := c.hu.Resubmit(dl.Type, dl.Payload)
+		if err != nil {
+			// Hand the rest back to the sink so nothing is lost.
+			for _, rest := range letters[i:] {
+				sink.Put(rest)
+			}
+
+			return i, err
+		}
+	}
+
+	return len(letters), nil
+}
+
+// Flush sends the pending actions batch right away and waits until every action
+// and identity emitted so far has either been delivered or failed on its last
+// retry. It returns a *FlushError listing the errors of failed requests, or
+// ctx.Err() if ctx is done first. The client stays usable afterwards.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.hu.Flush(ctx)
+}
+
+// Dropped returns the number of actions and identities dropped so far because the
+// buffer was full. It's always zero with OverflowBlock and OverflowSpillToDisk.
+func (c *Client) Dropped() DropCounts {
+	actions, identities := c.hu.Dropped()
+	return DropCounts{
+		Actions:    actions,
+		Identities: identities,
+	}
+}
+
+// Stats returns a snapshot of the client's counters and gauges. Taking a snapshot
+// is cheap and never blocks emitting.
+func (c *Client) Stats() Stats {
+	return c.hu.Stats()
+}
+
+// CircuitState returns the current state of the circuit breaker. It's always
+// CircuitClosed if CircuitBreakerThreshold is zero.
+func (c *Client) CircuitState() CircuitState {
+	if c.cb == nil {
+		return CircuitClosed
+	}
+
+	return c.cb.State()
+}
+
 // Close gracefully terminates the underlying dependencies.
 func (c *Client) Close() {
-	c.hu.Shutdown()
+	c.CloseContext(context.Background())
+}
+
+// CloseContext works like Close but stops waiting for pending requests once ctx is
+// done. In-flight requests are then aborted, retries are given up on and a
+// *CloseError reports how many actions and identities were left unsent.
+func (c *Client) CloseContext(ctx context.Context) error {
+	unsent, err := c.hu.ShutdownContext(ctx)
+	if err != nil {
+		return &CloseError{
+			Err:              err,
+			UnsentActions:    unsent.Actions,
+			UnsentIdentities: unsent.Identities,
+		}
+	}
+
+	return nil
 }
 
 // NewClient creates a new Client instance with given configuration values. Use this
-// function to instantiate a concrete Client type.
+// function to instantiate a concrete Client type. All problems of cfg are reported
+// at once as a MultiError. See New for a constructor with defaults.
 func NewClient(cfg ClientConfig) (*Client, error) {
 	err := validateConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(cfg.baseURL) == 0 {
-		cfg.baseURL = sourcingURL
+	if len(cfg.Endpoint) == 0 {
+		cfg.Endpoint = DefaultEndpoint
+	}
+
+	tmOpts := task.ManagerOptions{
+		MaxElapsed:    cfg.FlushMaxRetryElapsed,
+		MaxRetryAfter: cfg.FlushMaxRetryAfter,
+	}
+	if cfg.FlushBackoff != nil {
+		tmOpts.Backoff = cfg.FlushBackoff
 	}
 
 	tm, err := task.NewManager(cfg.FlushNumWorkers, cfg.FlushBufferSize,
-		cfg.FlushNumRetries, cfg.FlushBackoffRatio, nil, nil)
+		cfg.FlushNumRetries, cfg.FlushBackoffRatio, nil, nil, tmOpts)
 
 	if err != nil {
 		return nil, err
 	}
 
-	uploader, err := http.NewUploader(cfg.baseURL, cfg.APIKey,
-		cfg.FlushActionsBatchSize, cfg.FlushInterval, cfg.HTTPClient, tm)
+	opts := http.UploaderOptions{
+		Endpoints: http.Endpoints{
+			APIVersion:     cfg.APIVersion,
+			ActionsPath:    cfg.ActionsPath,
+			IdentitiesPath: cfg.IdentitiesPath,
+		},
+		Overflow:            cfg.FlushOverflowPolicy,
+		BufferSize:          cfg.FlushBufferSize,
+		Retryable:           cfg.FlushRetryClassifier,
+		Compression:         cfg.Compression,
+		CompressionLevel:    cfg.CompressionLevel,
+		CompressionMinSize:  cfg.CompressionMinSize,
+		MaxPayloadSize:      cfg.FlushMaxPayloadSize,
+		IdentitiesBatchSize: cfg.FlushIdentitiesBatchSize,
+		Tracer:              cfg.Tracer,
+		Logger:              cfg.Logger,
+		OnBatchSent:         cfg.OnBatchSent,
+		OnIdentitySent:      cfg.OnIdentitySent,
+		OnBatchRetry:        cfg.OnBatchRetry,
+		OnBatchFailed:       cfg.OnBatchFailed,
+	}
+	if opts.Logger == nil {
+		opts.Logger = NopLogger{}
+	}
+	if cfg.RateLimitRequests > 0 || cfg.RateLimitEvents > 0 {
+		limiter, err := ratelimit.NewLimiter(cfg.RateLimitRequests, cfg.RateLimitRequestBurst,
+			cfg.RateLimitEvents, cfg.RateLimitEventBurst)
+		if err != nil {
+			return nil, err
+		}
+		opts.RateLimiter = limiter
+	}
+
+	var cb *breaker.Breaker
+	if cfg.CircuitBreakerThreshold > 0 {
+		successThreshold := cfg.CircuitBreakerSuccessThreshold
+		if successThreshold == 0 {
+			successThreshold = 1
+		}
+
+		coolDown := cfg.CircuitBreakerCoolDown
+		if coolDown == 0 {
+			coolDown = defaultCircuitBreakerCoolDown
+		}
+
+		logger, onChange := opts.Logger, cfg.OnCircuitStateChange
+		cb, err = breaker.NewBreaker(cfg.CircuitBreakerThreshold, successThreshold,
+			coolDown, func(from, to CircuitState) {
+				logger.Warn("circuit breaker state changed", "from", from, "to", to)
+				if onChange != nil {
+					onChange(from, to)
+				}
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		opts.Breaker = cb
+		opts.BreakerFailFast = cfg.CircuitBreakerFailFast
+	}
+
+	if len(cfg.FailoverEndpoints) > 0 {
+		threshold := cfg.FailoverThreshold
+		if threshold == 0 {
+			threshold = defaultFailoverThreshold
+		}
+
+		coolDown := cfg.FailoverCoolDown
+		if coolDown == 0 {
+			coolDown = defaultFailoverCoolDown
+		}
+
+		endpoints := append([]string{cfg.Endpoint}, cfg.FailoverEndpoints...)
+		logger, onChange := opts.Logger, cfg.OnEndpointHealthChange
+		pool, err := failover.NewPool(len(endpoints), cfg.FailoverStrategy, threshold,
+			coolDown, func(i int, healthy bool) {
+				if healthy {
+					logger.Info("endpoint recovered", "endpoint", endpoints[i])
+				} else {
+					logger.Warn("endpoint marked unhealthy", "endpoint", endpoints[i])
+				}
+				if onChange != nil {
+					onChange(endpoints[i], healthy)
+				}
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		opts.FallbackURLs = cfg.FailoverEndpoints
+		opts.Selector = pool
+	}
+
+	if len(cfg.QueueDir) > 0 {
+		l, err := wal.Open(cfg.QueueDir, cfg.QueueSegmentSize, cfg.QueueSyncInterval)
+		if err != nil {
+			return nil, err
+		}
+		opts.Journal = l
+	}
+
+	if cfg.DeadLetterSink != nil {
+		sink := cfg.DeadLetterSink
+		opts.DeadLetterHook = func(payloadType string, b []byte, attempts int, err error) error {
+			return sink.Put(DeadLetter{
+				Type:     payloadType,
+				Payload:  b,
+				Err:      err,
+				Attempts: attempts,
+				FailedAt: time.Now(),
+			})
+		}
+	}
+
+	uploader, err := http.NewUploader(cfg.Endpoint, cfg.APIKey,
+		cfg.FlushActionsBatchSize, cfg.FlushInterval, cfg.HTTPClient, tm, opts)
 
 	if err != nil {
+		if opts.Journal != nil {
+			opts.Journal.Close()
+		}
 		return nil, err
 	}
 
 	c := &Client{
 		Config: cfg,
 		hu:     uploader,
+		cb:     cb,
 	}
 
 	return c, nil
@@ -139,6 +139,58 @@ func TestNewClient(t *testing.T) {
 		t.Error("given HTTPClient is invalid")
 		t.Fail()
 	}
+
+	cfg = ClientConfig{
+		APIKey:                "api-key",
+		FlushBufferSize:       1,
+		FlushNumWorkers:       1,
+		FlushNumRetries:       1,
+		FlushBackoffRatio:     1,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+		QueueSegmentSize:      -1,
+	}
+	_, err = NewClient(cfg)
+	if err == nil {
+		t.Error("given QueueSegmentSize is invalid")
+		t.Fail()
+	}
+
+	cfg = ClientConfig{
+		APIKey:                "api-key",
+		FlushBufferSize:       1,
+		FlushNumWorkers:       1,
+		FlushNumRetries:       1,
+		FlushBackoffRatio:     1,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+		FlushOverflowPolicy:   OverflowSpillToDisk,
+	}
+	_, err = NewClient(cfg)
+	if err == nil {
+		t.Error("given FlushOverflowPolicy requires QueueDir")
+		t.Fail()
+	}
+
+	cfg = ClientConfig{
+		APIKey:                  "api-key",
+		FlushBufferSize:         1,
+		FlushNumWorkers:         1,
+		FlushNumRetries:         1,
+		FlushBackoffRatio:       1,
+		FlushActionsBatchSize:   1,
+		FlushInterval:           time.Duration(5 * time.Second),
+		HTTPClient:              gohttp.DefaultClient,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCoolDown:  -time.Second,
+	}
+	_, err = NewClient(cfg)
+	if err == nil {
+		t.Error("given CircuitBreakerCoolDown is invalid")
+		t.Fail()
+	}
 }
 
 func TestClient_WithEmitActionAndInvalidData(t *testing.T) {
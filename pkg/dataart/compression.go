@@ -0,0 +1,19 @@
+package dataart
+
+import (
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+// Compression is the encoding applied to request bodies.
+type Compression = http.Compression
+
+const (
+	// CompressionNone sends request bodies as plain JSON. This is the default.
+	CompressionNone = http.CompressionNone
+
+	// CompressionGzip sends request bodies gzip compressed.
+	CompressionGzip = http.CompressionGzip
+
+	// CompressionDeflate sends request bodies deflate compressed.
+	CompressionDeflate = http.CompressionDeflate
+)
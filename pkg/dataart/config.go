@@ -3,22 +3,28 @@ package dataart
 import (
 	"errors"
 	"net/http"
+	"net/url"
 	"time"
 )
 
 // ClientConfig is the container for all required settings for DataArt Go client.
 type ClientConfig struct {
-	// baseURL is the server endpoint root address.
-	baseURL string
-
 	// APIKey is the authorization key for sending requests. You can find this value
 	// in your dashboard. Contact support if you need help.
 	APIKey string
 
 	// FlushBufferSize is the number of pending requests held in memory. If you hit this
-	// many requests, future ones will be blocking. Modify this accordingly with your workload.
+	// many requests, future ones will be blocking unless FlushOverflowPolicy says otherwise.
+	// Modify this accordingly with your workload.
 	FlushBufferSize int
 
+	// FlushOverflowPolicy decides what EmitAction and Identify do once the buffer is full.
+	// The default OverflowBlock waits for room. OverflowDropNewest and OverflowDropOldest
+	// never block and drop objects instead, and OverflowSpillToDisk keeps new objects in
+	// the on-disk queue until there's room, which requires QueueDir. Non-blocking policies
+	// additionally hold up to FlushBufferSize objects before they kick in.
+	FlushOverflowPolicy OverflowPolicy
+
 	// FlushNumWorkers is the total number of workers sending async requests. Each worker
 	// will create a goroutine with a small footprint but beware of large values.
 	// Modify this accordingly with your workload.
@@ -29,54 +35,339 @@ type ClientConfig struct {
 
 	// FlushBackoffRatio is the constant time added for each execution retry. For instance
 	// a FlushNumRetries of 3 and FlushBackoffRatio of 5 will cause in 5, 10, 15 seconds
-	// of delay before giving up.
+	// of delay before giving up. It's ignored if FlushBackoff is set.
 	FlushBackoffRatio int
 
+	// FlushBackoff computes the delay between retries, e.g. ExponentialBackoff or
+	// DecorrelatedJitterBackoff. Leave nil to use the linear FlushBackoffRatio.
+	FlushBackoff BackoffPolicy
+
+	// FlushMaxRetryElapsed bounds the total time spent on a request including the
+	// delays between its retries. A request is given up on once its next retry would
+	// start later than that. Zero means no limit.
+	FlushMaxRetryElapsed time.Duration
+
+	// FlushMaxRetryAfter caps the delay a server can request through a Retry-After
+	// header before a retry. Defaults to 5 minutes when zero.
+	FlushMaxRetryAfter time.Duration
+
+	// FlushRetryClassifier reports whether a failed request should be retried. Requests
+	// it returns false for are given up on immediately. Leave nil to use
+	// DefaultRetryClassifier.
+	FlushRetryClassifier func(err error) bool
+
 	// FlushActionsBatchSize is the number of action events in batch request. If you emit
 	// this much actions, a request will be created and sent.
 	FlushActionsBatchSize int
 
+	// FlushIdentitiesBatchSize is the number of identities in a batch request, sent once
+	// it's full or FlushInterval has passed. Identities for the same user key replace each
+	// other within a batch, so only the last one is sent. Zero or 1 sends every identity in
+	// a request of its own.
+	FlushIdentitiesBatchSize int
+
+	// FlushMaxPayloadSize is the maximum size in bytes of a request body before
+	// compression. Batches are sent early if the next action would push them over the
+	// limit, and EmitAction and Identify reject objects that can't fit on their own with a
+	// *PayloadTooLargeError. Batches the server still rejects with status 413 are split in
+	// half and sent again. Zero means no limit.
+	FlushMaxPayloadSize int
+
 	// FlushInterval is the timer duration for flushing actions. If this much time is passed
 	// and there's some actions left, they will be sent to server.
 	FlushInterval time.Duration
 
+	// Endpoint is the root address requests are sent to, e.g. a regional ingest proxy
+	// or a staging environment. Defaults to DefaultEndpoint when empty.
+	Endpoint string
+
+	// APIVersion is a path segment such as "v2" put between Endpoint and every
+	// endpoint path. Empty means no prefix, which is the current API.
+	APIVersion string
+
+	// ActionsPath overrides the path action batches are sent to. Defaults to
+	// /events/send-actions when empty.
+	ActionsPath string
+
+	// IdentitiesPath overrides the path identities are sent to. Defaults to
+	// /users/identify when empty.
+	IdentitiesPath string
+
+	// FailoverEndpoints are root addresses requests fail over to while Endpoint is
+	// unhealthy, in order of preference. Every request attempt goes to an endpoint
+	// picked by FailoverStrategy, so retries of a batch can land elsewhere. APIVersion
+	// and the endpoint paths apply to all of them. Leave empty to use Endpoint only.
+	FailoverEndpoints []string
+
+	// FailoverStrategy picks the endpoint of every request among the healthy ones.
+	// Defaults to FailoverPriority, which fails back to Endpoint once it recovers.
+	FailoverStrategy FailoverStrategy
+
+	// FailoverThreshold is the number of consecutive failed requests after which an
+	// endpoint is marked unhealthy. Only network errors and responses with status 408,
+	// 429 or 5xx count as failures. Other responses, such as a 400 for a malformed batch,
+	// show the endpoint is up and count as successes. Defaults to 2 when zero.
+	FailoverThreshold int
+
+	// FailoverCoolDown is the time an unhealthy endpoint waits before a single probe
+	// request is sent to it. A successful probe marks it healthy again. Defaults to
+	// 30 seconds when zero.
+	FailoverCoolDown time.Duration
+
+	// OnEndpointHealthChange is called whenever an endpoint is marked unhealthy or
+	// healthy again. It must not block.
+	OnEndpointHealthChange func(endpoint string, healthy bool)
+
 	// HTTPClient is used for executing HTTP requests. You can provide http.DefaultClient if
 	// is suffices your needs.
 	HTTPClient *http.Client
+
+	// Compression is the encoding applied to request bodies, e.g. CompressionGzip. Large
+	// batches with rich metadata usually shrink by an order of magnitude. Defaults to
+	// CompressionNone.
+	Compression Compression
+
+	// CompressionLevel trades speed for size, from 1 (best speed) to 9 (best compression).
+	// Zero means the default level.
+	CompressionLevel int
+
+	// CompressionMinSize is the request body size in bytes below which bodies are sent
+	// uncompressed, since compressing tiny bodies costs more than it saves.
+	CompressionMinSize int
+
+	// QueueDir is the directory of the on-disk write-ahead queue. If set, every action and
+	// identity is written to this queue before EmitAction or Identify returns and removed
+	// once the server accepts it. Anything left over by a crash is sent by the next client
+	// created with the same QueueDir. Leave empty to keep pending objects in memory only.
+	QueueDir string
+
+	// QueueSegmentSize is the size in bytes after which the on-disk queue starts a new
+	// segment file. Defaults to 16 MiB when zero. Only used together with QueueDir.
+	QueueSegmentSize int64
+
+	// QueueSyncInterval is how often writes to the on-disk queue are synced to stable
+	// storage. Zero syncs every object before EmitAction or Identify returns, which is
+	// the safest and slowest choice. Objects written since the last sync may be lost on
+	// power loss. Only used together with QueueDir.
+	QueueSyncInterval time.Duration
+
+	// RateLimitRequests is the maximum number of requests sent per second, retries
+	// included. Requests over the limit are delayed, never dropped. While they wait the
+	// buffer fills up and FlushOverflowPolicy decides what happens to new objects. Zero
+	// means no limit.
+	RateLimitRequests float64
+
+	// RateLimitRequestBurst is the number of requests that may be sent at once before
+	// RateLimitRequests kicks in. Defaults to one second's worth when zero.
+	RateLimitRequestBurst int
+
+	// RateLimitEvents is the maximum number of actions and identities sent per second.
+	// Like RateLimitRequests it delays requests and zero means no limit.
+	RateLimitEvents float64
+
+	// RateLimitEventBurst is the number of events that may be sent at once before
+	// RateLimitEvents kicks in. Defaults to one second's worth when zero.
+	RateLimitEventBurst int
+
+	// CircuitBreakerThreshold is the number of consecutive failed requests after which
+	// the circuit breaker opens and stops sending requests for CircuitBreakerCoolDown.
+	// Only network errors and responses with status 408, 429 or 5xx count as failures.
+	// With FailoverEndpoints failures only count while no endpoint is healthy, so the
+	// breaker opens only once failover has nothing left to try. Zero disables the
+	// circuit breaker.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerSuccessThreshold is the number of successful probe requests needed
+	// to close an open circuit breaker again. Defaults to 1 when zero.
+	CircuitBreakerSuccessThreshold int
+
+	// CircuitBreakerCoolDown is the time an open circuit breaker waits before letting a
+	// single probe request through. Defaults to 30 seconds when zero.
+	CircuitBreakerCoolDown time.Duration
+
+	// CircuitBreakerFailFast makes requests rejected by an open circuit breaker fail
+	// right away, which hands them to DeadLetterSink. By default they are parked and
+	// retried once the cool-down has passed. Parked requests don't count against
+	// FlushNumRetries, only FlushMaxRetryElapsed bounds how long they wait. Once the
+	// client is closing, rejected requests fail right away either way.
+	CircuitBreakerFailFast bool
+
+	// OnCircuitStateChange is called on every state transition of the circuit breaker.
+	// It must not block.
+	OnCircuitStateChange func(from, to CircuitState)
+
+	// DeadLetterSink receives requests that failed on all of their FlushNumRetries or were
+	// rejected by the server. If nil, or if it fails, such requests are dropped, also from
+	// the on-disk queue. Only requests left unsent by CloseContext stay in QueueDir for the
+	// next client. Use Client.ReplayDeadLetters to send the stored dead letters again.
+	DeadLetterSink DeadLetterSink
+
+	// OnBatchSent is called after a batch of actions was delivered and OnIdentitySent
+	// after identities were. Hooks are called from task workers and receive the batch
+	// contents, attempt number, worker ID, latency and error. They must not block.
+	OnBatchSent    func(info BatchInfo)
+	OnIdentitySent func(info BatchInfo)
+
+	// OnBatchRetry is called before a batch is retried, with the error of the previous
+	// attempt.
+	OnBatchRetry func(info BatchInfo)
+
+	// OnBatchFailed is called once a batch is given up on, before it's handed to
+	// DeadLetterSink.
+	OnBatchFailed func(info BatchInfo)
+
+	// Logger receives lifecycle events, failed requests, drops and permanent failures,
+	// identified by batch IDs. Use NewStdLogger or NewSlogLogger to adapt an existing
+	// logger. Defaults to NopLogger.
+	Logger Logger
+
+	// Tracer, if set, traces every EmitActionContext call as a child of its context
+	// and every request attempt, linked to the emits of the actions it carries.
+	Tracer Tracer
+}
+
+func isAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0
 }
 
+// validateConfig reports all problems of cfg at once as a MultiError.
 func validateConfig(cfg ClientConfig) error {
+	var errs MultiError
+
 	if len(cfg.APIKey) == 0 {
-		return errors.New("APIKey must not be empty")
+		errs = append(errs, errors.New("APIKey must not be empty"))
 	}
 
 	if cfg.FlushBufferSize < 1 {
-		return errors.New("FlushBufferSize can't be less than 1")
+		errs = append(errs, errors.New("FlushBufferSize can't be less than 1"))
+	}
+
+	if cfg.FlushOverflowPolicy < OverflowBlock || cfg.FlushOverflowPolicy > OverflowSpillToDisk {
+		errs = append(errs, errors.New("FlushOverflowPolicy is not valid"))
+	}
+
+	if cfg.FlushOverflowPolicy == OverflowSpillToDisk && len(cfg.QueueDir) == 0 {
+		errs = append(errs, errors.New("FlushOverflowPolicy OverflowSpillToDisk requires QueueDir"))
 	}
 
 	if cfg.FlushNumWorkers < 1 {
-		return errors.New("FlushNumWorkers can't be less than 1")
+		errs = append(errs, errors.New("FlushNumWorkers can't be less than 1"))
 	}
 
 	if cfg.FlushNumRetries < 0 {
-		return errors.New("FlushNumRetries must be at least 0")
+		errs = append(errs, errors.New("FlushNumRetries must be at least 0"))
 	}
 
-	if cfg.FlushBackoffRatio < 1 {
-		return errors.New("FlushBackoffRatio can't be less than 1")
+	if cfg.FlushBackoffRatio < 1 && cfg.FlushBackoff == nil {
+		errs = append(errs, errors.New("FlushBackoffRatio can't be less than 1"))
+	}
+
+	switch b := cfg.FlushBackoff.(type) {
+	case ExponentialBackoff:
+		errs = append(errs, b.validate()...)
+	case *ExponentialBackoff:
+		if b != nil {
+			errs = append(errs, b.validate()...)
+		}
+	case DecorrelatedJitterBackoff:
+		errs = append(errs, b.validate()...)
+	case *DecorrelatedJitterBackoff:
+		if b != nil {
+			errs = append(errs, b.validate()...)
+		}
+	}
+
+	if cfg.FlushMaxRetryElapsed < 0 {
+		errs = append(errs, errors.New("FlushMaxRetryElapsed can't be negative"))
+	}
+
+	if cfg.FlushMaxRetryAfter < 0 {
+		errs = append(errs, errors.New("FlushMaxRetryAfter can't be negative"))
 	}
 
 	if cfg.FlushActionsBatchSize < 1 {
-		return errors.New("FlushActionsBatchSize can't be less than 1")
+		errs = append(errs, errors.New("FlushActionsBatchSize can't be less than 1"))
+	}
+
+	if cfg.FlushIdentitiesBatchSize < 0 {
+		errs = append(errs, errors.New("FlushIdentitiesBatchSize can't be negative"))
+	}
+
+	if cfg.FlushMaxPayloadSize < 0 {
+		errs = append(errs, errors.New("FlushMaxPayloadSize can't be negative"))
 	}
 
 	if cfg.FlushInterval < time.Duration(time.Second*5) {
-		return errors.New("FlushInterval must be greater than 5 seconds")
+		errs = append(errs, errors.New("FlushInterval must be greater than 5 seconds"))
+	}
+
+	if len(cfg.Endpoint) > 0 && !isAbsoluteURL(cfg.Endpoint) {
+		errs = append(errs, errors.New("Endpoint must be an absolute http or https URL"))
+	}
+
+	for _, e := range cfg.FailoverEndpoints {
+		if !isAbsoluteURL(e) {
+			errs = append(errs, errors.New("FailoverEndpoints must be absolute http or https URLs"))
+			break
+		}
+	}
+
+	if cfg.FailoverStrategy < FailoverPriority || cfg.FailoverStrategy > FailoverLatencyWeighted {
+		errs = append(errs, errors.New("FailoverStrategy is not valid"))
+	}
+
+	if cfg.FailoverThreshold < 0 {
+		errs = append(errs, errors.New("FailoverThreshold can't be negative"))
+	}
+
+	if cfg.FailoverCoolDown < 0 {
+		errs = append(errs, errors.New("FailoverCoolDown can't be negative"))
 	}
 
 	if cfg.HTTPClient == nil {
-		return errors.New("HTTPClient can't be nil")
+		errs = append(errs, errors.New("HTTPClient can't be nil"))
+	}
+
+	if cfg.Compression < CompressionNone || cfg.Compression > CompressionDeflate {
+		errs = append(errs, errors.New("Compression is not valid"))
+	}
+
+	if cfg.CompressionLevel < 0 || cfg.CompressionLevel > 9 {
+		errs = append(errs, errors.New("CompressionLevel must be between 1 and 9"))
+	}
+
+	if cfg.CompressionMinSize < 0 {
+		errs = append(errs, errors.New("CompressionMinSize can't be negative"))
+	}
+
+	if cfg.QueueSegmentSize < 0 {
+		errs = append(errs, errors.New("QueueSegmentSize can't be negative"))
+	}
+
+	if cfg.QueueSyncInterval < 0 {
+		errs = append(errs, errors.New("QueueSyncInterval can't be negative"))
+	}
+
+	if cfg.RateLimitRequests < 0 || cfg.RateLimitEvents < 0 {
+		errs = append(errs, errors.New("RateLimitRequests and RateLimitEvents can't be negative"))
+	}
+
+	if cfg.RateLimitRequestBurst < 0 || cfg.RateLimitEventBurst < 0 {
+		errs = append(errs, errors.New("RateLimitRequestBurst and RateLimitEventBurst can't be negative"))
+	}
+
+	if cfg.CircuitBreakerThreshold < 0 {
+		errs = append(errs, errors.New("CircuitBreakerThreshold can't be negative"))
+	}
+
+	if cfg.CircuitBreakerSuccessThreshold < 0 {
+		errs = append(errs, errors.New("CircuitBreakerSuccessThreshold can't be negative"))
+	}
+
+	if cfg.CircuitBreakerCoolDown < 0 {
+		errs = append(errs, errors.New("CircuitBreakerCoolDown can't be negative"))
 	}
 
-	return nil
+	return errs.errorOrNil()
 }
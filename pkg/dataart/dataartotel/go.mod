@@ -0,0 +1,21 @@
+module github.com/dataart-ai/dataart-go/pkg/dataart/dataartotel
+
+go 1.20
+
+require (
+	github.com/dataart-ai/dataart-go v0.0.0-00010101000000-000000000000
+	go.opentelemetry.io/otel v1.24.0
+	go.opentelemetry.io/otel/sdk v1.24.0
+	go.opentelemetry.io/otel/trace v1.24.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.1 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/metric v1.24.0 // indirect
+	golang.org/x/sys v0.17.0 // indirect
+)
+
+// No tagged release of the core module has the Tracer API yet, so the module
+// builds against the checkout and isn't published. See CONTRIBUTING.md.
+replace github.com/dataart-ai/dataart-go => ../../..
@@ -0,0 +1,97 @@
+// Package dataartotel traces a dataart.Client with OpenTelemetry. It's a module
+// of its own, so the core module stays free of dependencies.
+//
+// Every EmitActionContext call gets a span that's a child of the span in the
+// emit context. Every request attempt gets a span of its own, linked to the emit
+// spans of all actions it carries.
+package dataartotel
+
+import (
+	"context"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/dataart-ai/dataart-go/pkg/dataart/dataartotel"
+
+// Span names and attribute keys used by Tracer.
+const (
+	EmitSpanName   = "dataart.emit"
+	UploadSpanName = "dataart.upload"
+
+	PayloadTypeKey = attribute.Key("dataart.payload.type")
+	AttemptKey     = attribute.Key("dataart.attempt")
+	PayloadSizeKey = attribute.Key("dataart.payload.size")
+	EventCountKey  = attribute.Key("dataart.event.count")
+	URLKey         = attribute.Key("url.full")
+	StatusCodeKey  = attribute.Key("http.response.status_code")
+)
+
+// Tracer implements dataart.Tracer on top of an OpenTelemetry tracer.
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+var _ dataart.Tracer = (*Tracer)(nil)
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartEmit starts the span of an emitted action as a child of ctx. The span
+// ends once the action is queued or rejected.
+func (t *Tracer) StartEmit(ctx context.Context) (interface{}, func(err error)) {
+	_, span := t.tracer.Start(ctx, EmitSpanName, trace.WithSpanKind(trace.SpanKindProducer))
+
+	return span.SpanContext(), func(err error) {
+		endSpan(span, err)
+	}
+}
+
+// StartUpload starts the span of a request attempt, linked to the emits of the
+// actions it carries.
+func (t *Tracer) StartUpload(ctx context.Context, info dataart.UploadInfo) (context.Context, func(int, error)) {
+	links := make([]trace.Link, 0, len(info.Links))
+	for _, l := range info.Links {
+		if sc, ok := l.(trace.SpanContext); ok && sc.IsValid() {
+			links = append(links, trace.Link{SpanContext: sc})
+		}
+	}
+
+	ctx, span := t.tracer.Start(ctx, UploadSpanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			PayloadTypeKey.String(info.PayloadType),
+			URLKey.String(info.URL),
+			AttemptKey.Int(info.Attempt),
+			PayloadSizeKey.Int(info.PayloadSize),
+			EventCountKey.Int(info.EventCount),
+		))
+
+	return ctx, func(status int, err error) {
+		if status > 0 {
+			span.SetAttributes(StatusCodeKey.Int(status))
+		}
+		endSpan(span, err)
+	}
+}
+
+// NewTracer creates a new Tracer instance using given tracer provider, or the
+// global one if tp is nil. Use this function to instantiate a concrete Tracer
+// type.
+func NewTracer(tp trace.TracerProvider) *Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+
+	return &Tracer{tracer: tp.Tracer(instrumentationName)}
+}
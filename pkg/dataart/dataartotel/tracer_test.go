@@ -0,0 +1,105 @@
+package dataartotel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func attr(s sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestTracer_WithEmitsAndUpload(t *testing.T) {
+	t.Parallel()
+
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	tr := NewTracer(tp)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	first, end := tr.StartEmit(ctx)
+	end(nil)
+	second, end := tr.StartEmit(ctx)
+	end(errors.New("buffer is full"))
+	parent.End()
+
+	_, finish := tr.StartUpload(context.Background(), dataart.UploadInfo{
+		PayloadType: "actions",
+		Attempt:     1,
+		PayloadSize: 128,
+		EventCount:  2,
+		Links:       []interface{}{first, second},
+	})
+	finish(http.StatusOK, nil)
+
+	spans := rec.Ended()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+
+	for _, span := range spans[:2] {
+		if span.Name() != EmitSpanName || span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Error("emit span should be a child of the emit context")
+			t.Fail()
+		}
+	}
+
+	if spans[0].Status().Code == codes.Error || spans[1].Status().Code != codes.Error {
+		t.Error("only the rejected emit should be marked as failed")
+		t.Fail()
+	}
+
+	up := spans[3]
+	if up.Name() != UploadSpanName || up.Parent().IsValid() {
+		t.Errorf("expected a root upload span, got %q", up.Name())
+		t.Fail()
+	}
+
+	links := up.Links()
+	if len(links) != 2 || links[0].SpanContext.SpanID() != spans[0].SpanContext().SpanID() ||
+		links[1].SpanContext.SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("upload span should link to the emit spans, got %v", links)
+		t.Fail()
+	}
+
+	if attr(up, AttemptKey).AsInt64() != 1 || attr(up, EventCountKey).AsInt64() != 2 ||
+		attr(up, PayloadSizeKey).AsInt64() != 128 || attr(up, StatusCodeKey).AsInt64() != http.StatusOK {
+		t.Errorf("unexpected upload span attributes: %v", up.Attributes())
+		t.Fail()
+	}
+}
+
+func TestTracer_WithFailedUpload(t *testing.T) {
+	t.Parallel()
+
+	rec := tracetest.NewSpanRecorder()
+	tr := NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+
+	_, finish := tr.StartUpload(context.Background(), dataart.UploadInfo{Attempt: 2, Links: []interface{}{"invalid"}})
+	finish(0, errors.New("connection refused"))
+
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+
+	if spans[0].Status().Code != codes.Error || len(spans[0].Links()) != 0 ||
+		attr(spans[0], AttemptKey).AsInt64() != 2 || attr(spans[0], StatusCodeKey).Type() != attribute.INVALID {
+		t.Errorf("unexpected span: %+v", spans[0])
+		t.Fail()
+	}
+}
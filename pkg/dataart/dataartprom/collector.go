@@ -0,0 +1,201 @@
+// Package dataartprom exposes the metrics of a dataart.Client in the Prometheus
+// text exposition format. It has no dependencies besides the standard library,
+// so it can be served on its own /metrics endpoint or appended to the output of
+// an existing one.
+package dataartprom
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var namespacePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// StatsSource provides the stats to expose. *dataart.Client implements it. If
+// the source also has a CircuitState method, the circuit breaker state is
+// exposed too.
+type StatsSource interface {
+	Stats() dataart.Stats
+}
+
+// Collector renders the stats of a StatsSource as Prometheus metrics. Every
+// collection takes a fresh snapshot.
+type Collector struct {
+	src       StatsSource
+	namespace string
+}
+
+type writer struct {
+	w         *bufio.Writer
+	namespace string
+}
+
+func (w *writer) header(name, typ, help string) {
+	fmt.Fprintf(w.w, "# HELP %s_%s %s\n", w.namespace, name, help)
+	fmt.Fprintf(w.w, "# TYPE %s_%s %s\n", w.namespace, name, typ)
+}
+
+func (w *writer) sample(name string, labels []string, v float64) {
+	w.w.WriteString(w.namespace)
+	w.w.WriteByte('_')
+	w.w.WriteString(name)
+
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			fmt.Fprintf(w.w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.w.WriteByte('}')
+	}
+
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatFloat(v))
+	w.w.WriteByte('\n')
+}
+
+func (w *writer) metric(name, typ, help string, v float64) {
+	w.header(name, typ, help)
+	w.sample(name, nil, v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedEndpoints(st dataart.Stats) []string {
+	res := make([]string, 0, len(st.Endpoints))
+	for endpoint := range st.Endpoints {
+		res = append(res, endpoint)
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// WriteTo writes all metrics to w in the text exposition format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	pw := &writer{w: bufio.NewWriter(cw), namespace: c.namespace}
+	st := c.src.Stats()
+
+	pw.header("emitted_total", "counter", "Number of objects accepted by EmitAction and Identify.")
+	pw.sample("emitted_total", []string{"type", "actions"}, float64(st.ActionsEmitted))
+	pw.sample("emitted_total", []string{"type", "identities"}, float64(st.IdentitiesEmitted))
+
+	pw.header("dropped_total", "counter", "Number of objects dropped by the overflow policy.")
+	pw.sample("dropped_total", []string{"type", "actions"}, float64(st.ActionsDropped))
+	pw.sample("dropped_total", []string{"type", "identities"}, float64(st.IdentitiesDropped))
+
+	pw.metric("batches_sent_total", "counter", "Number of requests accepted by the server.", float64(st.BatchesSent))
+	pw.metric("bytes_sent_total", "counter", "Size of all request bodies sent, retries included.", float64(st.BytesSent))
+	pw.metric("retries_total", "counter", "Number of request attempts after the first one.", float64(st.Retries))
+	pw.metric("permanent_failures_total", "counter", "Number of requests given up on.", float64(st.PermanentFailures))
+	pw.metric("queue_depth", "gauge", "Number of objects accepted but not sent or given up on yet.", float64(st.QueueDepth))
+	pw.metric("task_queue_depth", "gauge", "Number of requests waiting for a worker.", float64(st.TaskQueueDepth))
+	pw.metric("in_flight_requests", "gauge", "Number of requests being sent.", float64(st.InFlight))
+
+	if cs, ok := c.src.(interface{ CircuitState() dataart.CircuitState }); ok {
+		pw.metric("circuit_breaker_state", "gauge",
+			"State of the circuit breaker: 0 closed, 1 open, 2 half-open.", float64(cs.CircuitState()))
+	}
+
+	endpoints := sortedEndpoints(st)
+
+	pw.header("requests_total", "counter", "Number of responses by endpoint and status code.")
+	for _, endpoint := range endpoints {
+		es := st.Endpoints[endpoint]
+
+		codes := make([]int, 0, len(es.StatusCodes))
+		for code := range es.StatusCodes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+
+		for _, code := range codes {
+			pw.sample("requests_total", []string{"endpoint", endpoint, "code", strconv.Itoa(code)},
+				float64(es.StatusCodes[code]))
+		}
+	}
+
+	pw.header("transport_errors_total", "counter", "Number of requests that got no response by endpoint.")
+	for _, endpoint := range endpoints {
+		pw.sample("transport_errors_total", []string{"endpoint", endpoint},
+			float64(st.Endpoints[endpoint].TransportErrors))
+	}
+
+	pw.header("request_duration_seconds", "histogram", "Request latency by endpoint.")
+	for _, endpoint := range endpoints {
+		h := st.Endpoints[endpoint].Latency
+
+		var cumulative int64
+		for i, bound := range h.Bounds {
+			cumulative += h.Counts[i]
+			pw.sample("request_duration_seconds_bucket",
+				[]string{"endpoint", endpoint, "le", formatFloat(bound.Seconds())}, float64(cumulative))
+		}
+		pw.sample("request_duration_seconds_bucket", []string{"endpoint", endpoint, "le", "+Inf"}, float64(h.Count))
+		pw.sample("request_duration_seconds_sum", []string{"endpoint", endpoint}, h.Sum.Seconds())
+		pw.sample("request_duration_seconds_count", []string{"endpoint", endpoint}, float64(h.Count))
+	}
+
+	err := pw.w.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP writes all metrics as the response, so a Collector can be mounted as
+// a /metrics handler.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	c.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// NewCollector creates a new Collector instance exposing the stats of src under
+// given namespace, which prefixes all metric names. An empty namespace defaults
+// to "dataart". Use this function to instantiate a concrete Collector type.
+func NewCollector(src StatsSource, namespace string) (*Collector, error) {
+	if src == nil {
+		return nil, errors.New("src can't be nil")
+	}
+
+	if len(namespace) == 0 {
+		namespace = "dataart"
+	}
+
+	if !namespacePattern.MatchString(namespace) {
+		return nil, errors.New("namespace is not a valid metric name prefix")
+	}
+
+	c := &Collector{
+		src:       src,
+		namespace: namespace,
+	}
+
+	return c, nil
+}
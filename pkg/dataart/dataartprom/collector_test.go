@@ -0,0 +1,141 @@
+package dataartprom
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+)
+
+type mockSource struct {
+	st dataart.Stats
+}
+
+func (m *mockSource) Stats() dataart.Stats {
+	return m.st
+}
+
+func (m *mockSource) CircuitState() dataart.CircuitState {
+	return dataart.CircuitOpen
+}
+
+func newMockSource() *mockSource {
+	return &mockSource{st: dataart.Stats{
+		ActionsEmitted: 10,
+		ActionsDropped: 2,
+		BatchesSent:    3,
+		Retries:        1,
+		QueueDepth:     4,
+		Endpoints: map[string]dataart.EndpointStats{
+			"/events/send-actions": {
+				Requests:        4,
+				TransportErrors: 1,
+				StatusCodes:     map[int]int64{200: 3},
+				Latency: dataart.Histogram{
+					Bounds: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond},
+					Counts: []int64{1, 2, 1},
+					Count:  4,
+					Sum:    1500 * time.Millisecond,
+				},
+			},
+			"/users/\"identify\"": {
+				StatusCodes: map[int]int64{},
+				Latency: dataart.Histogram{
+					Bounds: []time.Duration{10 * time.Millisecond, 100 * time.Millisecond},
+					Counts: []int64{0, 0, 0},
+				},
+			},
+		},
+	}}
+}
+
+func TestNewCollector(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewCollector(nil, ""); err == nil {
+		t.Error("nil source should be rejected")
+		t.Fail()
+	}
+
+	if _, err := NewCollector(newMockSource(), "data-art"); err == nil {
+		t.Error("invalid namespace should be rejected")
+		t.Fail()
+	}
+
+	c, err := NewCollector(newMockSource(), "")
+	if err != nil {
+		t.Fatalf("collector creation failed with error: %s", err.Error())
+	}
+
+	if c.namespace != "dataart" {
+		t.Errorf("expected default namespace, got %q", c.namespace)
+		t.Fail()
+	}
+}
+
+func TestCollector_WithWriteTo(t *testing.T) {
+	t.Parallel()
+
+	c, _ := NewCollector(newMockSource(), "app")
+
+	var buf bytes.Buffer
+	n, err := c.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("writing metrics failed with error: %s", err.Error())
+	}
+
+	if n != int64(buf.Len()) {
+		t.Errorf("expected %d bytes written, got %d", buf.Len(), n)
+		t.Fail()
+	}
+
+	out := buf.String()
+	expected := []string{
+		"# TYPE app_emitted_total counter",
+		`app_emitted_total{type="actions"} 10`,
+		`app_dropped_total{type="actions"} 2`,
+		"app_batches_sent_total 3",
+		"app_retries_total 1",
+		"# TYPE app_queue_depth gauge",
+		"app_queue_depth 4",
+		"app_circuit_breaker_state 1",
+		`app_requests_total{endpoint="/events/send-actions",code="200"} 3`,
+		`app_transport_errors_total{endpoint="/events/send-actions"} 1`,
+		`app_transport_errors_total{endpoint="/users/\"identify\""} 0`,
+		"# TYPE app_request_duration_seconds histogram",
+		`app_request_duration_seconds_bucket{endpoint="/events/send-actions",le="0.01"} 1`,
+		`app_request_duration_seconds_bucket{endpoint="/events/send-actions",le="0.1"} 3`,
+		`app_request_duration_seconds_bucket{endpoint="/events/send-actions",le="+Inf"} 4`,
+		`app_request_duration_seconds_sum{endpoint="/events/send-actions"} 1.5`,
+		`app_request_duration_seconds_count{endpoint="/events/send-actions"} 4`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected line %q in output:\n%s", line, out)
+			t.Fail()
+		}
+	}
+}
+
+func TestCollector_WithServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	c, _ := NewCollector(newMockSource(), "")
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != contentType {
+		t.Errorf("expected content type %q, got %q", contentType, ct)
+		t.Fail()
+	}
+
+	if !strings.Contains(rec.Body.String(), "dataart_batches_sent_total 3\n") {
+		t.Errorf("unexpected response body:\n%s", rec.Body.String())
+		t.Fail()
+	}
+}
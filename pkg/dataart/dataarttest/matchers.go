@@ -0,0 +1,102 @@
+package dataarttest
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+)
+
+// Matcher narrows down the actions an assertion looks for.
+type Matcher struct {
+	desc  string
+	match func(a dataart.Action) bool
+}
+
+func (m Matcher) String() string {
+	return m.desc
+}
+
+// Match creates a Matcher from fn, described by desc in failure messages.
+func Match(desc string, fn func(a dataart.Action) bool) Matcher {
+	return Matcher{desc: desc, match: fn}
+}
+
+// WithUserKey matches actions emitted for given user key.
+func WithUserKey(userKey string) Matcher {
+	return Match(fmt.Sprintf("user key %q", userKey), func(a dataart.Action) bool {
+		return a.UserKey == userKey
+	})
+}
+
+// WithAnonymousUser matches actions by whether their user is anonymous.
+func WithAnonymousUser(isAnonymousUser bool) Matcher {
+	return Match(fmt.Sprintf("anonymous user %t", isAnonymousUser), func(a dataart.Action) bool {
+		return a.IsAnonymousUser == isAnonymousUser
+	})
+}
+
+// WithID matches actions with given event ID.
+func WithID(id string) Matcher {
+	return Match(fmt.Sprintf("ID %q", id), func(a dataart.Action) bool {
+		return a.ID == id
+	})
+}
+
+// WithMetadata matches actions whose metadata holds value under key. Values are
+// compared with reflect.DeepEqual.
+func WithMetadata(key string, value interface{}) Matcher {
+	return Match(fmt.Sprintf("metadata %s=%v", key, value), func(a dataart.Action) bool {
+		v, ok := a.Metadata[key]
+		return ok && reflect.DeepEqual(v, value)
+	})
+}
+
+// WithMetadataKey matches actions whose metadata has key, whatever its value.
+func WithMetadataKey(key string) Matcher {
+	return Match(fmt.Sprintf("metadata key %s", key), func(a dataart.Action) bool {
+		_, ok := a.Metadata[key]
+		return ok
+	})
+}
+
+func matchAll(a dataart.Action, matchers []Matcher) bool {
+	for _, m := range matchers {
+		if !m.match(a) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func describe(matchers []Matcher) string {
+	if len(matchers) == 0 {
+		return ""
+	}
+
+	descs := make([]string, len(matchers))
+	for i, m := range matchers {
+		descs[i] = m.desc
+	}
+
+	return " with " + strings.Join(descs, ", ")
+}
+
+func formatAction(a dataart.Action) string {
+	return fmt.Sprintf("{key: %q, user key: %q, metadata: %v}", a.Key, a.UserKey, a.Metadata)
+}
+
+func formatActions(actions []dataart.Action) string {
+	if len(actions) == 0 {
+		return "none"
+	}
+
+	res := make([]string, len(actions))
+	for i, a := range actions {
+		res[i] = formatAction(a)
+	}
+
+	return strings.Join(res, ", ")
+}
@@ -0,0 +1,306 @@
+// Package dataarttest provides utilities for testing code instrumented with the
+// dataart client without a network.
+package dataarttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+)
+
+// TestingT is the subset of testing.TB used by the assertion helpers.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// Recorder implements dataart.Tracker and records emitted actions and identities
+// in memory instead of sending them. It's safe for concurrent use.
+type Recorder struct {
+	mx         sync.Mutex
+	actions    []dataart.Action
+	identities []dataart.Identity
+	closed     bool
+
+	// changed is closed and replaced whenever an object is recorded, which wakes
+	// up waiters.
+	changed chan struct{}
+}
+
+var _ dataart.Tracker = (*Recorder)(nil)
+
+func (r *Recorder) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *Recorder) recordAction(ctx context.Context, a dataart.Action) error {
+	if len(a.Key) == 0 {
+		return errors.New("event key identifier must not empty")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(a.ID) == 0 {
+		a.ID = dataart.NewEventID()
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.closed {
+		return errors.New("recorder is closed")
+	}
+
+	r.actions = append(r.actions, a)
+	r.notify()
+
+	return nil
+}
+
+// EmitAction records an action with given properties.
+func (r *Recorder) EmitAction(key string, userKey string, isAnonymousUser bool,
+	timestamp time.Time, metadata map[string]interface{}) error {
+
+	return r.EmitActionContext(context.Background(), key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+// EmitActionContext works like EmitAction but returns ctx.Err() if ctx is done.
+func (r *Recorder) EmitActionContext(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	return r.EmitActionWithID(ctx, "", key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+// EmitActionWithID works like EmitActionContext but records given id as the event
+// ID instead of generating one.
+func (r *Recorder) EmitActionWithID(ctx context.Context, id string, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	return r.recordAction(ctx, dataart.Action{
+		ID:              id,
+		Key:             key,
+		UserKey:         userKey,
+		IsAnonymousUser: isAnonymousUser,
+		Timestamp:       timestamp,
+		Metadata:        metadata,
+	})
+}
+
+// EmitActionAsync works like EmitActionContext and returns a Delivery that's
+// already resolved.
+func (r *Recorder) EmitActionAsync(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) (*dataart.Delivery, error) {
+
+	err := r.EmitActionContext(ctx, key, userKey, isAnonymousUser, timestamp, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return dataart.NewResolvedDelivery(nil), nil
+}
+
+// Identify records an identity with given properties.
+func (r *Recorder) Identify(userKey string, metadata map[string]interface{}) error {
+	return r.IdentifyContext(context.Background(), userKey, metadata)
+}
+
+// IdentifyContext works like Identify but returns ctx.Err() if ctx is done.
+func (r *Recorder) IdentifyContext(ctx context.Context, userKey string, metadata map[string]interface{}) error {
+	if len(userKey) == 0 {
+		return errors.New("userKey must not empty")
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.closed {
+		return errors.New("recorder is closed")
+	}
+
+	r.identities = append(r.identities, dataart.Identity{
+		UserKey:  userKey,
+		Metadata: metadata,
+	})
+	r.notify()
+
+	return nil
+}
+
+// ReplayDeadLetters returns right away since recorded objects never fail.
+func (r *Recorder) ReplayDeadLetters() (int, error) {
+	return 0, nil
+}
+
+// Flush returns right away since recorded objects are never pending.
+func (r *Recorder) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Dropped returns zero counts since the recorder never drops objects.
+func (r *Recorder) Dropped() dataart.DropCounts {
+	return dataart.DropCounts{}
+}
+
+// Stats returns the number of recorded actions and identities as emitted.
+func (r *Recorder) Stats() dataart.Stats {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return dataart.Stats{
+		ActionsEmitted:    int64(len(r.actions)),
+		IdentitiesEmitted: int64(len(r.identities)),
+	}
+}
+
+// CircuitState always returns dataart.CircuitClosed.
+func (r *Recorder) CircuitState() dataart.CircuitState {
+	return dataart.CircuitClosed
+}
+
+// Close makes the recorder reject further actions and identities. Recorded ones
+// stay available.
+func (r *Recorder) Close() {
+	r.CloseContext(context.Background())
+}
+
+// CloseContext works like Close. It never fails.
+func (r *Recorder) CloseContext(ctx context.Context) error {
+	r.mx.Lock()
+	r.closed = true
+	r.mx.Unlock()
+
+	return nil
+}
+
+// Actions returns the recorded actions in the order they were emitted.
+func (r *Recorder) Actions() []dataart.Action {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return append([]dataart.Action(nil), r.actions...)
+}
+
+// Identities returns the recorded identities in the order they were emitted.
+func (r *Recorder) Identities() []dataart.Identity {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return append([]dataart.Identity(nil), r.identities...)
+}
+
+// Reset forgets all recorded actions and identities.
+func (r *Recorder) Reset() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.actions = nil
+	r.identities = nil
+}
+
+// wait blocks until count reports at least n or timeout passes.
+func (r *Recorder) wait(n int, timeout time.Duration, count func() int) (int, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		r.mx.Lock()
+		got, changed := count(), r.changed
+		r.mx.Unlock()
+
+		if got >= n {
+			return got, true
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return got, false
+		}
+	}
+}
+
+// WaitForActions blocks until at least n actions are recorded and returns them.
+// It returns an error if that takes longer than timeout, which is useful for
+// code emitting from other goroutines.
+func (r *Recorder) WaitForActions(n int, timeout time.Duration) ([]dataart.Action, error) {
+	got, ok := r.wait(n, timeout, func() int { return len(r.actions) })
+	if !ok {
+		return nil, fmt.Errorf("expected %d actions within %s, got %d", n, timeout, got)
+	}
+
+	return r.Actions(), nil
+}
+
+// WaitForIdentities is the identities counterpart of WaitForActions.
+func (r *Recorder) WaitForIdentities(n int, timeout time.Duration) ([]dataart.Identity, error) {
+	got, ok := r.wait(n, timeout, func() int { return len(r.identities) })
+	if !ok {
+		return nil, fmt.Errorf("expected %d identities within %s, got %d", n, timeout, got)
+	}
+
+	return r.Identities(), nil
+}
+
+// AssertEmitted reports an error to t unless an action with given key matching
+// all matchers was recorded. It returns whether the assertion held.
+func (r *Recorder) AssertEmitted(t TestingT, key string, matchers ...Matcher) bool {
+	t.Helper()
+
+	actions := r.Actions()
+	for _, a := range actions {
+		if a.Key == key && matchAll(a, matchers) {
+			return true
+		}
+	}
+
+	t.Errorf("expected an action %q%s to be emitted, recorded actions: %s",
+		key, describe(matchers), formatActions(actions))
+	return false
+}
+
+// AssertNotEmitted reports an error to t if an action with given key matching all
+// matchers was recorded. It returns whether the assertion held.
+func (r *Recorder) AssertNotEmitted(t TestingT, key string, matchers ...Matcher) bool {
+	t.Helper()
+
+	for _, a := range r.Actions() {
+		if a.Key == key && matchAll(a, matchers) {
+			t.Errorf("expected no action %q%s to be emitted, got %s", key, describe(matchers), formatAction(a))
+			return false
+		}
+	}
+
+	return true
+}
+
+// AssertIdentified reports an error to t unless an identity for given user key
+// was recorded. It returns whether the assertion held.
+func (r *Recorder) AssertIdentified(t TestingT, userKey string) bool {
+	t.Helper()
+
+	for _, id := range r.Identities() {
+		if id.UserKey == userKey {
+			return true
+		}
+	}
+
+	t.Errorf("expected user %q to be identified", userKey)
+	return false
+}
+
+// NewRecorder creates a new Recorder instance. Use this function to instantiate
+// a concrete Recorder type.
+func NewRecorder() *Recorder {
+	return &Recorder{changed: make(chan struct{})}
+}
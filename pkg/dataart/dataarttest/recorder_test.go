@@ -0,0 +1,121 @@
+package dataarttest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockT struct {
+	errors []string
+}
+
+func (m *mockT) Helper() {}
+
+func (m *mockT) Errorf(format string, args ...interface{}) {
+	m.errors = append(m.errors, fmt.Sprintf(format, args...))
+}
+
+func TestRecorder_WithEmitAndIdentify(t *testing.T) {
+	t.Parallel()
+
+	r := NewRecorder()
+	r.EmitAction("signup", "user-1", false, time.Now(), map[string]interface{}{"plan": "pro"})
+	r.EmitActionWithID(context.Background(), "custom-id", "login", "user-1", false, time.Now(), nil)
+	r.Identify("user-1", map[string]interface{}{"name": "Jane"})
+
+	d, err := r.EmitActionAsync(context.Background(), "purchase", "user-2", true, time.Now(), nil)
+	if err != nil || d.Wait(context.Background()) != nil {
+		t.Errorf("async emit should be delivered right away, got %v", err)
+		t.Fail()
+	}
+
+	actions := r.Actions()
+	if len(actions) != 3 || len(actions[0].ID) != 26 || actions[1].ID != "custom-id" {
+		t.Errorf("unexpected actions: %+v", actions)
+		t.Fail()
+	}
+
+	if ids := r.Identities(); len(ids) != 1 || ids[0].UserKey != "user-1" {
+		t.Errorf("unexpected identities: %+v", ids)
+		t.Fail()
+	}
+
+	if r.EmitAction("", "user-1", false, time.Now(), nil) == nil || r.Identify("", nil) == nil {
+		t.Error("empty keys should be rejected like the client does")
+		t.Fail()
+	}
+
+	r.Reset()
+	if len(r.Actions()) != 0 || len(r.Identities()) != 0 {
+		t.Error("reset should forget recorded objects")
+		t.Fail()
+	}
+
+	r.Close()
+	if r.EmitAction("signup", "user-1", false, time.Now(), nil) == nil {
+		t.Error("closed recorder should reject actions")
+		t.Fail()
+	}
+}
+
+func TestRecorder_WithAssertions(t *testing.T) {
+	t.Parallel()
+
+	r := NewRecorder()
+	r.EmitAction("signup", "user-1", false, time.Now(), map[string]interface{}{"plan": "pro", "seats": 3})
+
+	r.AssertEmitted(t, "signup")
+	r.AssertEmitted(t, "signup", WithUserKey("user-1"), WithMetadata("plan", "pro"), WithMetadataKey("seats"))
+	r.AssertNotEmitted(t, "login")
+
+	mt := &mockT{}
+	if r.AssertEmitted(mt, "signup", WithMetadata("plan", "free")) {
+		t.Error("assertion should fail for unmatched metadata")
+		t.Fail()
+	}
+
+	if len(mt.errors) != 1 || !strings.Contains(mt.errors[0], "metadata plan=free") ||
+		!strings.Contains(mt.errors[0], `key: "signup"`) {
+		t.Errorf("failure message should describe the matchers and recorded actions: %v", mt.errors)
+		t.Fail()
+	}
+
+	mt = &mockT{}
+	if r.AssertNotEmitted(mt, "signup", WithAnonymousUser(false)) || len(mt.errors) != 1 {
+		t.Error("negative assertion should fail for a matching action")
+		t.Fail()
+	}
+
+	mt = &mockT{}
+	if r.AssertIdentified(mt, "user-1") || len(mt.errors) != 1 {
+		t.Error("identity assertion should fail without identities")
+		t.Fail()
+	}
+}
+
+func TestRecorder_WithWaitForActions(t *testing.T) {
+	t.Parallel()
+
+	r := NewRecorder()
+	go func() {
+		for i := 0; i < 3; i++ {
+			time.Sleep(5 * time.Millisecond)
+			r.EmitAction("tick", "user-1", false, time.Now(), nil)
+		}
+	}()
+
+	actions, err := r.WaitForActions(3, time.Second)
+	if err != nil || len(actions) != 3 {
+		t.Errorf("expected 3 actions, got %d and error %v", len(actions), err)
+		t.Fail()
+	}
+
+	_, err = r.WaitForIdentities(1, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "got 0") {
+		t.Errorf("expected a timeout error, got %v", err)
+		t.Fail()
+	}
+}
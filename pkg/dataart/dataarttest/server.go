@@ -0,0 +1,558 @@
+package dataarttest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+)
+
+// Endpoint paths served by Server unless SetPaths says otherwise.
+const (
+	ActionsPath    = "/events/send-actions"
+	IdentitiesPath = "/users/identify"
+)
+
+// Fault scripts the response to a single request. Faults are consumed in the
+// order they were scripted, each by the first valid request to a matching path.
+// Requests rejected for their API key or body don't consume faults.
+type Fault struct {
+	// Path limits the fault to requests to a single endpoint, given either as
+	// the path of the request or as the path the endpoint is served at. Empty
+	// matches all.
+	Path string
+
+	// Latency delays the response.
+	Latency time.Duration
+
+	// Status is the response status code. Zero accepts the request, unless the
+	// connection is reset.
+	Status int
+
+	// RetryAfter sets the Retry-After header of the response, rounded up to
+	// whole seconds.
+	RetryAfter time.Duration
+
+	// Reset closes the connection without a response.
+	Reset bool
+
+	// AcceptFirst stores the first AcceptFirst objects of the batch before the
+	// fault's status is returned, simulating a server that failed halfway.
+	AcceptFirst int
+}
+
+// Delay returns a Fault accepting the next request after d.
+func Delay(d time.Duration) Fault {
+	return Fault{Latency: d}
+}
+
+// FailWith returns a Fault responding to the next request with status.
+func FailWith(status int) Fault {
+	return Fault{Status: status}
+}
+
+// Throttle returns a Fault responding to the next request with 429 Too Many
+// Requests and given Retry-After delay.
+func Throttle(retryAfter time.Duration) Fault {
+	return Fault{Status: http.StatusTooManyRequests, RetryAfter: retryAfter}
+}
+
+// ResetConnection returns a Fault closing the connection of the next request
+// without a response.
+func ResetConnection() Fault {
+	return Fault{Reset: true}
+}
+
+// AcceptPartially returns a Fault storing the first n objects of the next batch
+// and responding with 500 Internal Server Error.
+func AcceptPartially(n int) Fault {
+	return Fault{Status: http.StatusInternalServerError, AcceptFirst: n}
+}
+
+// Batch is a request received by Server.
+type Batch struct {
+	Path           string
+	Header         http.Header
+	IdempotencyKey string
+	ReceivedAt     time.Time
+
+	// Actions and Identities hold the objects of the request. For a partially
+	// accepted request only the stored objects are included.
+	Actions    []dataart.Action
+	Identities []dataart.Identity
+
+	// Status is the response status code.
+	Status int
+}
+
+// Server is a fake ingest server implementing the actions and identities
+// endpoints. It validates the API key and request bodies, stores received
+// batches for inspection and responds with scripted faults. Endpoints are
+// matched by the end of the request path, so clients with a base URL path or
+// an API version talk to it as well.
+type Server struct {
+	// URL is the base URL of the server.
+	URL string
+
+	apiKey string
+	srv    *httptest.Server
+
+	mx             sync.Mutex
+	batches        []Batch
+	requests       int
+	faults         []Fault
+	latency        time.Duration
+	actionsPath    string
+	identitiesPath string
+	changed        chan struct{}
+}
+
+// actionsBody is the request body of the actions endpoint.
+type actionsBody struct {
+	Timestamp time.Time        `json:"timestamp"`
+	Actions   []dataart.Action `json:"actions"`
+}
+
+// identitiesBody is the request body of the identities endpoint for a batch of
+// identities. A single identity is sent as is.
+type identitiesBody struct {
+	Timestamp  time.Time          `json:"timestamp"`
+	Identities []dataart.Identity `json:"identities"`
+}
+
+// validateActions checks the fields the ingest endpoint requires.
+func validateActions(cnt actionsBody) error {
+	if cnt.Timestamp.IsZero() {
+		return errors.New("timestamp is required")
+	}
+
+	if cnt.Actions == nil {
+		return errors.New("actions are required")
+	}
+
+	for i, a := range cnt.Actions {
+		if len(a.ID) == 0 || len(a.Key) == 0 || a.Timestamp.IsZero() {
+			return fmt.Errorf("action %d: id, key and timestamp are required", i)
+		}
+	}
+
+	return nil
+}
+
+func validateIdentity(cnt dataart.Identity) error {
+	if len(cnt.UserKey) == 0 {
+		return errors.New("user_key is required")
+	}
+
+	return nil
+}
+
+// readBody reads a possibly compressed request body.
+func readBody(r *http.Request) ([]byte, error) {
+	var body io.Reader = r.Body
+	switch r.Header.Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = zr
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", r.Header.Get("Content-Encoding"))
+	}
+
+	return ioutil.ReadAll(body)
+}
+
+// decodeStrict decodes b into v, rejecting unknown fields.
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// parseBatch decodes and validates the body of r sent to endpoint.
+func parseBatch(r *http.Request, endpoint string) (Batch, error) {
+	bt := Batch{
+		Path:           r.URL.Path,
+		Header:         r.Header,
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		ReceivedAt:     time.Now(),
+	}
+
+	b, err := readBody(r)
+	if err != nil {
+		return bt, err
+	}
+
+	switch endpoint {
+	case ActionsPath:
+		cnt := actionsBody{}
+		if err := decodeStrict(b, &cnt); err != nil {
+			return bt, err
+		}
+		if err := validateActions(cnt); err != nil {
+			return bt, err
+		}
+		bt.Actions = cnt.Actions
+	case IdentitiesPath:
+		// A single identity and a batch of them share the endpoint.
+		raw := map[string]json.RawMessage{}
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return bt, err
+		}
+
+		if _, ok := raw["identities"]; ok {
+			cnt := identitiesBody{}
+			if err := decodeStrict(b, &cnt); err != nil {
+				return bt, err
+			}
+			for _, id := range cnt.Identities {
+				if err := validateIdentity(id); err != nil {
+					return bt, err
+				}
+			}
+			bt.Identities = cnt.Identities
+		} else {
+			cnt := dataart.Identity{}
+			if err := decodeStrict(b, &cnt); err != nil {
+				return bt, err
+			}
+			if err := validateIdentity(cnt); err != nil {
+				return bt, err
+			}
+			bt.Identities = []dataart.Identity{cnt}
+		}
+	}
+
+	return bt, nil
+}
+
+// endpoint returns ActionsPath or IdentitiesPath for requests to path, or an
+// empty string if path matches neither.
+func (s *Server) endpoint(path string) string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	switch {
+	case strings.HasSuffix(path, s.actionsPath):
+		return ActionsPath
+	case strings.HasSuffix(path, s.identitiesPath):
+		return IdentitiesPath
+	}
+
+	return ""
+}
+
+func (s *Server) countRequest() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.requests++
+}
+
+// nextFault takes the first scripted fault matching path, the path of a request
+// to endpoint.
+func (s *Server) nextFault(path, endpoint string) Fault {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for i, f := range s.faults {
+		if len(f.Path) == 0 || f.Path == path || f.Path == endpoint {
+			s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			f.Latency += s.latency
+			return f
+		}
+	}
+
+	return Fault{Latency: s.latency}
+}
+
+func (s *Server) store(bt Batch) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.batches = append(s.batches, bt)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func resetConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return
+	}
+
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		// Discarding unsent data makes closing send a RST.
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// ServeHTTP serves the ingest endpoints. Valid requests get the next matching
+// fault applied.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	endpoint := s.endpoint(r.URL.Path)
+	if len(endpoint) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.countRequest()
+
+	key := r.Header.Get("X-API-Key")
+	if len(key) == 0 || (len(s.apiKey) > 0 && key != s.apiKey) {
+		http.Error(w, "invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	bt, err := parseBatch(r, endpoint)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f := s.nextFault(r.URL.Path, endpoint)
+	if f.Latency > 0 {
+		select {
+		case <-time.After(f.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if f.Reset {
+		resetConnection(w)
+		return
+	}
+
+	bt.Status = http.StatusOK
+	if f.Status != 0 {
+		bt.Status = f.Status
+	}
+
+	if f.Status != 0 && f.AcceptFirst > 0 {
+		if f.AcceptFirst < len(bt.Actions) {
+			bt.Actions = bt.Actions[:f.AcceptFirst]
+		}
+		if f.AcceptFirst < len(bt.Identities) {
+			bt.Identities = bt.Identities[:f.AcceptFirst]
+		}
+	}
+
+	if f.Status == 0 || f.AcceptFirst > 0 {
+		s.store(bt)
+	}
+
+	if f.RetryAfter > 0 {
+		// Retry-After only has whole seconds, and rounding down could ask for
+		// no delay at all.
+		secs := (f.RetryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+	}
+	w.WriteHeader(bt.Status)
+}
+
+// Script queues faults for the next requests. Requests that find no matching
+// fault are accepted.
+func (s *Server) Script(faults ...Fault) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.faults = append(s.faults, faults...)
+}
+
+// SetLatency delays all responses by d, in addition to the latency of faults.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.latency = d
+}
+
+// SetPaths sets the paths the actions and identities endpoints are served at,
+// like ClientConfig.ActionsPath and IdentitiesPath. Requests match if their path
+// ends with one of them. Empty paths keep their default.
+func (s *Server) SetPaths(actionsPath, identitiesPath string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.actionsPath, s.identitiesPath = ActionsPath, IdentitiesPath
+	if len(actionsPath) > 0 {
+		s.actionsPath = actionsPath
+	}
+	if len(identitiesPath) > 0 {
+		s.identitiesPath = identitiesPath
+	}
+}
+
+// Requests returns the number of requests received, including rejected ones.
+func (s *Server) Requests() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.requests
+}
+
+// Batches returns the stored batches in the order they were received.
+func (s *Server) Batches() []Batch {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return append([]Batch(nil), s.batches...)
+}
+
+func (s *Server) actions() []dataart.Action {
+	var res []dataart.Action
+	seen := make(map[string]bool)
+	for _, bt := range s.batches {
+		for _, a := range bt.Actions {
+			if !seen[a.ID] {
+				seen[a.ID] = true
+				res = append(res, a)
+			}
+		}
+	}
+
+	return res
+}
+
+// Actions returns the stored actions deduplicated by their event ID, as the real
+// server would, in the order they were first received.
+func (s *Server) Actions() []dataart.Action {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.actions()
+}
+
+func (s *Server) identities() []dataart.Identity {
+	var res []dataart.Identity
+	for _, bt := range s.batches {
+		res = append(res, bt.Identities...)
+	}
+
+	return res
+}
+
+// Identities returns the stored identities in the order they were received.
+func (s *Server) Identities() []dataart.Identity {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	return s.identities()
+}
+
+// WaitForActions blocks until at least n distinct actions are stored and returns
+// them. It returns an error if that takes longer than timeout.
+func (s *Server) WaitForActions(n int, timeout time.Duration) ([]dataart.Action, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mx.Lock()
+		actions, changed := s.actions(), s.changed
+		s.mx.Unlock()
+
+		if len(actions) >= n {
+			return actions, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, fmt.Errorf("expected %d actions within %s, got %d", n, timeout, len(actions))
+		}
+	}
+}
+
+// Reset forgets stored batches, the request count and scripted faults.
+func (s *Server) Reset() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.batches = nil
+	s.requests = 0
+	s.faults = nil
+}
+
+// Client returns an HTTP client sending all requests to the server whatever
+// their host, so a client with the default endpoint talks to it.
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.URL)
+
+	return &http.Client{
+		Transport: &redirectingTransport{
+			target: target,
+			rt:     s.srv.Client().Transport,
+		},
+	}
+}
+
+// Close shuts down the server and blocks until all requests are finished.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+type redirectingTransport struct {
+	target *url.URL
+	rt     http.RoundTripper
+}
+
+func (t *redirectingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the request, so redirect a copy.
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Scheme, u.Host = t.target.Scheme, t.target.Host
+	r2.URL, r2.Host = &u, t.target.Host
+
+	return t.rt.RoundTrip(r2)
+}
+
+// NewServer starts a new Server instance accepting requests with given API key,
+// or with any non-empty one if apiKey is empty. Close it once done. Use this
+// function to instantiate a concrete Server type.
+func NewServer(apiKey string) *Server {
+	s := &Server{
+		apiKey:         apiKey,
+		actionsPath:    ActionsPath,
+		identitiesPath: IdentitiesPath,
+		changed:        make(chan struct{}),
+	}
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+
+	return s
+}
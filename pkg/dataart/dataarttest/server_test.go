@@ -0,0 +1,252 @@
+package dataarttest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dataart-ai/dataart-go/pkg/dataart"
+)
+
+func newTestClient(t *testing.T, s *Server, apiKey string) *dataart.Client {
+	t.Helper()
+
+	c, err := dataart.NewClient(dataart.ClientConfig{
+		APIKey:                apiKey,
+		FlushBufferSize:       10,
+		FlushNumWorkers:       1,
+		FlushNumRetries:       3,
+		FlushBackoff:          dataart.ExponentialBackoff{Initial: time.Millisecond, Max: time.Millisecond},
+		FlushActionsBatchSize: 2,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            s.Client(),
+	})
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	return c
+}
+
+func TestServer_WithClient(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer("api-key")
+	defer s.Close()
+
+	c := newTestClient(t, s, "api-key")
+	c.EmitAction("signup", "user-1", false, time.Now(), map[string]interface{}{"plan": "pro"})
+	c.EmitAction("login", "user-1", false, time.Now(), nil)
+	c.Identify("user-1", map[string]interface{}{"name": "Jane"})
+	c.Close()
+
+	actions := s.Actions()
+	if len(actions) != 2 || actions[0].Key != "signup" || actions[1].Key != "login" {
+		t.Errorf("unexpected actions: %+v", actions)
+		t.Fail()
+	}
+
+	if ids := s.Identities(); len(ids) != 1 || ids[0].UserKey != "user-1" {
+		t.Errorf("unexpected identities: %+v", ids)
+		t.Fail()
+	}
+
+	batches := s.Batches()
+	if len(batches) != 2 || batches[0].Path != ActionsPath || len(batches[0].IdempotencyKey) == 0 {
+		t.Errorf("unexpected batches: %+v", batches)
+		t.Fail()
+	}
+}
+
+func TestServer_WithInvalidRequests(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer("api-key")
+	defer s.Close()
+
+	cases := []struct {
+		path   string
+		key    string
+		body   string
+		status int
+	}{
+		{ActionsPath, "wrong-key", `{}`, http.StatusUnauthorized},
+		{ActionsPath, "api-key", `{"timestamp":"2021-01-01T00:00:00Z","actions":[{"key":"k"}]}`, http.StatusBadRequest},
+		{ActionsPath, "api-key", `{"timestamp":"2021-01-01T00:00:00Z","events":[]}`, http.StatusBadRequest},
+		{IdentitiesPath, "api-key", `{"user_key":""}`, http.StatusBadRequest},
+		{IdentitiesPath, "api-key", `{"timestamp":"2021-01-01T00:00:00Z","identities":[{"user_key":"u"}]}`, http.StatusOK},
+		{"/unknown", "api-key", `{}`, http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodPost, s.URL+c.path, bytes.NewReader([]byte(c.body)))
+		req.Header.Set("X-API-Key", c.key)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed with error: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != c.status {
+			t.Errorf("%s %s: expected status %d, got %d", c.path, c.body, c.status, res.StatusCode)
+			t.Fail()
+		}
+	}
+}
+
+func TestServer_WithScriptedFaults(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer("")
+	defer s.Close()
+
+	s.Script(
+		FailWith(http.StatusInternalServerError),
+		ResetConnection(),
+		Throttle(time.Millisecond),
+		AcceptPartially(1),
+	)
+
+	c := newTestClient(t, s, "any-key")
+	c.EmitAction("first", "user-1", false, time.Now(), nil)
+	c.EmitAction("second", "user-1", false, time.Now(), nil)
+
+	actions, err := s.WaitForActions(2, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	if len(actions) != 2 || actions[0].Key != "first" || actions[1].Key != "second" {
+		t.Errorf("retries should deliver every action once: %+v", actions)
+		t.Fail()
+	}
+
+	// 3 failed requests, the partially accepted one and the final one.
+	if s.Requests() != 5 {
+		t.Errorf("expected 5 requests, got %d", s.Requests())
+		t.Fail()
+	}
+
+	batches := s.Batches()
+	if len(batches) != 2 || batches[0].Status != http.StatusInternalServerError || len(batches[0].Actions) != 1 ||
+		batches[0].IdempotencyKey != batches[1].IdempotencyKey {
+		t.Errorf("unexpected batches: %+v", batches)
+		t.Fail()
+	}
+}
+
+func TestServer_WithFaultsShouldSkipInvalidRequests(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer("api-key")
+	defer s.Close()
+
+	s.Script(Throttle(300 * time.Millisecond))
+
+	body := `{"timestamp":"2021-01-01T00:00:00Z","identities":[{"user_key":"u"}]}`
+	send := func(key string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, s.URL+IdentitiesPath, bytes.NewReader([]byte(body)))
+		req.Header.Set("X-API-Key", key)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed with error: %s", err.Error())
+		}
+		res.Body.Close()
+
+		return res
+	}
+
+	if res := send("wrong-key"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status %d, got %d", http.StatusUnauthorized, res.StatusCode)
+		t.Fail()
+	}
+
+	// The rejected request left the fault for the next valid one.
+	res := send("api-key")
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "1" {
+		t.Errorf("expected a throttled response asking for 1 second, got %d with %q",
+			res.StatusCode, res.Header.Get("Retry-After"))
+		t.Fail()
+	}
+
+	if res := send("api-key"); res.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, res.StatusCode)
+		t.Fail()
+	}
+}
+
+func TestServer_WithEndpointPaths(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer("api-key")
+	defer s.Close()
+
+	s.SetPaths("/actions", "")
+	s.Script(Fault{Path: ActionsPath, Status: http.StatusServiceUnavailable})
+
+	c, err := dataart.New("api-key",
+		dataart.WithEndpoint(s.URL+"/eu"),
+		dataart.WithAPIVersion("v2"),
+		dataart.WithEndpointPaths("/actions", ""),
+		dataart.WithBackoff(dataart.ExponentialBackoff{Initial: time.Millisecond}),
+		dataart.WithHTTPClient(s.Client()),
+	)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	c.EmitAction("signup", "user-1", false, time.Now(), nil)
+	c.Identify("user-1", nil)
+	c.Close()
+
+	if len(s.Actions()) != 1 || len(s.Identities()) != 1 {
+		t.Errorf("expected both endpoints to be served, got %+v", s.Batches())
+		t.Fail()
+	}
+
+	// The fault scripted for the actions endpoint caused a retry.
+	if s.Requests() != 3 {
+		t.Errorf("expected 3 requests, got %d", s.Requests())
+		t.Fail()
+	}
+
+	paths := map[string]bool{}
+	for _, bt := range s.Batches() {
+		paths[bt.Path] = true
+	}
+	if !paths["/eu/v2/actions"] || !paths["/eu/v2"+IdentitiesPath] {
+		t.Errorf("unexpected paths: %v", paths)
+		t.Fail()
+	}
+}
+
+func TestServer_WithLatencyAndCloseDeadline(t *testing.T) {
+	t.Parallel()
+
+	s := NewServer("")
+	defer s.Close()
+	s.SetLatency(time.Second)
+
+	c := newTestClient(t, s, "any-key")
+	c.EmitAction("slow", "user-1", false, time.Now(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	cerr, ok := c.CloseContext(ctx).(*dataart.CloseError)
+	if !ok || cerr.UnsentActions != 1 {
+		t.Errorf("expected the slow action to be reported unsent, got %v", cerr)
+		t.Fail()
+	}
+
+	s.Reset()
+	if s.Requests() != 0 || len(s.Batches()) != 0 {
+		t.Error("reset should forget requests")
+		t.Fail()
+	}
+}
@@ -0,0 +1,235 @@
+package dataart
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+const (
+	// DeadLetterActions marks a dead letter holding a batch of actions.
+	DeadLetterActions = http.PayloadTypeActions
+
+	// DeadLetterIdentity marks a dead letter holding a single identity.
+	DeadLetterIdentity = http.PayloadTypeIdentity
+
+	// DeadLetterIdentities marks a dead letter holding a batch of identities.
+	DeadLetterIdentities = http.PayloadTypeIdentities
+)
+
+// DeadLetter is a request that failed on all of its retries.
+type DeadLetter struct {
+	// Type is DeadLetterActions, DeadLetterIdentity or DeadLetterIdentities.
+	Type string
+
+	// Payload is the JSON encoded, uncompressed request body holding the objects
+	// that weren't delivered. It's the body as it was sent unless the server
+	// rejected the batch as too large. Then only the undelivered parts are
+	// encoded again into a single body with a new timestamp, keeping the event
+	// IDs of the actions.
+	Payload []byte
+
+	// Err is the error of the last attempt.
+	Err error
+
+	// Attempts is the number of times the request was tried.
+	Attempts int
+
+	// FailedAt is the time the request was given up on.
+	FailedAt time.Time
+}
+
+// DeadLetterSink stores requests that failed on all of their retries. Dead letters
+// accepted by a sink can be sent again with Client.ReplayDeadLetters.
+type DeadLetterSink interface {
+	// Put stores given dead letter. Returning an error for a request abandoned on
+	// shutdown keeps it in the on-disk queue, if there's one.
+	Put(dl DeadLetter) error
+
+	// Take removes and returns all stored dead letters.
+	Take() ([]DeadLetter, error)
+}
+
+// DeadLetterFunc is a DeadLetterSink calling a function for every dead letter.
+// It doesn't store anything, so Take always returns no dead letters.
+type DeadLetterFunc func(dl DeadLetter)
+
+// Put calls f with given dead letter.
+func (f DeadLetterFunc) Put(dl DeadLetter) error {
+	f(dl)
+	return nil
+}
+
+// Take returns no dead letters.
+func (f DeadLetterFunc) Take() ([]DeadLetter, error) {
+	return nil, nil
+}
+
+// DeadLetterRing is an in-memory DeadLetterSink holding the most recent dead
+// letters. Once full, every new dead letter replaces the oldest one.
+type DeadLetterRing struct {
+	mx      sync.Mutex
+	letters []DeadLetter
+	next    int
+	full    bool
+}
+
+// Put stores given dead letter, replacing the oldest one if the ring is full.
+func (r *DeadLetterRing) Put(dl DeadLetter) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.letters[r.next] = dl
+	r.next = (r.next + 1) % len(r.letters)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	return nil
+}
+
+// Take removes and returns all stored dead letters, oldest first.
+func (r *DeadLetterRing) Take() ([]DeadLetter, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	var res []DeadLetter
+	if r.full {
+		res = append(res, r.letters[r.next:]...)
+	}
+	res = append(res, r.letters[:r.next]...)
+
+	for i := range r.letters {
+		r.letters[i] = DeadLetter{}
+	}
+	r.next = 0
+	r.full = false
+
+	return res, nil
+}
+
+// NewDeadLetterRing creates a new DeadLetterRing holding up to size dead letters.
+func NewDeadLetterRing(size int) (*DeadLetterRing, error) {
+	if size < 1 {
+		return nil, errors.New("size must be at least 1")
+	}
+
+	r := &DeadLetterRing{
+		letters: make([]DeadLetter, size),
+	}
+
+	return r, nil
+}
+
+type deadLetterLine struct {
+	Type     string          `json:"type"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// DeadLetterFile is a DeadLetterSink appending dead letters to a file as
+// newline delimited JSON, one object per line.
+type DeadLetterFile struct {
+	mx   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// Put appends given dead letter to the file.
+func (d *DeadLetterFile) Put(dl DeadLetter) error {
+	line := deadLetterLine{
+		Type:     dl.Type,
+		Payload:  json.RawMessage(dl.Payload),
+		Attempts: dl.Attempts,
+		FailedAt: dl.FailedAt,
+	}
+	if dl.Err != nil {
+		line.Error = dl.Err.Error()
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	_, err = d.f.Write(append(b, '\n'))
+	return err
+}
+
+// Take reads all dead letters from the file and truncates it.
+func (d *DeadLetterFile) Take() ([]DeadLetter, error) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []DeadLetter
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		line := deadLetterLine{}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			// Skip lines torn by a crash in the middle of a write.
+			continue
+		}
+
+		dl := DeadLetter{
+			Type:     line.Type,
+			Payload:  []byte(line.Payload),
+			Attempts: line.Attempts,
+			FailedAt: line.FailedAt,
+		}
+		if len(line.Error) > 0 {
+			dl.Err = errors.New(line.Error)
+		}
+		res = append(res, dl)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := d.f.Truncate(0); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Close closes the underlying file.
+func (d *DeadLetterFile) Close() error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+
+	return d.f.Close()
+}
+
+// NewDeadLetterFile creates a new DeadLetterFile writing to the file at path.
+// Dead letters already in the file are kept.
+func NewDeadLetterFile(path string) (*DeadLetterFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DeadLetterFile{
+		path: path,
+		f:    f,
+	}
+
+	return d, nil
+}
@@ -0,0 +1,85 @@
+package dataart
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewDeadLetterRing(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewDeadLetterRing(0)
+	if err == nil {
+		t.Error("given size is invalid")
+		t.Fail()
+	}
+}
+
+func TestDeadLetterRing_WithOverflowShouldKeepNewest(t *testing.T) {
+	t.Parallel()
+
+	r, _ := NewDeadLetterRing(2)
+	for i := 1; i <= 3; i++ {
+		r.Put(DeadLetter{Type: DeadLetterActions, Attempts: i})
+	}
+
+	letters, _ := r.Take()
+	if len(letters) != 2 || letters[0].Attempts != 2 || letters[1].Attempts != 3 {
+		t.Errorf("unexpected dead letters: %v", letters)
+		t.Fail()
+	}
+
+	letters, _ = r.Take()
+	if len(letters) != 0 {
+		t.Error("take should empty the ring")
+		t.Fail()
+	}
+}
+
+func TestDeadLetterFile_WithPutAndTake(t *testing.T) {
+	t.Parallel()
+
+	dir, _ := ioutil.TempDir("", "dataart-dlq")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dead-letters.ndjson")
+	d, err := NewDeadLetterFile(path)
+	if err != nil {
+		t.Fatalf("creating dead letter file failed with error: %s", err.Error())
+	}
+	defer d.Close()
+
+	d.Put(DeadLetter{
+		Type:     DeadLetterIdentity,
+		Payload:  []byte(`{"user_key":"user-key","metadata":null}`),
+		Err:      errors.New("request failed"),
+		Attempts: 4,
+		FailedAt: time.Now(),
+	})
+
+	letters, err := d.Take()
+	if err != nil {
+		t.Fatalf("taking dead letters failed with error: %s", err.Error())
+	}
+
+	if len(letters) != 1 {
+		t.Fatalf("expected 1 dead letter, got %d", len(letters))
+	}
+
+	dl := letters[0]
+	if dl.Type != DeadLetterIdentity || dl.Attempts != 4 || dl.Err == nil ||
+		string(dl.Payload) != `{"user_key":"user-key","metadata":null}` {
+		t.Errorf("unexpected dead letter: %v", dl)
+		t.Fail()
+	}
+
+	letters, _ = d.Take()
+	if len(letters) != 0 {
+		t.Error("take should truncate the file")
+		t.Fail()
+	}
+}
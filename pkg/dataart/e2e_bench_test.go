@@ -19,7 +19,7 @@ func BenchmarkClient(b *testing.B) {
 	defer s.Close()
 
 	cfg := ClientConfig{
-		baseURL:               s.URL,
+		Endpoint:              s.URL,
 		APIKey:                "some-api-key",
 		FlushBufferSize:       100,
 		FlushNumWorkers:       16,
@@ -1,9 +1,12 @@
 package dataart
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	gohttp "net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -44,6 +47,40 @@ func (t *testAcceptingIdentitiesHandler) ServeHTTP(w gohttp.ResponseWriter, r *g
 	w.Write(nil)
 }
 
+type mockTogglingHandler struct {
+	accepting int32
+	received  int32
+}
+
+func (m *mockTogglingHandler) ServeHTTP(w gohttp.ResponseWriter, r *gohttp.Request) {
+	if atomic.LoadInt32(&m.accepting) == 0 {
+		w.WriteHeader(gohttp.StatusServiceUnavailable)
+		return
+	}
+
+	atomic.AddInt32(&m.received, 1)
+	w.WriteHeader(gohttp.StatusOK)
+	w.Write(nil)
+}
+
+type mockNotifyingSink struct {
+	*DeadLetterRing
+	putCh chan DeadLetter
+}
+
+func (m *mockNotifyingSink) Put(dl DeadLetter) error {
+	m.DeadLetterRing.Put(dl)
+	m.putCh <- dl
+	return nil
+}
+
+type mockRejectingActionsHandler struct{}
+
+func (m *mockRejectingActionsHandler) ServeHTTP(w gohttp.ResponseWriter, r *gohttp.Request) {
+	w.WriteHeader(gohttp.StatusBadRequest)
+	w.Write([]byte("malformed batch"))
+}
+
 func TestClient_WithActionsRequest(t *testing.T) {
 	t.Parallel()
 
@@ -54,7 +91,7 @@ func TestClient_WithActionsRequest(t *testing.T) {
 	defer s.Close()
 
 	cfg := ClientConfig{
-		baseURL:               s.URL,
+		Endpoint:              s.URL,
 		APIKey:                "api-key",
 		FlushBufferSize:       2,
 		FlushNumWorkers:       2,
@@ -99,7 +136,7 @@ func TestClient_WithIdentityRequest(t *testing.T) {
 	defer s.Close()
 
 	cfg := ClientConfig{
-		baseURL:               s.URL,
+		Endpoint:              s.URL,
 		APIKey:                "api-key",
 		FlushBufferSize:       2,
 		FlushNumWorkers:       2,
@@ -133,3 +170,690 @@ func TestClient_WithIdentityRequest(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestClient_WithDeadLetterSinkAndReplay(t *testing.T) {
+	t.Parallel()
+
+	h := &mockTogglingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	ring, _ := NewDeadLetterRing(10)
+	sink := &mockNotifyingSink{ring, make(chan DeadLetter, 1)}
+
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       2,
+		FlushNumWorkers:       2,
+		FlushNumRetries:       0,
+		FlushBackoffRatio:     1,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+		DeadLetterSink:        sink,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+
+	select {
+	case dl := <-sink.putCh:
+		if dl.Type != DeadLetterActions || dl.Attempts != 1 || dl.Err == nil {
+			t.Errorf("unexpected dead letter: %v", dl)
+			t.Fail()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("rejected request should have been dead-lettered")
+	}
+
+	atomic.StoreInt32(&h.accepting, 1)
+
+	n, err := c.ReplayDeadLetters()
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 replayed dead letter, got %d and error %v", n, err)
+		t.Fail()
+	}
+
+	c.Close()
+	if atomic.LoadInt32(&h.received) != 1 {
+		t.Error("replayed dead letter should have been accepted by server")
+		t.Fail()
+	}
+}
+
+func TestClient_WithPermanentFailureShouldNotRetry(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingActionsHandler{})
+	defer s.Close()
+
+	ring, _ := NewDeadLetterRing(10)
+	sink := &mockNotifyingSink{ring, make(chan DeadLetter, 1)}
+
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       2,
+		FlushNumWorkers:       2,
+		FlushNumRetries:       3,
+		FlushBackoffRatio:     5,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+		DeadLetterSink:        sink,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+
+	select {
+	case dl := <-sink.putCh:
+		herr, ok := dl.Err.(*HTTPError)
+		if !ok || herr.StatusCode != gohttp.StatusBadRequest || string(herr.Body) != "malformed batch" {
+			t.Errorf("expected an HTTP error with status 400, got %v", dl.Err)
+			t.Fail()
+		}
+
+		if dl.Attempts != 1 {
+			t.Errorf("permanent failures should not be retried, got %d attempts", dl.Attempts)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("rejected request should have been dead-lettered without retries")
+	}
+}
+
+func TestClient_WithCloseDeadlineShouldReportUnsent(t *testing.T) {
+	t.Parallel()
+
+	// The handler never accepts, so the action keeps being retried.
+	h := &mockTogglingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       2,
+		FlushNumWorkers:       1,
+		FlushNumRetries:       3,
+		FlushBackoffRatio:     10,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err = c.CloseContext(ctx)
+	if time.Since(started) > 2*time.Second {
+		t.Error("close should return shortly after its deadline")
+		t.Fail()
+	}
+
+	cerr, ok := err.(*CloseError)
+	if !ok {
+		t.Fatalf("expected a close error, got %v", err)
+	}
+
+	if cerr.Err != context.DeadlineExceeded || cerr.UnsentActions != 1 || cerr.UnsentIdentities != 0 {
+		t.Errorf("unexpected close error: %v", cerr)
+		t.Fail()
+	}
+}
+
+func TestClient_WithCloseDeadlineShouldNotWaitForFullBuffer(t *testing.T) {
+	t.Parallel()
+
+	// With a single slot in the buffer, the uploader waits on it while the
+	// worker sleeps through its backoff.
+	h := &mockTogglingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       1,
+		FlushNumWorkers:       1,
+		FlushNumRetries:       3,
+		FlushBackoffRatio:     5,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	// One action is being retried, one waits in the buffer and one waits for
+	// room in it.
+	for i := 0; i < 3; i++ {
+		c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	err = c.CloseContext(ctx)
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("close took %s, should return shortly after its deadline", time.Since(started))
+		t.Fail()
+	}
+
+	cerr, ok := err.(*CloseError)
+	if !ok {
+		t.Fatalf("expected a close error, got %v", err)
+	}
+
+	if cerr.Err != context.DeadlineExceeded || cerr.UnsentActions != 3 {
+		t.Errorf("unexpected close error: %v", cerr)
+		t.Fail()
+	}
+}
+
+func TestClient_WithFlushShouldWaitForDelivery(t *testing.T) {
+	t.Parallel()
+
+	h := &mockTogglingHandler{accepting: 1}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       2,
+		FlushNumWorkers:       2,
+		FlushNumRetries:       3,
+		FlushBackoffRatio:     1,
+		FlushActionsBatchSize: 10,
+		FlushInterval:         time.Duration(time.Minute),
+		HTTPClient:            gohttp.DefaultClient,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("flush failed with error: %s", err.Error())
+	}
+
+	if atomic.LoadInt32(&h.received) != 1 {
+		t.Errorf("expected the pending batch to be delivered, got %d requests", h.received)
+		t.Fail()
+	}
+}
+
+func TestClient_WithEmitActionAsync(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingActionsHandler{})
+	defer s.Close()
+
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       2,
+		FlushNumWorkers:       2,
+		FlushNumRetries:       3,
+		FlushBackoffRatio:     1,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	d, err := c.EmitActionAsync(context.Background(), "event-key", "user-key", false, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("emitting action failed with error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	herr, ok := d.Wait(ctx).(*HTTPError)
+	if !ok || herr.StatusCode != gohttp.StatusBadRequest {
+		t.Errorf("expected an HTTP error with status 400, got %v", d.Err())
+		t.Fail()
+	}
+
+	if _, err := c.EmitActionAsync(context.Background(), "", "user-key", false, time.Now(), nil); err == nil {
+		t.Error("given event key is invalid")
+		t.Fail()
+	}
+}
+
+func TestClient_WithCircuitBreakerShouldFailFast(t *testing.T) {
+	t.Parallel()
+
+	// The handler never accepts, so every request fails.
+	h := &mockTogglingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	ring, _ := NewDeadLetterRing(10)
+	sink := &mockNotifyingSink{ring, make(chan DeadLetter, 4)}
+	transitions := make(chan CircuitState, 4)
+
+	cfg := ClientConfig{
+		Endpoint:                s.URL,
+		APIKey:                  "api-key",
+		FlushBufferSize:         4,
+		FlushNumWorkers:         1,
+		FlushNumRetries:         0,
+		FlushBackoffRatio:       1,
+		FlushActionsBatchSize:   1,
+		FlushInterval:           time.Duration(5 * time.Second),
+		HTTPClient:              gohttp.DefaultClient,
+		DeadLetterSink:          sink,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCoolDown:  time.Minute,
+		CircuitBreakerFailFast:  true,
+		OnCircuitStateChange: func(from, to CircuitState) {
+			transitions <- to
+		},
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	for i := 0; i < 4; i++ {
+		c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	}
+
+	var rejected int
+	for i := 0; i < 4; i++ {
+		select {
+		case dl := <-sink.putCh:
+			if _, ok := dl.Err.(*CircuitOpenError); ok {
+				rejected++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("all actions should have been dead-lettered")
+		}
+	}
+
+	if rejected != 2 || atomic.LoadInt32(&h.received) != 0 {
+		t.Errorf("expected 2 requests rejected by the breaker, got %d", rejected)
+		t.Fail()
+	}
+
+	if c.CircuitState() != CircuitOpen || <-transitions != CircuitOpen {
+		t.Errorf("expected %s, got %s", CircuitOpen, c.CircuitState())
+		t.Fail()
+	}
+}
+
+func TestClient_WithCircuitBreakerShouldNotUseUpRetries(t *testing.T) {
+	t.Parallel()
+
+	h := &mockFailingOnceHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	ring, _ := NewDeadLetterRing(10)
+	sink := &mockNotifyingSink{ring, make(chan DeadLetter, 2)}
+
+	cfg := ClientConfig{
+		Endpoint:                s.URL,
+		APIKey:                  "api-key",
+		FlushBufferSize:         2,
+		FlushNumWorkers:         1,
+		FlushNumRetries:         0,
+		FlushBackoffRatio:       1,
+		FlushActionsBatchSize:   1,
+		FlushInterval:           time.Duration(5 * time.Second),
+		HTTPClient:              gohttp.DefaultClient,
+		DeadLetterSink:          sink,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCoolDown:  200 * time.Millisecond,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	// The first action opens the breaker, the second one waits for the probe
+	// although no retries are left. Closing the client would fail it instead.
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&h.received) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+
+	if n := atomic.LoadInt32(&h.received); n != 2 {
+		t.Errorf("expected both actions to be sent, got %d requests", n)
+		t.Fail()
+	}
+
+	if n := len(sink.putCh); n != 1 {
+		t.Errorf("expected only the failed action to be dead-lettered, got %d", n)
+		t.Fail()
+	}
+}
+
+func TestClient_WithCircuitBreakerShouldNotDelayClose(t *testing.T) {
+	t.Parallel()
+
+	// The handler never accepts, so the breaker opens after the first request.
+	h := &mockTogglingHandler{}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	ring, _ := NewDeadLetterRing(10)
+	sink := &mockNotifyingSink{ring, make(chan DeadLetter, 3)}
+
+	cfg := ClientConfig{
+		Endpoint:                s.URL,
+		APIKey:                  "api-key",
+		FlushBufferSize:         4,
+		FlushNumWorkers:         1,
+		FlushNumRetries:         0,
+		FlushBackoffRatio:       1,
+		FlushActionsBatchSize:   1,
+		FlushInterval:           time.Duration(5 * time.Second),
+		HTTPClient:              gohttp.DefaultClient,
+		DeadLetterSink:          sink,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCoolDown:  time.Minute,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	for i := 0; i < 3; i++ {
+		c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	}
+
+	// Wait for the breaker to open, so the other actions are parked.
+	<-sink.putCh
+
+	started := time.Now()
+	c.Close()
+	if time.Since(started) > 2*time.Second {
+		t.Errorf("close took %s, parked requests should fail on close", time.Since(started))
+		t.Fail()
+	}
+
+	if n := len(sink.putCh); n != 2 {
+		t.Errorf("expected the parked actions to be dead-lettered, got %d", n)
+		t.Fail()
+	}
+
+	for len(sink.putCh) > 0 {
+		if dl := <-sink.putCh; dl.Err == nil {
+			t.Error("dead letter should carry the breaker's error")
+			t.Fail()
+		}
+	}
+}
+
+func TestClient_WithRateLimitShouldDelayRequests(t *testing.T) {
+	t.Parallel()
+
+	h := &mockTogglingHandler{accepting: 1}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       4,
+		FlushNumWorkers:       4,
+		FlushNumRetries:       0,
+		FlushBackoffRatio:     1,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+		RateLimitEvents:       20,
+		RateLimitEventBurst:   1,
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	started := time.Now()
+	for i := 0; i < 4; i++ {
+		c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	}
+	c.Close()
+
+	if atomic.LoadInt32(&h.received) != 4 {
+		t.Errorf("delayed requests should not be dropped, got %d requests", h.received)
+		t.Fail()
+	}
+
+	if elapsed := time.Since(started); elapsed < 140*time.Millisecond {
+		t.Errorf("4 events at 20/s should take about 150ms, took %s", elapsed)
+		t.Fail()
+	}
+}
+
+type mockFailingOnceHandler struct {
+	received int32
+}
+
+func (m *mockFailingOnceHandler) ServeHTTP(w gohttp.ResponseWriter, r *gohttp.Request) {
+	if atomic.AddInt32(&m.received, 1) == 1 {
+		w.WriteHeader(gohttp.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(gohttp.StatusOK)
+	w.Write(nil)
+}
+
+func TestClient_WithBatchHooks(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockFailingOnceHandler{})
+	defer s.Close()
+
+	var sent, retried, identities []BatchInfo
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       2,
+		FlushNumWorkers:       1,
+		FlushNumRetries:       1,
+		FlushBackoff:          ExponentialBackoff{Initial: time.Millisecond, Max: time.Millisecond},
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+		OnBatchSent:           func(info BatchInfo) { sent = append(sent, info) },
+		OnBatchRetry:          func(info BatchInfo) { retried = append(retried, info) },
+		OnIdentitySent:        func(info BatchInfo) { identities = append(identities, info) },
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	c.Flush(context.Background())
+	c.Identify("user-key", map[string]interface{}{"plan": "pro"})
+	c.Close()
+
+	if len(retried) != 1 || retried[0].Attempt != 2 || retried[0].Err == nil {
+		t.Fatalf("expected a single retry with the previous error, got %+v", retried)
+	}
+
+	if len(sent) != 1 {
+		t.Fatalf("expected a single sent batch, got %+v", sent)
+	}
+
+	info := sent[0]
+	if info.ID != retried[0].ID || len(info.ID) != 26 || info.Attempt != 2 || info.WorkerID != "worker-0" ||
+		info.Err != nil || info.Latency <= 0 || info.Elapsed < info.Latency {
+		t.Errorf("unexpected batch info: %+v", info)
+		t.Fail()
+	}
+
+	if len(info.Actions) != 1 || info.Actions[0].Key != "event-key" {
+		t.Errorf("expected batch contents, got %+v", info.Actions)
+		t.Fail()
+	}
+
+	if len(identities) != 1 || len(identities[0].Identities) != 1 ||
+		identities[0].Identities[0].UserKey != "user-key" || identities[0].PayloadType != DeadLetterIdentity {
+		t.Errorf("unexpected identity info: %+v", identities)
+		t.Fail()
+	}
+}
+
+func TestClient_WithOnBatchFailed(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(&mockRejectingActionsHandler{})
+	defer s.Close()
+
+	failedCh := make(chan BatchInfo, 1)
+	cfg := ClientConfig{
+		Endpoint:              s.URL,
+		APIKey:                "api-key",
+		FlushBufferSize:       2,
+		FlushNumWorkers:       2,
+		FlushNumRetries:       3,
+		FlushBackoffRatio:     5,
+		FlushActionsBatchSize: 1,
+		FlushInterval:         time.Duration(5 * time.Second),
+		HTTPClient:            gohttp.DefaultClient,
+		OnBatchFailed:         func(info BatchInfo) { failedCh <- info },
+	}
+
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+
+	select {
+	case info := <-failedCh:
+		herr, ok := info.Err.(*HTTPError)
+		if !ok || herr.StatusCode != gohttp.StatusBadRequest || info.Attempt != 1 || len(info.Actions) != 1 {
+			t.Errorf("unexpected batch info: %+v", info)
+			t.Fail()
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("rejected batch should have been reported")
+	}
+}
+
+func TestClient_WithFailoverShouldFailBack(t *testing.T) {
+	t.Parallel()
+
+	primary := &mockTogglingHandler{}
+	ps := httptest.NewServer(primary)
+	defer ps.Close()
+
+	secondary := &mockTogglingHandler{accepting: 1}
+	ss := httptest.NewServer(secondary)
+	defer ss.Close()
+
+	changes := make(chan string, 4)
+	c, err := New("api-key",
+		WithEndpoint(ps.URL),
+		WithFailover(FailoverPriority, ss.URL),
+		WithRetries(3),
+		WithBackoff(ExponentialBackoff{Initial: time.Millisecond}),
+		func(cfg *ClientConfig) {
+			cfg.FailoverThreshold = 1
+			cfg.FailoverCoolDown = 50 * time.Millisecond
+			cfg.OnEndpointHealthChange = func(endpoint string, healthy bool) {
+				changes <- fmt.Sprintf("%s:%t", endpoint, healthy)
+			}
+		},
+	)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("expected the action to fail over, got %v", err)
+	}
+
+	if atomic.LoadInt32(&secondary.received) != 1 {
+		t.Error("expected the secondary to receive the batch")
+		t.Fail()
+	}
+
+	if ch := <-changes; ch != ps.URL+":false" {
+		t.Errorf("expected the primary to be marked unhealthy, got %s", ch)
+		t.Fail()
+	}
+
+	atomic.StoreInt32(&primary.accepting, 1)
+	time.Sleep(60 * time.Millisecond)
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("flushing failed with error: %s", err.Error())
+	}
+
+	if atomic.LoadInt32(&primary.received) != 1 {
+		t.Error("expected the recovered primary to receive the batch")
+		t.Fail()
+	}
+
+	if ch := <-changes; ch != ps.URL+":true" {
+		t.Errorf("expected the primary to recover, got %s", ch)
+		t.Fail()
+	}
+}
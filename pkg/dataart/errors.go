@@ -0,0 +1,50 @@
+package dataart
+
+import (
+	"strings"
+
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+// HTTPError is the error of a request the server answered with a non-200 status.
+// It carries the status code, response body and headers. Dead letters and retry
+// classifiers receive it as *HTTPError.
+type HTTPError = http.HTTPError
+
+// FlushError is returned by Client.Flush when some requests failed on their last
+// retry. Errs holds the error of every failed request.
+type FlushError = http.FlushError
+
+// PayloadTooLargeError is returned by EmitAction and Identify for objects that
+// exceed ClientConfig.FlushMaxPayloadSize on their own.
+type PayloadTooLargeError = http.PayloadTooLargeError
+
+// DefaultRetryClassifier is used when ClientConfig.FlushRetryClassifier is nil. It
+// retries network errors and responses with status 408, 429 or 5xx. Any other
+// status, such as 400 for a malformed batch or 401 for a bad APIKey, is permanent.
+func DefaultRetryClassifier(err error) bool {
+	return http.IsRetryable(err)
+}
+
+// MultiError holds several errors reported at once, such as all problems of a
+// ClientConfig or the errors of every tracker a MultiTracker fans out to.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// errorOrNil returns nil for an empty MultiError, so callers never return a
+// non-nil error interface holding no errors.
+func (e MultiError) errorOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
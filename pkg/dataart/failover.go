@@ -0,0 +1,32 @@
+package dataart
+
+import (
+	"time"
+
+	"github.com/dataart-ai/dataart-go/internal/failover"
+)
+
+const (
+	// defaultFailoverThreshold is used when ClientConfig.FailoverThreshold is zero.
+	defaultFailoverThreshold = 2
+
+	// defaultFailoverCoolDown is used when ClientConfig.FailoverCoolDown is zero.
+	defaultFailoverCoolDown = 30 * time.Second
+)
+
+// FailoverStrategy decides which healthy endpoint gets the next request when
+// FailoverEndpoints are configured.
+type FailoverStrategy = failover.Strategy
+
+const (
+	// FailoverPriority sends every request to the first healthy endpoint, Endpoint
+	// before FailoverEndpoints in order. This is the default.
+	FailoverPriority = failover.Priority
+
+	// FailoverRoundRobin spreads requests evenly over all healthy endpoints.
+	FailoverRoundRobin = failover.RoundRobin
+
+	// FailoverLatencyWeighted prefers healthy endpoints with a lower average
+	// latency, picking them at random weighted by the inverse of their latency.
+	FailoverLatencyWeighted = failover.LatencyWeighted
+)
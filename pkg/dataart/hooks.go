@@ -0,0 +1,15 @@
+package dataart
+
+import (
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+// BatchInfo describes a batch of actions or identities to the OnBatchSent,
+// OnBatchRetry, OnBatchFailed and OnIdentitySent hooks.
+type BatchInfo = http.BatchInfo
+
+// Action is an action as carried by a batch.
+type Action = http.ActionContainer
+
+// Identity is an identity as carried by a batch.
+type Identity = http.IdentityContainer
@@ -0,0 +1,128 @@
+package dataart
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+// Logger receives leveled log messages from the client along with alternating
+// keys and values describing them, such as batch_id and err. Implementations must
+// be safe for concurrent use.
+type Logger = http.Logger
+
+// NopLogger discards all messages. It's used when ClientConfig.Logger is nil.
+type NopLogger = http.NopLogger
+
+// LogLevel is the severity of a log message.
+type LogLevel int
+
+const (
+	// LevelDebug is for messages on every sent batch.
+	LevelDebug LogLevel = iota
+
+	// LevelInfo is for lifecycle events.
+	LevelInfo
+
+	// LevelWarn is for failed requests that are retried and dropped objects.
+	LevelWarn
+
+	// LevelError is for objects given up on.
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// StdLogger adapts a standard library *log.Logger to Logger. Messages are
+// written as a level, the message and key=value pairs on a single line.
+type StdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+func formatLogValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if len(s) == 0 || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func (s *StdLogger) log(level LogLevel, msg string, keysAndValues []interface{}) {
+	if level < s.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+
+	for i := 0; i < len(keysAndValues); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(keysAndValues[i]))
+		b.WriteByte('=')
+		if i+1 < len(keysAndValues) {
+			b.WriteString(formatLogValue(keysAndValues[i+1]))
+		}
+	}
+
+	s.l.Output(3, b.String())
+}
+
+// Debug logs msg at LevelDebug.
+func (s *StdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	s.log(LevelDebug, msg, keysAndValues)
+}
+
+// Info logs msg at LevelInfo.
+func (s *StdLogger) Info(msg string, keysAndValues ...interface{}) {
+	s.log(LevelInfo, msg, keysAndValues)
+}
+
+// Warn logs msg at LevelWarn.
+func (s *StdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	s.log(LevelWarn, msg, keysAndValues)
+}
+
+// Error logs msg at LevelError.
+func (s *StdLogger) Error(msg string, keysAndValues ...interface{}) {
+	s.log(LevelError, msg, keysAndValues)
+}
+
+// NewStdLogger creates a new StdLogger instance writing messages of at least
+// given level to l, or to the standard logger if l is nil. Use this function to
+// instantiate a concrete StdLogger type.
+func NewStdLogger(l *log.Logger, level LogLevel) *StdLogger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	return &StdLogger{l: l, level: level}
+}
@@ -0,0 +1,46 @@
+//go:build go1.21
+// +build go1.21
+
+package dataart
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger adapts a *slog.Logger to Logger. Levels map to their slog
+// counterparts and keys and values become attributes.
+type SlogLogger struct {
+	l *slog.Logger
+}
+
+// Debug logs msg at slog.LevelDebug.
+func (s *SlogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelDebug, msg, keysAndValues...)
+}
+
+// Info logs msg at slog.LevelInfo.
+func (s *SlogLogger) Info(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelInfo, msg, keysAndValues...)
+}
+
+// Warn logs msg at slog.LevelWarn.
+func (s *SlogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelWarn, msg, keysAndValues...)
+}
+
+// Error logs msg at slog.LevelError.
+func (s *SlogLogger) Error(msg string, keysAndValues ...interface{}) {
+	s.l.Log(context.Background(), slog.LevelError, msg, keysAndValues...)
+}
+
+// NewSlogLogger creates a new SlogLogger instance writing to l, or to
+// slog.Default() if l is nil. Use this function to instantiate a concrete
+// SlogLogger type.
+func NewSlogLogger(l *slog.Logger) *SlogLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+
+	return &SlogLogger{l: l}
+}
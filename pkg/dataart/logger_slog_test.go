@@ -0,0 +1,32 @@
+//go:build go1.21
+// +build go1.21
+
+package dataart
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	l.Info("uploader shut down")
+	l.Error("giving up on batch", "batch_id", "abc", "attempts", 3)
+
+	out := buf.String()
+	if strings.Contains(out, "uploader shut down") {
+		t.Errorf("info message should be filtered, got %q", out)
+		t.Fail()
+	}
+
+	if !strings.Contains(out, `level=ERROR msg="giving up on batch" batch_id=abc attempts=3`) {
+		t.Errorf("unexpected output %q", out)
+		t.Fail()
+	}
+}
@@ -0,0 +1,35 @@
+package dataart
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+
+	l.Debug("batch sent", "batch_id", "abc")
+	if buf.Len() != 0 {
+		t.Errorf("debug message should be filtered, got %q", buf.String())
+		t.Fail()
+	}
+
+	l.Warn("request failed", "batch_id", "abc", "attempt", 2, "err", errors.New("bad gateway"))
+	expected := "WARN request failed batch_id=abc attempt=2 err=\"bad gateway\"\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+		t.Fail()
+	}
+
+	buf.Reset()
+	l.Error("giving up on batch", "dangling")
+	if buf.String() != "ERROR giving up on batch dangling=\n" {
+		t.Errorf("unexpected message %q", buf.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,182 @@
+package dataart
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option changes a setting of the ClientConfig New starts from. Any function
+// modifying a *ClientConfig can be used as an Option.
+type Option func(cfg *ClientConfig)
+
+// DefaultConfig returns the configuration New starts from. The defaults suit most
+// production workloads:
+//
+//   - FlushBufferSize of 1000 with OverflowBlock
+//   - FlushNumWorkers of 4
+//   - FlushNumRetries of 3 with an ExponentialBackoff from 1 second up to 30
+//     seconds with jitter
+//   - FlushActionsBatchSize of 100 and FlushIdentitiesBatchSize of 1
+//   - FlushInterval of 5 seconds
+//   - HTTPClient with a timeout of 30 seconds
+//
+// Only APIKey has to be set on top of it.
+func DefaultConfig() ClientConfig {
+	return ClientConfig{
+		FlushBufferSize: 1000,
+		FlushNumWorkers: 4,
+		FlushNumRetries: 3,
+		FlushBackoff: ExponentialBackoff{
+			Initial: time.Second,
+			Max:     30 * time.Second,
+			Jitter:  true,
+		},
+		FlushActionsBatchSize:    100,
+		FlushIdentitiesBatchSize: 1,
+		FlushInterval:            5 * time.Second,
+		HTTPClient:               &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// WithBufferSize sets FlushBufferSize.
+func WithBufferSize(n int) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushBufferSize = n
+	}
+}
+
+// WithOverflowPolicy sets FlushOverflowPolicy.
+func WithOverflowPolicy(p OverflowPolicy) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushOverflowPolicy = p
+	}
+}
+
+// WithWorkers sets FlushNumWorkers.
+func WithWorkers(n int) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushNumWorkers = n
+	}
+}
+
+// WithRetries sets FlushNumRetries.
+func WithRetries(n int) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushNumRetries = n
+	}
+}
+
+// WithBackoff sets FlushBackoff.
+func WithBackoff(b BackoffPolicy) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushBackoff = b
+	}
+}
+
+// WithBatchSize sets FlushActionsBatchSize.
+func WithBatchSize(n int) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushActionsBatchSize = n
+	}
+}
+
+// WithIdentitiesBatchSize sets FlushIdentitiesBatchSize.
+func WithIdentitiesBatchSize(n int) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushIdentitiesBatchSize = n
+	}
+}
+
+// WithFlushInterval sets FlushInterval.
+func WithFlushInterval(d time.Duration) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FlushInterval = d
+	}
+}
+
+// WithHTTPClient sets HTTPClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(cfg *ClientConfig) {
+		cfg.HTTPClient = c
+	}
+}
+
+// WithEndpoint sets Endpoint.
+func WithEndpoint(url string) Option {
+	return func(cfg *ClientConfig) {
+		cfg.Endpoint = url
+	}
+}
+
+// WithAPIVersion sets APIVersion.
+func WithAPIVersion(v string) Option {
+	return func(cfg *ClientConfig) {
+		cfg.APIVersion = v
+	}
+}
+
+// WithEndpointPaths sets ActionsPath and IdentitiesPath. Empty paths keep their
+// default.
+func WithEndpointPaths(actionsPath, identitiesPath string) Option {
+	return func(cfg *ClientConfig) {
+		cfg.ActionsPath = actionsPath
+		cfg.IdentitiesPath = identitiesPath
+	}
+}
+
+// WithFailover sets FailoverStrategy and FailoverEndpoints.
+func WithFailover(strategy FailoverStrategy, endpoints ...string) Option {
+	return func(cfg *ClientConfig) {
+		cfg.FailoverStrategy = strategy
+		cfg.FailoverEndpoints = endpoints
+	}
+}
+
+// WithCompression sets Compression.
+func WithCompression(c Compression) Option {
+	return func(cfg *ClientConfig) {
+		cfg.Compression = c
+	}
+}
+
+// WithQueueDir sets QueueDir.
+func WithQueueDir(dir string) Option {
+	return func(cfg *ClientConfig) {
+		cfg.QueueDir = dir
+	}
+}
+
+// WithDeadLetterSink sets DeadLetterSink.
+func WithDeadLetterSink(sink DeadLetterSink) Option {
+	return func(cfg *ClientConfig) {
+		cfg.DeadLetterSink = sink
+	}
+}
+
+// WithLogger sets Logger.
+func WithLogger(l Logger) Option {
+	return func(cfg *ClientConfig) {
+		cfg.Logger = l
+	}
+}
+
+// WithTracer sets Tracer.
+func WithTracer(t Tracer) Option {
+	return func(cfg *ClientConfig) {
+		cfg.Tracer = t
+	}
+}
+
+// New creates a new Client instance sending with given apiKey. It starts from
+// DefaultConfig and applies opts in order. All problems of the resulting
+// configuration are reported at once as a MultiError.
+func New(apiKey string, opts ...Option) (*Client, error) {
+	cfg := DefaultConfig()
+	cfg.APIKey = apiKey
+
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return NewClient(cfg)
+}
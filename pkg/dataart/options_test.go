@@ -0,0 +1,130 @@
+package dataart
+
+import (
+	"context"
+	gohttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	c, err := New("api-key")
+	if err != nil {
+		t.Fatalf("creating client with defaults failed with error: %s", err.Error())
+	}
+	c.Close()
+
+	if c.Config.FlushActionsBatchSize != 100 || c.Config.FlushNumWorkers != 4 || c.Config.HTTPClient == nil {
+		t.Errorf("expected default config, got %+v", c.Config)
+		t.Fail()
+	}
+
+	_, err = New("", WithWorkers(0), WithBatchSize(0))
+	merr, ok := err.(MultiError)
+	if !ok || len(merr) != 3 {
+		t.Fatalf("expected all 3 problems to be reported, got %v", err)
+	}
+
+	for _, field := range []string{"APIKey", "FlushNumWorkers", "FlushActionsBatchSize"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("expected error to mention %s, got %q", field, err.Error())
+			t.Fail()
+		}
+	}
+
+	_, err = New("api-key", WithFailover(FailoverStrategy(9), "eu.example.com"))
+	if merr, ok := err.(MultiError); !ok || len(merr) != 2 {
+		t.Errorf("expected invalid failover settings to be reported, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestNew_WithOptions(t *testing.T) {
+	t.Parallel()
+
+	var received int32
+	s := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		atomic.AddInt32(&received, 1)
+		w.WriteHeader(gohttp.StatusOK)
+	}))
+	defer s.Close()
+
+	c, err := New("api-key",
+		WithEndpoint(s.URL),
+		WithHTTPClient(s.Client()),
+		WithWorkers(1),
+		WithBatchSize(2),
+		WithFlushInterval(time.Minute),
+		func(cfg *ClientConfig) {
+			cfg.CompressionMinSize = 1024
+		},
+	)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+	defer c.Close()
+
+	if c.Config.CompressionMinSize != 1024 {
+		t.Error("expected custom options to be applied")
+		t.Fail()
+	}
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.Flush(ctx); err != nil {
+		t.Fatalf("flushing failed with error: %s", err.Error())
+	}
+
+	if n := atomic.LoadInt32(&received); n != 1 {
+		t.Errorf("expected a single batch at the custom endpoint, got %d requests", n)
+		t.Fail()
+	}
+}
+
+func TestNew_WithEndpointPaths(t *testing.T) {
+	t.Parallel()
+
+	paths := make(chan string, 2)
+	s := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		paths <- r.URL.Path
+		w.WriteHeader(gohttp.StatusOK)
+	}))
+	defer s.Close()
+
+	_, err := New("api-key", WithEndpoint("src.example.com"))
+	if err == nil {
+		t.Error("expected a relative endpoint to be rejected")
+		t.Fail()
+	}
+
+	c, err := New("api-key",
+		WithEndpoint(s.URL+"/eu"),
+		WithAPIVersion("v2"),
+		WithEndpointPaths("", "/identities"),
+		WithHTTPClient(s.Client()),
+	)
+	if err != nil {
+		t.Fatalf("creating client failed with error: %s", err.Error())
+	}
+
+	c.EmitAction("event-key", "user-key", false, time.Now(), nil)
+	c.Identify("user-key", nil)
+	c.Close()
+
+	got := map[string]bool{<-paths: true, <-paths: true}
+	for _, p := range []string{"/eu/v2/events/send-actions", "/eu/v2/identities"} {
+		if !got[p] {
+			t.Errorf("expected a request to %s, got %v", p, got)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package dataart
+
+import (
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+// OverflowPolicy decides what happens to new actions and identities while the
+// client can't keep up and its buffer is full.
+type OverflowPolicy = http.OverflowPolicy
+
+const (
+	// OverflowBlock makes EmitAction and Identify wait until there's room. This is
+	// the default.
+	OverflowBlock = http.OverflowBlock
+
+	// OverflowDropNewest rejects new objects with ErrBufferFull.
+	OverflowDropNewest = http.OverflowDropNewest
+
+	// OverflowDropOldest evicts the oldest buffered object to make room for the
+	// new one, which is accepted.
+	OverflowDropOldest = http.OverflowDropOldest
+
+	// OverflowSpillToDisk keeps new objects in the on-disk queue and sends them
+	// once the buffer drains. It requires ClientConfig.QueueDir.
+	OverflowSpillToDisk = http.OverflowSpillToDisk
+)
+
+// ErrBufferFull is returned by EmitAction and Identify when OverflowDropNewest
+// drops the given object.
+var ErrBufferFull = http.ErrBufferFull
+
+// DropCounts holds the number of objects dropped by the overflow policy.
+type DropCounts struct {
+	Actions    int64
+	Identities int64
+}
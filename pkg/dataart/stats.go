@@ -0,0 +1,17 @@
+package dataart
+
+import (
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+// Stats is a snapshot of the client's counters and gauges returned by
+// Client.Stats. Counters only ever grow, so rates can be derived from
+// consecutive snapshots.
+type Stats = http.Stats
+
+// EndpointStats is a snapshot of the requests sent to a single endpoint,
+// including their status codes and latency distribution.
+type EndpointStats = http.EndpointStats
+
+// Histogram is a snapshot of a request latency distribution.
+type Histogram = http.Histogram
@@ -0,0 +1,12 @@
+package dataart
+
+import (
+	"github.com/dataart-ai/dataart-go/internal/http"
+)
+
+// Tracer traces emitted actions and the requests carrying them. The dataartotel
+// package implements it on top of OpenTelemetry.
+type Tracer = http.Tracer
+
+// UploadInfo describes a single request attempt to a Tracer.
+type UploadInfo = http.UploadInfo
@@ -0,0 +1,455 @@
+package dataart
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Tracker is the public API of Client. Depend on it instead of *Client to swap the
+// client for a decorator or a test double.
+type Tracker interface {
+	EmitAction(key string, userKey string, isAnonymousUser bool,
+		timestamp time.Time, metadata map[string]interface{}) error
+	EmitActionContext(ctx context.Context, key string, userKey string,
+		isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error
+	EmitActionWithID(ctx context.Context, id string, key string, userKey string,
+		isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error
+	EmitActionAsync(ctx context.Context, key string, userKey string,
+		isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) (*Delivery, error)
+	Identify(userKey string, metadata map[string]interface{}) error
+	IdentifyContext(ctx context.Context, userKey string, metadata map[string]interface{}) error
+	ReplayDeadLetters() (int, error)
+	Flush(ctx context.Context) error
+	Dropped() DropCounts
+	Stats() Stats
+	CircuitState() CircuitState
+	Close()
+	CloseContext(ctx context.Context) error
+}
+
+var _ Tracker = (*Client)(nil)
+
+// NopTracker is a Tracker that discards everything. Use it where tracking is
+// disabled.
+type NopTracker struct{}
+
+// EmitAction does nothing.
+func (NopTracker) EmitAction(key string, userKey string, isAnonymousUser bool,
+	timestamp time.Time, metadata map[string]interface{}) error {
+
+	return nil
+}
+
+// EmitActionContext does nothing.
+func (NopTracker) EmitActionContext(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	return nil
+}
+
+// EmitActionWithID does nothing.
+func (NopTracker) EmitActionWithID(ctx context.Context, id string, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	return nil
+}
+
+// EmitActionAsync returns a Delivery that's already resolved.
+func (NopTracker) EmitActionAsync(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) (*Delivery, error) {
+
+	return NewResolvedDelivery(nil), nil
+}
+
+// Identify does nothing.
+func (NopTracker) Identify(userKey string, metadata map[string]interface{}) error {
+	return nil
+}
+
+// IdentifyContext does nothing.
+func (NopTracker) IdentifyContext(ctx context.Context, userKey string, metadata map[string]interface{}) error {
+	return nil
+}
+
+// ReplayDeadLetters does nothing.
+func (NopTracker) ReplayDeadLetters() (int, error) {
+	return 0, nil
+}
+
+// Flush does nothing.
+func (NopTracker) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Dropped returns zero counts.
+func (NopTracker) Dropped() DropCounts {
+	return DropCounts{}
+}
+
+// Stats returns zero stats.
+func (NopTracker) Stats() Stats {
+	return Stats{}
+}
+
+// CircuitState returns CircuitClosed.
+func (NopTracker) CircuitState() CircuitState {
+	return CircuitClosed
+}
+
+// Close does nothing.
+func (NopTracker) Close() {}
+
+// CloseContext does nothing.
+func (NopTracker) CloseContext(ctx context.Context) error {
+	return nil
+}
+
+// MultiTracker fans out every call to several trackers, for example to send the
+// same actions to two projects during a migration. Errors of the trackers are
+// reported together as a MultiError.
+type MultiTracker struct {
+	trackers []Tracker
+}
+
+func (m *MultiTracker) each(fn func(t Tracker) error) error {
+	var errs MultiError
+	for _, t := range m.trackers {
+		if err := fn(t); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs.errorOrNil()
+}
+
+// parallel works like each but calls fn for all trackers concurrently, so they
+// share the deadline of a context.
+func (m *MultiTracker) parallel(fn func(t Tracker) error) error {
+	errs := make([]error, len(m.trackers))
+
+	var wg sync.WaitGroup
+	for i, t := range m.trackers {
+		wg.Add(1)
+		go func(i int, t Tracker) {
+			defer wg.Done()
+			errs[i] = fn(t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var res MultiError
+	for _, err := range errs {
+		if err != nil {
+			res = append(res, err)
+		}
+	}
+
+	return res.errorOrNil()
+}
+
+// EmitAction emits the action to all trackers.
+func (m *MultiTracker) EmitAction(key string, userKey string, isAnonymousUser bool,
+	timestamp time.Time, metadata map[string]interface{}) error {
+
+	return m.each(func(t Tracker) error {
+		return t.EmitAction(key, userKey, isAnonymousUser, timestamp, metadata)
+	})
+}
+
+// EmitActionContext emits the action to all trackers.
+func (m *MultiTracker) EmitActionContext(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	return m.each(func(t Tracker) error {
+		return t.EmitActionContext(ctx, key, userKey, isAnonymousUser, timestamp, metadata)
+	})
+}
+
+// EmitActionWithID emits the action to all trackers.
+func (m *MultiTracker) EmitActionWithID(ctx context.Context, id string, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	return m.each(func(t Tracker) error {
+		return t.EmitActionWithID(ctx, id, key, userKey, isAnonymousUser, timestamp, metadata)
+	})
+}
+
+// EmitActionAsync emits the action to all trackers. The returned Delivery is
+// resolved once the action is delivered by every tracker that accepted it, with
+// the first delivery error. It's returned along with the error of the trackers
+// that didn't accept the action.
+func (m *MultiTracker) EmitActionAsync(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) (*Delivery, error) {
+
+	var ds []*Delivery
+	err := m.each(func(t Tracker) error {
+		d, err := t.EmitActionAsync(ctx, key, userKey, isAnonymousUser, timestamp, metadata)
+		if err != nil {
+			return err
+		}
+
+		ds = append(ds, d)
+		return nil
+	})
+
+	return JoinDeliveries(ds...), err
+}
+
+// Identify identifies the user with all trackers.
+func (m *MultiTracker) Identify(userKey string, metadata map[string]interface{}) error {
+	return m.each(func(t Tracker) error {
+		return t.Identify(userKey, metadata)
+	})
+}
+
+// IdentifyContext identifies the user with all trackers.
+func (m *MultiTracker) IdentifyContext(ctx context.Context, userKey string, metadata map[string]interface{}) error {
+	return m.each(func(t Tracker) error {
+		return t.IdentifyContext(ctx, userKey, metadata)
+	})
+}
+
+// ReplayDeadLetters replays the dead letters of all trackers and returns the
+// total number of resubmitted ones.
+func (m *MultiTracker) ReplayDeadLetters() (int, error) {
+	total := 0
+	err := m.each(func(t Tracker) error {
+		n, err := t.ReplayDeadLetters()
+		total += n
+		return err
+	})
+
+	return total, err
+}
+
+// Flush flushes all trackers concurrently.
+func (m *MultiTracker) Flush(ctx context.Context) error {
+	return m.parallel(func(t Tracker) error {
+		return t.Flush(ctx)
+	})
+}
+
+// Dropped returns the sum of the drop counts of all trackers.
+func (m *MultiTracker) Dropped() DropCounts {
+	var res DropCounts
+	for _, t := range m.trackers {
+		dc := t.Dropped()
+		res.Actions += dc.Actions
+		res.Identities += dc.Identities
+	}
+
+	return res
+}
+
+// Stats returns the sum of the stats of all trackers. Stats of the same endpoint
+// are merged.
+func (m *MultiTracker) Stats() Stats {
+	var res Stats
+	for _, t := range m.trackers {
+		res = mergeStats(res, t.Stats())
+	}
+
+	return res
+}
+
+// CircuitState returns CircuitOpen if the circuit breaker of any tracker is open,
+// CircuitHalfOpen if any is half-open and CircuitClosed otherwise.
+func (m *MultiTracker) CircuitState() CircuitState {
+	res := CircuitClosed
+	for _, t := range m.trackers {
+		switch t.CircuitState() {
+		case CircuitOpen:
+			return CircuitOpen
+		case CircuitHalfOpen:
+			res = CircuitHalfOpen
+		}
+	}
+
+	return res
+}
+
+// Close closes all trackers concurrently.
+func (m *MultiTracker) Close() {
+	m.CloseContext(context.Background())
+}
+
+// CloseContext closes all trackers concurrently.
+func (m *MultiTracker) CloseContext(ctx context.Context) error {
+	return m.parallel(func(t Tracker) error {
+		return t.CloseContext(ctx)
+	})
+}
+
+func mergeStats(a, b Stats) Stats {
+	res := Stats{
+		ActionsEmitted:    a.ActionsEmitted + b.ActionsEmitted,
+		IdentitiesEmitted: a.IdentitiesEmitted + b.IdentitiesEmitted,
+		ActionsDropped:    a.ActionsDropped + b.ActionsDropped,
+		IdentitiesDropped: a.IdentitiesDropped + b.IdentitiesDropped,
+		BatchesSent:       a.BatchesSent + b.BatchesSent,
+		BytesSent:         a.BytesSent + b.BytesSent,
+		Retries:           a.Retries + b.Retries,
+		PermanentFailures: a.PermanentFailures + b.PermanentFailures,
+		QueueDepth:        a.QueueDepth + b.QueueDepth,
+		TaskQueueDepth:    a.TaskQueueDepth + b.TaskQueueDepth,
+		InFlight:          a.InFlight + b.InFlight,
+	}
+
+	if len(a.Endpoints)+len(b.Endpoints) == 0 {
+		return res
+	}
+
+	res.Endpoints = make(map[string]EndpointStats)
+	for _, eps := range []map[string]EndpointStats{a.Endpoints, b.Endpoints} {
+		for path, es := range eps {
+			res.Endpoints[path] = mergeEndpointStats(res.Endpoints[path], es)
+		}
+	}
+
+	return res
+}
+
+func mergeEndpointStats(a, b EndpointStats) EndpointStats {
+	res := EndpointStats{
+		Requests:        a.Requests + b.Requests,
+		TransportErrors: a.TransportErrors + b.TransportErrors,
+		StatusCodes:     make(map[int]int64),
+		Latency: Histogram{
+			Bounds: b.Latency.Bounds,
+			Counts: make([]int64, len(b.Latency.Counts)),
+			Count:  a.Latency.Count + b.Latency.Count,
+			Sum:    a.Latency.Sum + b.Latency.Sum,
+		},
+	}
+
+	for _, codes := range []map[int]int64{a.StatusCodes, b.StatusCodes} {
+		for code, n := range codes {
+			res.StatusCodes[code] += n
+		}
+	}
+
+	// All clients share the same latency bounds.
+	copy(res.Latency.Counts, a.Latency.Counts)
+	for i, n := range b.Latency.Counts {
+		res.Latency.Counts[i] += n
+	}
+
+	return res
+}
+
+// NewMultiTracker creates a new MultiTracker instance fanning out to given
+// trackers. Use this function to instantiate a concrete MultiTracker type.
+func NewMultiTracker(trackers ...Tracker) *MultiTracker {
+	return &MultiTracker{trackers: append([]Tracker(nil), trackers...)}
+}
+
+// FilterTracker passes only the actions accepted by its filter on to the wrapped
+// Tracker. Rejected actions are discarded without an error. Identities and all
+// other calls are passed on as they are.
+type FilterTracker struct {
+	Tracker
+	keep func(a Action) bool
+}
+
+// EmitAction emits the action if the filter accepts it.
+func (f *FilterTracker) EmitAction(key string, userKey string, isAnonymousUser bool,
+	timestamp time.Time, metadata map[string]interface{}) error {
+
+	if !f.keep(newAction("", key, userKey, isAnonymousUser, timestamp, metadata)) {
+		return nil
+	}
+
+	return f.Tracker.EmitAction(key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+// EmitActionContext emits the action if the filter accepts it.
+func (f *FilterTracker) EmitActionContext(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	if !f.keep(newAction("", key, userKey, isAnonymousUser, timestamp, metadata)) {
+		return nil
+	}
+
+	return f.Tracker.EmitActionContext(ctx, key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+// EmitActionWithID emits the action if the filter accepts it.
+func (f *FilterTracker) EmitActionWithID(ctx context.Context, id string, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	if !f.keep(newAction(id, key, userKey, isAnonymousUser, timestamp, metadata)) {
+		return nil
+	}
+
+	return f.Tracker.EmitActionWithID(ctx, id, key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+// EmitActionAsync emits the action if the filter accepts it. A rejected action
+// gets a Delivery that's already resolved.
+func (f *FilterTracker) EmitActionAsync(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) (*Delivery, error) {
+
+	if !f.keep(newAction("", key, userKey, isAnonymousUser, timestamp, metadata)) {
+		return NewResolvedDelivery(nil), nil
+	}
+
+	return f.Tracker.EmitActionAsync(ctx, key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+func newAction(id string, key string, userKey string, isAnonymousUser bool,
+	timestamp time.Time, metadata map[string]interface{}) Action {
+
+	return Action{
+		ID:              id,
+		Key:             key,
+		UserKey:         userKey,
+		IsAnonymousUser: isAnonymousUser,
+		Timestamp:       timestamp,
+		Metadata:        metadata,
+	}
+}
+
+// NewFilterTracker creates a new FilterTracker instance passing the actions keep
+// returns true for on to t. Use this function to instantiate a concrete
+// FilterTracker type.
+func NewFilterTracker(t Tracker, keep func(a Action) bool) (*FilterTracker, error) {
+	if keep == nil {
+		return nil, errors.New("keep function can't be nil")
+	}
+
+	return &FilterTracker{Tracker: t, keep: keep}, nil
+}
+
+// NewSamplingTracker creates a FilterTracker passing on the actions of a rate
+// fraction of users, from 0 for none to 1 for all. Users are sampled by a hash of
+// their key, so the actions of a sampled user are kept together. Actions without
+// a user key are sampled by their event ID if one is given, otherwise each one
+// on its own at random.
+func NewSamplingTracker(t Tracker, rate float64) (*FilterTracker, error) {
+	if rate < 0 || rate > 1 || math.IsNaN(rate) {
+		return nil, errors.New("sampling rate must be between 0 and 1")
+	}
+
+	threshold := uint64(rate * (1 << 32))
+	keep := func(a Action) bool {
+		key := a.UserKey
+		if len(key) == 0 {
+			key = a.ID
+		}
+
+		if len(key) == 0 {
+			return rand.Float64() < rate
+		}
+
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return uint64(h.Sum32()) < threshold
+	}
+
+	return NewFilterTracker(t, keep)
+}
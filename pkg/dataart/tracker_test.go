@@ -0,0 +1,284 @@
+package dataart
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockTracker struct {
+	NopTracker
+	mx         sync.Mutex
+	keys       []string
+	identities []string
+	err        error
+	stats      Stats
+}
+
+func (m *mockTracker) EmitActionContext(ctx context.Context, key string, userKey string,
+	isAnonymousUser bool, timestamp time.Time, metadata map[string]interface{}) error {
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+func (m *mockTracker) EmitAction(key string, userKey string, isAnonymousUser bool,
+	timestamp time.Time, metadata map[string]interface{}) error {
+
+	return m.EmitActionContext(context.Background(), key, userKey, isAnonymousUser, timestamp, metadata)
+}
+
+func (m *mockTracker) Identify(userKey string, metadata map[string]interface{}) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.identities = append(m.identities, userKey)
+	return m.err
+}
+
+func (m *mockTracker) Stats() Stats {
+	return m.stats
+}
+
+func (m *mockTracker) Keys() []string {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	return append([]string(nil), m.keys...)
+}
+
+func TestMultiTracker_WithFanOut(t *testing.T) {
+	t.Parallel()
+
+	a, b := &mockTracker{}, &mockTracker{}
+	m := NewMultiTracker(a, b)
+
+	if err := m.EmitAction("signup", "user-1", false, time.Now(), nil); err != nil {
+		t.Fatalf("emitting action failed with error: %s", err.Error())
+	}
+	if err := m.Identify("user-1", nil); err != nil {
+		t.Fatalf("identifying failed with error: %s", err.Error())
+	}
+
+	for _, mt := range []*mockTracker{a, b} {
+		if keys := mt.Keys(); len(keys) != 1 || keys[0] != "signup" || len(mt.identities) != 1 {
+			t.Errorf("expected every tracker to receive the calls, got %v and %v", keys, mt.identities)
+			t.Fail()
+		}
+	}
+
+	b.err = errors.New("boom")
+	err := m.EmitAction("login", "user-1", false, time.Now(), nil)
+	merr, ok := err.(MultiError)
+	if !ok || len(merr) != 1 || merr[0] != b.err {
+		t.Errorf("expected a MultiError holding the failing tracker's error, got %v", err)
+		t.Fail()
+	}
+
+	if keys := a.Keys(); len(keys) != 2 {
+		t.Errorf("a failing tracker shouldn't stop the others, got %v", keys)
+		t.Fail()
+	}
+
+	if err := m.CloseContext(context.Background()); err != nil {
+		t.Errorf("closing failed with error: %s", err.Error())
+		t.Fail()
+	}
+}
+
+func TestMultiTracker_WithEmitActionAsync(t *testing.T) {
+	t.Parallel()
+
+	m := NewMultiTracker(NopTracker{}, NopTracker{})
+
+	d, err := m.EmitActionAsync(context.Background(), "signup", "user-1", false, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("emitting action failed with error: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := d.Wait(ctx); err != nil {
+		t.Errorf("expected a resolved delivery, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestMultiTracker_WithStats(t *testing.T) {
+	t.Parallel()
+
+	es := func(n int64) map[string]EndpointStats {
+		return map[string]EndpointStats{
+			"/events/send-actions": {
+				Requests:    n,
+				StatusCodes: map[int]int64{200: n},
+				Latency:     Histogram{Counts: []int64{n, 0}, Count: n, Sum: time.Duration(n)},
+			},
+		}
+	}
+
+	m := NewMultiTracker(
+		&mockTracker{stats: Stats{ActionsEmitted: 2, QueueDepth: 1, Endpoints: es(2)}},
+		&mockTracker{stats: Stats{ActionsEmitted: 3, QueueDepth: 4, Endpoints: es(3)}},
+		NopTracker{},
+	)
+
+	s := m.Stats()
+	if s.ActionsEmitted != 5 || s.QueueDepth != 5 {
+		t.Errorf("expected summed counters, got %+v", s)
+		t.Fail()
+	}
+
+	ep := s.Endpoints["/events/send-actions"]
+	if ep.Requests != 5 || ep.StatusCodes[200] != 5 || ep.Latency.Counts[0] != 5 || ep.Latency.Count != 5 {
+		t.Errorf("expected merged endpoint stats, got %+v", ep)
+		t.Fail()
+	}
+}
+
+func TestJoinDeliveries(t *testing.T) {
+	t.Parallel()
+
+	failed := errors.New("request failed")
+	d := JoinDeliveries(NewResolvedDelivery(nil), nil, NewResolvedDelivery(failed))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := d.Wait(ctx); err != failed {
+		t.Errorf("expected the first error among the deliveries, got %v", err)
+		t.Fail()
+	}
+
+	if a, b := NewEventID(), NewEventID(); len(a) != 26 || a == b {
+		t.Errorf("expected unique ULIDs, got %q and %q", a, b)
+		t.Fail()
+	}
+}
+
+func TestFilterTracker(t *testing.T) {
+	t.Parallel()
+
+	mt := &mockTracker{}
+	f, err := NewFilterTracker(mt, func(a Action) bool {
+		return a.Key != "heartbeat"
+	})
+	if err != nil {
+		t.Fatalf("creating filter tracker failed with error: %s", err.Error())
+	}
+
+	f.EmitAction("heartbeat", "user-1", false, time.Now(), nil)
+	f.EmitAction("signup", "user-1", false, time.Now(), nil)
+	f.EmitActionWithID(context.Background(), "id", "heartbeat", "user-1", false, time.Now(), nil)
+
+	d, err := f.EmitActionAsync(context.Background(), "heartbeat", "user-1", false, time.Now(), nil)
+	if err != nil || d.Err() != nil {
+		t.Errorf("expected a filtered action to resolve right away, got %v", err)
+		t.Fail()
+	}
+
+	f.Identify("user-1", nil)
+
+	if keys := mt.Keys(); len(keys) != 1 || keys[0] != "signup" {
+		t.Errorf("expected only the signup action to pass, got %v", keys)
+		t.Fail()
+	}
+
+	if len(mt.identities) != 1 {
+		t.Errorf("expected identities to pass, got %v", mt.identities)
+		t.Fail()
+	}
+
+	if _, err := NewFilterTracker(mt, nil); err == nil {
+		t.Error("expected a nil filter to be rejected")
+		t.Fail()
+	}
+}
+
+func TestSamplingTracker(t *testing.T) {
+	t.Parallel()
+
+	for _, rate := range []float64{-0.1, 1.1} {
+		if _, err := NewSamplingTracker(NopTracker{}, rate); err == nil {
+			t.Errorf("expected rate %v to be rejected", rate)
+			t.Fail()
+		}
+	}
+
+	cases := []struct {
+		rate     float64
+		min, max int
+	}{
+		{0, 0, 0},
+		{0.5, 400, 600},
+		{1, 1000, 1000},
+	}
+
+	for _, c := range cases {
+		mt := &mockTracker{}
+		s, err := NewSamplingTracker(mt, c.rate)
+		if err != nil {
+			t.Fatalf("creating sampling tracker failed with error: %s", err.Error())
+		}
+
+		for i := 0; i < 1000; i++ {
+			s.EmitAction("signup", fmt.Sprintf("user-%d", i), false, time.Now(), nil)
+		}
+
+		if n := len(mt.Keys()); n < c.min || n > c.max {
+			t.Errorf("rate %v: expected between %d and %d actions, got %d", c.rate, c.min, c.max, n)
+			t.Fail()
+		}
+	}
+
+	// Actions of the same user are either all kept or all dropped.
+	mt := &mockTracker{}
+	s, _ := NewSamplingTracker(mt, 0.5)
+	for i := 0; i < 10; i++ {
+		s.EmitAction("signup", "user-1", false, time.Now(), nil)
+	}
+
+	if n := len(mt.Keys()); n != 0 && n != 10 {
+		t.Errorf("expected users to be sampled consistently, got %d of 10 actions", n)
+		t.Fail()
+	}
+
+	// Actions without a user key aren't all kept or dropped together.
+	mt = &mockTracker{}
+	s, _ = NewSamplingTracker(mt, 0.5)
+	for i := 0; i < 1000; i++ {
+		s.EmitAction("heartbeat", "", true, time.Now(), nil)
+	}
+
+	if n := len(mt.Keys()); n < 400 || n > 600 {
+		t.Errorf("expected anonymous actions to be sampled one by one, got %d of 1000 actions", n)
+		t.Fail()
+	}
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		a := Action{ID: fmt.Sprintf("id-%d", i)}
+		if s.keep(a) != s.keep(a) {
+			t.Fatalf("expected %s to be sampled by its event ID", a.ID)
+		}
+		if s.keep(a) {
+			kept++
+		}
+	}
+
+	if kept < 400 || kept > 600 {
+		t.Errorf("expected anonymous actions with IDs to be sampled at rate, got %d of 1000 actions", kept)
+		t.Fail()
+	}
+}